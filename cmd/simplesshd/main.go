@@ -1,25 +1,38 @@
 package main
 
 import (
+	"bufio"
 	"flag"
 	"fmt"
+	"net"
 	"os"
+	"path"
+	"strings"
 
 	"github.com/rectcircle/stdiotunnel/internal/simplesshd"
+	"golang.org/x/term"
 )
 
-func parseArgs() (host string, port uint16) {
+func parseArgs() (config simplesshd.Config) {
 	var (
-		portUint64 uint
-		help       bool
+		portUint64   uint
+		acceptEnv    string
+		hashPassword string
+		help         bool
 	)
-	host = "127.0.0.1"
-	// Due to security, not allow config host
-	// flag.StringVar(&host ,"h", "127.0.0.1", "host")
+	flag.StringVar(&config.Host, "h", "127.0.0.1", "host, other than loopback requires ~/.stdiotunnel/authorized_keys or ~/.stdiotunnel/sshd_passwd")
 	flag.UintVar(&portUint64, "p", 20022, "port")
+	flag.BoolVar(&config.NoAuth, "no-auth", false, "accept every client even if the auth files exist, only for a loopback host")
+	flag.StringVar(&acceptEnv, "accept-env", "", "comma separated name patterns of client env variables applied to the shell besides LANG and LC_*, e.g. `EDITOR,GIT_*`")
+	flag.BoolVar(&config.GatewayPorts, "gateway-ports", false, "remote forwardings listen on the address the client asks, instead of loopback")
+	flag.BoolVar(&config.X11Forwarding, "x11", false, "accept x11 forwarding")
+	flag.StringVar(&config.SFTPRoot, "sftp-root", "", "`DIR` as the / of the sftp subsystem, default is the real file system")
+	flag.StringVar(&hashPassword, "hash-password", "", "read a password of `USER` from stdin, output the line of ~/.stdiotunnel/sshd_passwd and exit")
 	flag.BoolVar(&help, "help", false, "output this help")
 	flag.Usage = func() {
-		fmt.Fprintf(flag.CommandLine.Output(), "Start a Sample sshd Server (Public Auth)\nUsage of `%s`:\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "Start a Sample sshd Server (Public Key or Password Auth)\n"+
+			"Clients authenticate by keys of ~/.stdiotunnel/authorized_keys or passwords of ~/.stdiotunnel/sshd_passwd,\n"+
+			"if neither file exists, a loopback host accepts every client\nUsage of `%s`:\n", os.Args[0])
 		flag.PrintDefaults()
 	}
 	flag.Parse()
@@ -27,14 +40,70 @@ func parseArgs() (host string, port uint16) {
 		flag.Usage()
 		os.Exit(0)
 	}
+	if hashPassword != "" {
+		printPasswordLine(hashPassword)
+		os.Exit(0)
+	}
 	if portUint64 >= (1 << 16) {
 		os.Stderr.WriteString("error: port must is uint16\n")
 		os.Exit(2)
 	}
-	port = uint16(portUint64)
+	if ip := net.ParseIP(config.Host); config.NoAuth && (ip == nil || !ip.IsLoopback()) {
+		os.Stderr.WriteString("error: -no-auth requires a loopback host\n")
+		os.Exit(2)
+	}
+	for _, pattern := range strings.Split(acceptEnv, ",") {
+		if pattern = strings.TrimSpace(pattern); pattern == "" {
+			continue
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			fmt.Fprintf(os.Stderr, "error: invalid -accept-env pattern %q\n", pattern)
+			os.Exit(2)
+		}
+		config.AcceptEnv = append(config.AcceptEnv, pattern)
+	}
+	config.Port = uint16(portUint64)
 	return
 }
 
+// printPasswordLine - read the password without echo if stdin is a terminal
+func printPasswordLine(user string) {
+	var (
+		password []byte
+		err      error
+	)
+	if strings.Contains(user, ":") {
+		os.Stderr.WriteString("error: user must not contain `:`\n")
+		os.Exit(2)
+	}
+	if fd := int(os.Stdin.Fd()); term.IsTerminal(fd) {
+		fmt.Fprintf(os.Stderr, "Password of %s: ", user)
+		password, err = term.ReadPassword(fd)
+		os.Stderr.WriteString("\n")
+	} else {
+		var line string
+		line, err = bufio.NewReader(os.Stdin).ReadString('\n')
+		password = []byte(strings.TrimRight(line, "\r\n"))
+		if len(password) > 0 {
+			err = nil
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: read password: %v\n", err)
+		os.Exit(1)
+	}
+	if len(password) == 0 {
+		os.Stderr.WriteString("error: empty password\n")
+		os.Exit(1)
+	}
+	line, err := simplesshd.HashPassword(user, password)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %s\n", err)
+		os.Exit(1)
+	}
+	fmt.Println(line)
+}
+
 func main() {
 	simplesshd.ListenAndServe(parseArgs())
 }
@@ -4,34 +4,173 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/rectcircle/stdiotunnel/internal/stdiotunnel"
+	"github.com/rectcircle/stdiotunnel/internal/stdiotunnel/control"
+	"github.com/rectcircle/stdiotunnel/internal/variable"
 	"github.com/rectcircle/stdiotunnel/tools"
 )
 
 var (
 	subcommandKeyServer = "server"
 	subcommandKeyClient = "client"
+	subcommandKeyCtl    = "ctl"
+	subcommandKeyDaemon = "daemon"
 	subcommandKeyHelp   = "help"
 )
 
-func parseClientArgs(args []string) (host string, port uint16, interactive bool, command string) {
+var (
+	defaultControlSocket = path.Join(variable.ConfigBaseDir, variable.ControlSocketFileName)
+	defaultConfigFile    = path.Join(variable.ConfigBaseDir, variable.ConfigFileName)
+)
+
+// byteSizeFlag - flag.Value of a byte size like 512K
+type byteSizeFlag uint64
+
+func (f *byteSizeFlag) String() string {
+	return strconv.FormatUint(uint64(*f), 10)
+}
+
+func (f *byteSizeFlag) Set(s string) error {
+	n, err := tools.ParseByteSize(s)
+	*f = byteSizeFlag(n)
+	return err
+}
+
+// forwardsFlag - repeatable flag.Value of forwards
+type forwardsFlag struct {
+	forwards *[]stdiotunnel.Forward
+	parse    func(spec string) (stdiotunnel.Forward, error)
+}
+
+func (f forwardsFlag) String() string {
+	return ""
+}
+
+func (f forwardsFlag) Set(s string) error {
+	forward, err := f.parse(s)
+	if err == nil {
+		*f.forwards = append(*f.forwards, forward)
+	}
+	return err
+}
+
+func parseClientArgs(args []string) (config stdiotunnel.ClientConfig) {
 	var (
-		portUint64 uint
-		help       bool
+		portUint64     uint
+		priorityUint64 uint
+		profile        string
+		configFile     string
+		forwards       []stdiotunnel.Forward
+		help           bool
 	)
 	subcommand := subcommandKeyClient
 	flagset := flag.NewFlagSet(subcommand, flag.ExitOnError)
-	host = "127.0.0.1"
 	// Due to security, not allow config host
 	// flagset.StringVar(&host ,"h", "127.0.0.1", "host - bind host")
-	flagset.UintVar(&portUint64, "p", 20096, "port - bind port")
-	flagset.BoolVar(&interactive, "i", true, "interactive - whether start command with interactive mode (with pty mode) to initialize")
-	flagset.StringVar(&command, "c", tools.GetUnixUserShell(), "command - command to be launched")
+	flagset.UintVar(&portUint64, "p", 20096, "port - bind port, forward to the default target of server, used if no other forward")
+	flagset.Var(forwardsFlag{&forwards, stdiotunnel.ParseLocalForward}, "L", "local forward - `PORT[:HOST:PORT]`, bind port and forward to host:port (must be permitted by server), can repeat")
+	flagset.Var(forwardsFlag{&forwards, stdiotunnel.ParseRemoteForward}, "R", "remote forward - `PORT:HOST:PORT`, the server binds its loopback port and the client forwards to host:port, can repeat")
+	flagset.Var(forwardsFlag{&forwards, stdiotunnel.ParseDynamicForward}, "D", "dynamic forward - `PORT`, bind port as a SOCKS5 proxy (targets must be permitted by server), can repeat")
+	flagset.StringVar(&profile, "profile", "", "profile - name of a profile in the config file, flags override profile values")
+	flagset.StringVar(&configFile, "config", defaultConfigFile, "config - config file of profiles")
+	flagset.BoolVar(&config.Interactive, "i", true, "interactive - whether start command with interactive mode (with pty mode) to initialize")
+	flagset.StringVar(&config.Command, "c", tools.GetUnixUserShell(), "command - command to be launched")
+	flagset.UintVar(&priorityUint64, "priority", 0, "priority - scheduling weight (1-255) of connections from this port on the shared stdio link, 0 means default")
+	flagset.Var((*byteSizeFlag)(&config.Limits.GlobalUp), "global-up", "rate limit (bytes per second, e.g. 512K) from client to server of the whole stdio link, 0 means unlimited")
+	flagset.Var((*byteSizeFlag)(&config.Limits.GlobalDown), "global-down", "rate limit from server to client of the whole stdio link")
+	flagset.Var((*byteSizeFlag)(&config.Limits.ListenerUp), "listener-up", "rate limit from client to server of all connections from this port")
+	flagset.Var((*byteSizeFlag)(&config.Limits.ListenerDown), "listener-down", "rate limit from server to client of all connections from this port")
+	flagset.Var((*byteSizeFlag)(&config.Limits.TunnelUp), "tunnel-up", "rate limit from client to server of each connection")
+	flagset.Var((*byteSizeFlag)(&config.Limits.TunnelDown), "tunnel-down", "rate limit from server to client of each connection")
+	flagset.DurationVar(&config.OpenTimeout, "open-timeout", variable.OpenTimeout, "open timeout - max wait for server to open a connection, 0 means no timeout")
+	flagset.BoolVar(&config.Bootstrap, "bootstrap", false, "bootstrap - upload this binary (or one of -bootstrap-dir) through the remote shell of interactive command and execute it as server")
+	flagset.StringVar(&config.BootstrapDir, "bootstrap-dir", "", "bootstrap dir - local dir of server binaries named stdiotunnel-GOOS-GOARCH for other platforms")
+	flagset.StringVar(&config.BootstrapServerArgs, "bootstrap-args", "", "bootstrap args - space separated arguments of the bootstrapped server, e.g. \"-p 22\", each one is quoted for the remote shell")
+	flagset.DurationVar(&config.InitTimeout, "init-timeout", variable.InitTimeout, "init timeout - the server must be ready within it after the command started, 0 means no timeout; if neither this flag nor the profile sets it, it only applies without a terminal (e.g. cron), at a terminal end a stuck init with ^C")
+	flagset.DurationVar(&config.AuthTimeout, "auth-timeout", variable.AuthTimeout, "auth timeout - with Auth rules of profile, the next prompt or the ready trigger must appear within it, 0 means no timeout")
+	flagset.DurationVar(&config.IdleTimeout, "idle-timeout", 0, "idle timeout - close a connection from this port without data for this duration, 0 means never")
+	flagset.DurationVar(&config.KeepAlive, "keepalive", 0, "keepalive - TCP keepalive period of connections on both sides, for silent protocols, 0 means system default")
+	flagset.StringVar(&config.Encoding, "encoding", "", "encoding - link encoding for terminals which are not 8-bit clean (e.g. serial console, telnet): raw, base64 or escape, empty means raw")
+	flagset.BoolVar(&config.Checksum, "checksum", false, "checksum - checksum every segment, a lossy link (e.g. serial console) resyncs and closes only the connections which lost data")
+	flagset.StringVar(&config.ControlSocket, "control", "", "control - unix socket path of control interface (e.g. "+defaultControlSocket+"), empty means disable")
 	flagset.BoolVar(&help, "help", false, "output this subcommand help")
 	flagset.Usage = func() {
 		fmt.Fprintf(flagset.Output(), "Start a Stdio Tunnel Client\nUsage of `%s %s`:\n", os.Args[0], subcommand)
 		flagset.PrintDefaults()
+		fmt.Fprintf(flagset.Output(), "Exit code of init stage failure: 3 spawn failed, 4 command exited early, 5 timeout, 6 auth failed, 7 bootstrap failed\n")
+	}
+	flagset.Parse(args[1:])
+	if help {
+		flagset.Usage()
+		os.Exit(0)
+	}
+	if profile != "" {
+		// the profile overrides defaults, then parse again so that flags override the profile
+		config.InitTimeout = stdiotunnel.InitTimeoutDefault
+		if err := stdiotunnel.LoadProfile(configFile, profile, &config); err != nil {
+			fmt.Fprintf(os.Stderr, "error: %s\n", err.Error())
+			os.Exit(2)
+		}
+		priorityUint64 = uint(config.Priority)
+		forwards = nil
+		flagset.Parse(args[1:])
+	}
+	if portUint64 >= (1 << 16) {
+		os.Stderr.WriteString("error: port must is uint16\n")
+		os.Exit(2)
+	}
+	if priorityUint64 >= (1 << 8) {
+		os.Stderr.WriteString("error: priority must is uint8\n")
+		os.Exit(2)
+	}
+	config.Priority = uint8(priorityUint64)
+	if err := stdiotunnel.CheckEncoding(config.Encoding); err != nil {
+		fmt.Fprintf(os.Stderr, "error: %s\n", err.Error())
+		os.Exit(2)
+	}
+	portForward := stdiotunnel.Forward{Type: stdiotunnel.ForwardLocal, Host: "127.0.0.1", Port: uint16(portUint64)}
+	initTimeoutSet := false
+	flagset.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "p":
+			forwards = append([]stdiotunnel.Forward{portForward}, forwards...)
+		case "init-timeout":
+			initTimeoutSet = true
+		}
+	})
+	if profile == "" && !initTimeoutSet {
+		config.InitTimeout = stdiotunnel.InitTimeoutDefault
+	}
+	if len(forwards) > 0 {
+		config.Forwards = forwards
+	} else if len(config.Forwards) == 0 {
+		config.Forwards = []stdiotunnel.Forward{portForward}
+	}
+	return
+}
+
+func parseServerArgs(args []string) (host string, port uint16, logFile string, openTimeout time.Duration, permits []string) {
+	var (
+		portUint64 uint
+		permit     string
+		help       bool
+	)
+	subcommand := subcommandKeyServer
+	flagset := flag.NewFlagSet(subcommand, flag.ExitOnError)
+	flagset.StringVar(&host, "h", "127.0.0.1", "host - forward target host")
+	flagset.UintVar(&portUint64, "p", 20022, "port - forward target port")
+	flagset.DurationVar(&openTimeout, "open-timeout", variable.OpenTimeout, "open timeout - dial timeout of forward target, 0 means no timeout")
+	flagset.StringVar(&permit, "permit", "", "permit - comma separated `host:port` patterns (wildcard `*`) which clients may ask instead of the default target, empty means none")
+	flagset.StringVar(&logFile, "log", "", "log - log file path, default is stderr if it is not a terminal")
+	flagset.BoolVar(&help, "help", false, "output this subcommand help")
+	flagset.Usage = func() {
+		fmt.Fprintf(flagset.Output(), "Start a Stdio Tunnel Server on stdio\nUsage of `%s %s`:\n", os.Args[0], subcommand)
+		flagset.PrintDefaults()
 	}
 	flagset.Parse(args[1:])
 	if help {
@@ -43,15 +182,73 @@ func parseClientArgs(args []string) (host string, port uint16, interactive bool,
 		os.Exit(2)
 	}
 	port = uint16(portUint64)
+	if permit != "" {
+		permits = strings.Split(permit, ",")
+	}
+	return
+}
+
+func parseDaemonArgs(args []string) (config stdiotunnel.DaemonConfig) {
+	var help bool
+	subcommand := subcommandKeyDaemon
+	flagset := flag.NewFlagSet(subcommand, flag.ExitOnError)
+	flagset.StringVar(&config.ConfigFile, "config", defaultConfigFile, "config - config file of profiles, reloaded on change or SIGHUP")
+	flagset.StringVar(&config.ControlSocket, "control", defaultControlSocket, "control - unix socket path of control interface of all profiles, empty means disable")
+	flagset.StringVar(&config.LogFile, "log", "", "log - log file path, default is stderr")
+	flagset.BoolVar(&help, "help", false, "output this subcommand help")
+	flagset.Usage = func() {
+		fmt.Fprintf(flagset.Output(), "Run Stdio Tunnel Clients of profiles, restart failed ones\nUsage of `%s %s [profile...]` (default all profiles):\n", os.Args[0], subcommand)
+		flagset.PrintDefaults()
+	}
+	flagset.Parse(args[1:])
+	if help {
+		flagset.Usage()
+		os.Exit(0)
+	}
+	config.Profiles = flagset.Args()
 	return
 }
 
+func parseCtlArgs(args []string) (socket string, command []string) {
+	var help bool
+	subcommand := subcommandKeyCtl
+	flagset := flag.NewFlagSet(subcommand, flag.ExitOnError)
+	flagset.StringVar(&socket, "s", defaultControlSocket, "socket - unix socket path of control interface")
+	flagset.BoolVar(&help, "help", false, "output this subcommand help")
+	flagset.Usage = func() {
+		fmt.Fprintf(flagset.Output(), "Control a running Stdio Tunnel\nUsage of `%s %s [-s socket] command [args...]` (command `help` list all commands):\n", os.Args[0], subcommand)
+		flagset.PrintDefaults()
+	}
+	flagset.Parse(args[1:])
+	if help {
+		flagset.Usage()
+		os.Exit(0)
+	}
+	command = flagset.Args()
+	if len(command) == 0 {
+		command = []string{"help"}
+	}
+	return
+}
+
+func ctl(socket string, command []string) {
+	output, err := control.Request(socket, command)
+	os.Stdout.WriteString(output)
+	if output != "" && !strings.HasSuffix(output, "\n") {
+		os.Stdout.WriteString("\n")
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %s\n", err.Error())
+		os.Exit(1)
+	}
+}
+
 func helpAndExit(isErr bool) {
 	stdOutOrErr := os.Stdout
 	if isErr {
 		stdOutOrErr = os.Stderr
 	}
-	fmt.Fprintf(stdOutOrErr, "Start a Stdio Tunnel Client or Server\nUsage of %s server | client\n  -help\n         output this help\n", os.Args[0])
+	fmt.Fprintf(stdOutOrErr, "Start a Stdio Tunnel Client or Server\nUsage of %s server | client | daemon | ctl\n  -help\n         output this help\n", os.Args[0])
 	if isErr {
 		os.Exit(2)
 	}
@@ -65,6 +262,11 @@ func main() {
 	case subcommandKeyClient:
 		stdiotunnel.StartClient(parseClientArgs(os.Args[1:]))
 	case subcommandKeyServer:
+		stdiotunnel.StartServer(parseServerArgs(os.Args[1:]))
+	case subcommandKeyDaemon:
+		stdiotunnel.StartDaemon(parseDaemonArgs(os.Args[1:]))
+	case subcommandKeyCtl:
+		ctl(parseCtlArgs(os.Args[1:]))
 	case subcommandKeyHelp:
 		helpAndExit(false)
 	default:
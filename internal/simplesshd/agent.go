@@ -0,0 +1,49 @@
+package simplesshd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+)
+
+// agentForward - a unix socket of a session, whose connections are forwarded to the agent of the client
+type agentForward struct {
+	listener net.Listener
+	// dir - the private dir of the socket, only the user can connect
+	dir  string
+	path string
+}
+
+// startAgentForward - listen on a new socket in a private dir as sshd does, e.g. `/tmp/stdiotunnel-ssh-XXXX/agent.PID`
+func (c *client) startAgentForward() (*agentForward, error) {
+	dir, err := ioutil.TempDir("", "stdiotunnel-ssh-")
+	if err != nil {
+		return nil, err
+	}
+	name := filepath.Join(dir, fmt.Sprintf("agent.%d", os.Getpid()))
+	listener, err := net.Listen("unix", name)
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	log.Printf("Client %s agent forwarding on %s", c.conn.RemoteAddr().String(), name)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go c.openForwardedChannel("auth-agent@openssh.com", nil, conn)
+		}
+	}()
+	return &agentForward{listener: listener, dir: dir, path: name}, nil
+}
+
+// close - stop listening and remove the socket
+func (a *agentForward) close() {
+	a.listener.Close()
+	os.RemoveAll(a.dir)
+}
@@ -0,0 +1,57 @@
+package simplesshd
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh/agent"
+)
+
+func TestAgentForward(t *testing.T) {
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyring := agent.NewKeyring()
+	keyring.Add(agent.AddedKey{PrivateKey: privateKey, Comment: "forwarded"})
+	sshClient := dialTestServer(t, Config{}, restrictions{})
+	if err := agent.ForwardToAgent(sshClient, keyring); err != nil {
+		t.Fatal(err)
+	}
+	session, err := sshClient.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+	if err := agent.RequestAgentForwarding(session); err != nil {
+		t.Fatal(err)
+	}
+	// the shell prints the socket and waits, so that it is alive while this test connects
+	socket, stdin := startWaitingCommand(t, session, "$SSH_AUTH_SOCK")
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := agent.NewClient(conn).List()
+	conn.Close()
+	if err != nil || len(keys) != 1 || keys[0].Comment != "forwarded" {
+		t.Errorf("keys of %s = %v, %v", socket, keys, err)
+	}
+	stdin.Close()
+	if err := session.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	// the socket is removed after the session is closed
+	for i := 0; ; i++ {
+		if _, err := os.Stat(socket); os.IsNotExist(err) {
+			break
+		} else if i == 100 {
+			t.Fatalf("socket exists after the session: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,226 @@
+package simplesshd
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/rectcircle/stdiotunnel/internal/variable"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/ssh"
+)
+
+// Keys of ssh.Permissions.Extensions, carry the identity and the options of the authorized key to the channel handlers
+const (
+	extensionIdentity          = "identity"
+	extensionCommand           = "command"
+	extensionPermitOpen        = "permitopen"
+	extensionNoPty             = "no-pty"
+	extensionNoPortForwarding  = "no-port-forwarding"
+	extensionNoAgentForwarding = "no-agent-forwarding"
+	extensionNoX11Forwarding   = "no-x11-forwarding"
+)
+
+// restrictions - options of an authorized key, see AUTHORIZED_KEYS FILE FORMAT of sshd(8)
+type restrictions struct {
+	// command - forced command, run by the shell instead of what the client asks
+	command string
+	// permitOpen - `host:port` patterns (path.Match wildcards) of direct-tcpip, empty means any
+	permitOpen []string
+	// noPty - refuse pty-req
+	noPty bool
+	// noPortForwarding - refuse local and remote forwardings of TCP and unix sockets
+	noPortForwarding bool
+	// noAgentForwarding - refuse auth-agent-req
+	noAgentForwarding bool
+	// noX11Forwarding - refuse x11-req
+	noX11Forwarding bool
+}
+
+// parseKeyOptions - permissions of the options of an authorized key, unknown options are errors so that the key is not accepted
+func parseKeyOptions(options []string) (*ssh.Permissions, error) {
+	permissions := &ssh.Permissions{Extensions: map[string]string{}}
+	permitOpen := []string{}
+	for _, option := range options {
+		name, value := option, ""
+		if i := strings.IndexByte(option, '='); i >= 0 {
+			name, value = option[:i], option[i+1:]
+			if len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"' {
+				value = value[1 : len(value)-1]
+			}
+		}
+		switch strings.ToLower(name) {
+		case "command":
+			permissions.Extensions[extensionCommand] = strings.ReplaceAll(value, `\"`, `"`)
+		case "permitopen":
+			if _, err := path.Match(value, ""); err != nil || !strings.Contains(value, ":") {
+				return nil, fmt.Errorf("invalid permitopen %q", value)
+			}
+			permitOpen = append(permitOpen, value)
+		case "no-pty":
+			permissions.Extensions[extensionNoPty] = ""
+		case "no-port-forwarding":
+			permissions.Extensions[extensionNoPortForwarding] = ""
+		case "no-agent-forwarding":
+			permissions.Extensions[extensionNoAgentForwarding] = ""
+		case "no-x11-forwarding":
+			permissions.Extensions[extensionNoX11Forwarding] = ""
+		default:
+			return nil, fmt.Errorf("unsupported option %q", name)
+		}
+	}
+	if len(permitOpen) > 0 {
+		permissions.Extensions[extensionPermitOpen] = strings.Join(permitOpen, ",")
+	}
+	return permissions, nil
+}
+
+// restrictionsOf - restrictions of an authenticated connection, a password login has none
+func restrictionsOf(permissions *ssh.Permissions) restrictions {
+	r := restrictions{}
+	if permissions == nil {
+		return r
+	}
+	extensions := permissions.Extensions
+	r.command = extensions[extensionCommand]
+	if permitOpen, ok := extensions[extensionPermitOpen]; ok {
+		r.permitOpen = strings.Split(permitOpen, ",")
+	}
+	_, r.noPty = extensions[extensionNoPty]
+	_, r.noPortForwarding = extensions[extensionNoPortForwarding]
+	_, r.noAgentForwarding = extensions[extensionNoAgentForwarding]
+	_, r.noX11Forwarding = extensions[extensionNoX11Forwarding]
+	return r
+}
+
+// identityOf - who the client authenticated as, the key fingerprint or the password user,
+// without auth only the user it claims
+func identityOf(conn *ssh.ServerConn) string {
+	if conn.Permissions != nil {
+		if identity, ok := conn.Permissions.Extensions[extensionIdentity]; ok {
+			return identity
+		}
+	}
+	return "user " + conn.User()
+}
+
+// canOpen - whether direct-tcpip to `address` is allowed
+func (r restrictions) canOpen(address string) bool {
+	if r.noPortForwarding {
+		return false
+	}
+	if len(r.permitOpen) == 0 {
+		return true
+	}
+	for _, pattern := range r.permitOpen {
+		if ok, _ := path.Match(pattern, address); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// authorizedKeysPath - the authorized_keys file, read on every login so that edits apply without restart
+func authorizedKeysPath() string {
+	return path.Join(variable.ConfigBaseDir, variable.SSHAuthorizedKeysFileName)
+}
+
+// passwordFilePath - the password file, lines of `USER:BCRYPT_HASH`
+func passwordFilePath() string {
+	return path.Join(variable.ConfigBaseDir, variable.SSHPasswordFileName)
+}
+
+// publicKeyCallback - accept keys of authorized_keys, a key with invalid options is skipped
+func publicKeyCallback(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+	content, err := ioutil.ReadFile(authorizedKeysPath())
+	if err != nil {
+		return nil, err
+	}
+	wanted := key.Marshal()
+	for len(content) > 0 {
+		authorizedKey, comment, options, rest, err := ssh.ParseAuthorizedKey(content)
+		if err != nil {
+			// no more valid keys
+			break
+		}
+		content = rest
+		if !bytes.Equal(authorizedKey.Marshal(), wanted) {
+			continue
+		}
+		permissions, err := parseKeyOptions(options)
+		if err != nil {
+			log.Printf("Skip authorized key %s (%s): %s\n", ssh.FingerprintSHA256(authorizedKey), comment, err)
+			continue
+		}
+		log.Printf("Client %s@%s accepted by key %s (%s)\n", conn.User(), conn.RemoteAddr().String(), ssh.FingerprintSHA256(authorizedKey), comment)
+		permissions.Extensions[extensionIdentity] = "key " + ssh.FingerprintSHA256(authorizedKey)
+		return permissions, nil
+	}
+	return nil, fmt.Errorf("key %s is not authorized", ssh.FingerprintSHA256(key))
+}
+
+// passwordCallback - accept the user and password of the password file
+func passwordCallback(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+	f, err := os.Open(passwordFilePath())
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		i := strings.IndexByte(line, ':')
+		if i < 0 || strings.HasPrefix(line, "#") || line[:i] != conn.User() {
+			continue
+		}
+		if bcrypt.CompareHashAndPassword([]byte(line[i+1:]), password) != nil {
+			break
+		}
+		log.Printf("Client %s@%s accepted by password\n", conn.User(), conn.RemoteAddr().String())
+		return &ssh.Permissions{Extensions: map[string]string{extensionIdentity: "password " + conn.User()}}, nil
+	}
+	return nil, errors.New("wrong user or password")
+}
+
+// HashPassword - a line of the password file for `user`
+func HashPassword(user string, password []byte) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword(password, bcrypt.DefaultCost)
+	return user + ":" + string(hash), err
+}
+
+// isLoopback - whether `host` is a loopback IP, a name is not resolved
+func isLoopback(host string) bool {
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// authConfig - ssh server config with the auth methods whose files exist
+// without any, every client is accepted if `noAuth` is set or the server is on `loopback` as before the auth files
+func authConfig(noAuth bool, loopback bool) (*ssh.ServerConfig, error) {
+	config := &ssh.ServerConfig{NoClientAuth: noAuth}
+	if noAuth {
+		return config, nil
+	}
+	if _, err := os.Stat(authorizedKeysPath()); err == nil {
+		config.PublicKeyCallback = publicKeyCallback
+	}
+	if _, err := os.Stat(passwordFilePath()); err == nil {
+		config.PasswordCallback = passwordCallback
+	}
+	if config.PublicKeyCallback == nil && config.PasswordCallback == nil {
+		if loopback {
+			log.Printf("Warning: no %s or %s, accept every client of loopback\n", authorizedKeysPath(), passwordFilePath())
+			config.NoClientAuth = true
+			return config, nil
+		}
+		return nil, fmt.Errorf("no auth method, create %s or %s", authorizedKeysPath(), passwordFilePath())
+	}
+	return config, nil
+}
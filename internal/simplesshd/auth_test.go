@@ -0,0 +1,173 @@
+package simplesshd
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/rectcircle/stdiotunnel/internal/variable"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestKeyOptions(t *testing.T) {
+	permissions, err := parseKeyOptions([]string{`command="echo \"hi\""`, `permitopen="127.0.0.1:*"`, `permitopen="db:5432"`, "no-pty", "no-agent-forwarding"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := restrictionsOf(permissions)
+	if r.command != `echo "hi"` || !r.noPty || r.noPortForwarding || !r.noAgentForwarding {
+		t.Errorf("restrictions = %+v", r)
+	}
+	for address, want := range map[string]bool{"127.0.0.1:22": true, "db:5432": true, "db:22": false, "10.0.0.1:22": false} {
+		if got := r.canOpen(address); got != want {
+			t.Errorf("canOpen(%q) = %v, want %v", address, got, want)
+		}
+	}
+	if r := restrictionsOf(nil); !r.canOpen("any:1") || r.command != "" {
+		t.Errorf("password login has restrictions %+v", r)
+	}
+	if _, err := parseKeyOptions([]string{"from=\"10.*\""}); err == nil {
+		t.Error("unsupported option is accepted")
+	}
+}
+
+// testConnMetadata - ssh.ConnMetadata of a client `user` from loopback
+type testConnMetadata struct {
+	user string
+}
+
+func (m testConnMetadata) User() string          { return m.user }
+func (m testConnMetadata) SessionID() []byte     { return nil }
+func (m testConnMetadata) ClientVersion() []byte { return nil }
+func (m testConnMetadata) ServerVersion() []byte { return nil }
+func (m testConnMetadata) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}
+}
+func (m testConnMetadata) LocalAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 2}
+}
+
+// testConfigBaseDir - a temporary ConfigBaseDir for the auth files
+func testConfigBaseDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "stdiotunnel-auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	baseDir := variable.ConfigBaseDir
+	variable.ConfigBaseDir = dir
+	t.Cleanup(func() {
+		variable.ConfigBaseDir = baseDir
+		os.RemoveAll(dir)
+	})
+	return dir
+}
+
+func testPublicKey(t *testing.T) ssh.PublicKey {
+	public, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ssh.NewPublicKey(public)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestPublicKeyCallback(t *testing.T) {
+	dir := testConfigBaseDir(t)
+	conn := testConnMetadata{"alice"}
+	restricted, skipped, unknown := testPublicKey(t), testPublicKey(t), testPublicKey(t)
+	if _, err := publicKeyCallback(conn, restricted); err == nil {
+		t.Error("publicKeyCallback() without authorized_keys = nil")
+	}
+	content := "# comment\n" +
+		"no-pty,permitopen=\"db:5432\" " + string(ssh.MarshalAuthorizedKey(restricted)) +
+		// the first line of `skipped` has an unsupported option, the second is used
+		"from=\"10.*\" " + string(ssh.MarshalAuthorizedKey(skipped)) +
+		"no-x11-forwarding " + string(ssh.MarshalAuthorizedKey(skipped))
+	if err := ioutil.WriteFile(path.Join(dir, variable.SSHAuthorizedKeysFileName), []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	permissions, err := publicKeyCallback(conn, restricted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := restrictionsOf(permissions); !r.noPty || r.canOpen("db:22") || !r.canOpen("db:5432") {
+		t.Errorf("restrictions of key = %+v", r)
+	}
+	if identity := permissions.Extensions[extensionIdentity]; identity != "key "+ssh.FingerprintSHA256(restricted) {
+		t.Errorf("identity of key = %q", identity)
+	}
+	permissions, err = publicKeyCallback(conn, skipped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := restrictionsOf(permissions); !r.noX11Forwarding || r.noPty {
+		t.Errorf("restrictions of the key after the skipped one = %+v", r)
+	}
+	if _, err := publicKeyCallback(conn, unknown); err == nil {
+		t.Error("publicKeyCallback() of an unknown key = nil")
+	}
+
+	// a key whose only line is skipped is rejected
+	if err := ioutil.WriteFile(path.Join(dir, variable.SSHAuthorizedKeysFileName), []byte("from=\"10.*\" "+string(ssh.MarshalAuthorizedKey(skipped))), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := publicKeyCallback(conn, skipped); err == nil {
+		t.Error("publicKeyCallback() of a key with an unsupported option = nil")
+	}
+}
+
+func TestPasswordCallback(t *testing.T) {
+	dir := testConfigBaseDir(t)
+	line, err := HashPassword("alice", []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path.Join(dir, variable.SSHPasswordFileName), []byte("# comment\n"+line+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	permissions, err := passwordCallback(testConnMetadata{"alice"}, []byte("secret"))
+	if err != nil || permissions.Extensions[extensionIdentity] != "password alice" {
+		t.Errorf("passwordCallback() = %v, %v, want accepted as alice", permissions, err)
+	}
+	if r := restrictionsOf(permissions); !r.canOpen("any:1") || r.noPty {
+		t.Errorf("password login has restrictions %+v", r)
+	}
+	if _, err := passwordCallback(testConnMetadata{"alice"}, []byte("wrong")); err == nil {
+		t.Error("passwordCallback() of a wrong password = nil")
+	}
+	if _, err := passwordCallback(testConnMetadata{"bob"}, []byte("secret")); err == nil {
+		t.Error("passwordCallback() of an unknown user = nil")
+	}
+}
+
+func TestAuthConfig(t *testing.T) {
+	dir := testConfigBaseDir(t)
+	// without auth files, only loopback accepts every client
+	if config, err := authConfig(false, true); err != nil || !config.NoClientAuth {
+		t.Errorf("authConfig() on loopback = %+v, %v, want no client auth", config, err)
+	}
+	if _, err := authConfig(false, false); err == nil {
+		t.Error("authConfig() on other hosts without auth files = nil")
+	}
+	if config, err := authConfig(true, true); err != nil || !config.NoClientAuth {
+		t.Errorf("authConfig() of noAuth = %+v, %v", config, err)
+	}
+
+	if err := ioutil.WriteFile(path.Join(dir, variable.SSHAuthorizedKeysFileName), ssh.MarshalAuthorizedKey(testPublicKey(t)), 0600); err != nil {
+		t.Fatal(err)
+	}
+	for _, loopback := range []bool{true, false} {
+		config, err := authConfig(false, loopback)
+		if err != nil || config.NoClientAuth || config.PublicKeyCallback == nil || config.PasswordCallback != nil {
+			t.Errorf("authConfig(loopback %v) with authorized_keys = %+v, %v, want key auth only", loopback, config, err)
+		}
+	}
+}
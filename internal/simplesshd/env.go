@@ -0,0 +1,58 @@
+package simplesshd
+
+import (
+	"net"
+	"os"
+	"os/user"
+	"path"
+	"strings"
+
+	"github.com/rectcircle/stdiotunnel/internal/variable"
+	"github.com/rectcircle/stdiotunnel/tools"
+)
+
+// env data struct as specified in RFC4254, Section 6.4
+type envRequestData struct {
+	Name  string
+	Value string
+}
+
+// defaultPath - PATH of the shell if the server has none
+const defaultPath = "/usr/local/bin:/usr/bin:/bin"
+
+// acceptEnv - whether the env request `name` is applied to the shell, LANG and LC_* are always accepted like the default sshd_config of most distributions,
+// and the name of a persistent session too
+func (c *client) acceptEnv(name string) bool {
+	if name == "LANG" || strings.HasPrefix(name, "LC_") || name == variable.SSHSessionEnvName {
+		return true
+	}
+	for _, pattern := range c.config.AcceptEnv {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// shellEnv - environment of the shell as OpenSSH builds it, instead of the one of the server
+// the accepted env requests `env` come first, so that they can not override the variables set by the server
+func (c *client) shellEnv(env []string, ptyRequest *ptyRequestData) []string {
+	result := append([]string{}, env...)
+	if ptyRequest != nil && ptyRequest.Term != "" {
+		result = append(result, "TERM="+ptyRequest.Term)
+	}
+	pathEnv := os.Getenv("PATH")
+	if pathEnv == "" {
+		pathEnv = defaultPath
+	}
+	result = append(result, "PATH="+pathEnv, "SHELL="+tools.GetUnixUserShell())
+	if u, err := user.Current(); err == nil {
+		result = append(result, "USER="+u.Username, "LOGNAME="+u.Username, "HOME="+u.HomeDir)
+	}
+	clientHost, clientPort, _ := net.SplitHostPort(c.conn.RemoteAddr().String())
+	serverHost, serverPort, _ := net.SplitHostPort(c.conn.LocalAddr().String())
+	return append(result,
+		"SSH_CLIENT="+strings.Join([]string{clientHost, clientPort, serverPort}, " "),
+		"SSH_CONNECTION="+strings.Join([]string{clientHost, clientPort, serverHost, serverPort}, " "),
+	)
+}
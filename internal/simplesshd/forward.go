@@ -0,0 +1,253 @@
+package simplesshd
+
+import (
+	"log"
+	"net"
+	"os/user"
+	"path"
+	"strconv"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// tcpip-forward and cancel-tcpip-forward data struct as specified in RFC4254, Section 7.1
+type remoteForwardRequest struct {
+	BindAddr string
+	BindPort uint32
+}
+
+// tcpip-forward reply data struct when the client asks port 0, RFC4254, Section 7.1
+type remoteForwardSuccess struct {
+	BindPort uint32
+}
+
+// forwarded-tcpip data struct as specified in RFC4254, Section 7.2
+type remoteForwardChannelData struct {
+	DestAddr   string
+	DestPort   uint32
+	OriginAddr string
+	OriginPort uint32
+}
+
+// handleGlobalRequests - serve global requests until the connection is closed, then stop its remote forwardings
+func handleGlobalRequests(requests <-chan *ssh.Request, c *client) {
+	for req := range requests {
+		switch req.Type {
+		case "tcpip-forward":
+			// ssh -R [bind_address:]port:host:hostport sshserver
+			// user -> sshserver:port (sshserver host) --- ssh tunnel ---> ssh client --- network ---> host:hostport
+			c.handleTCPIPForward(req)
+		case "cancel-tcpip-forward":
+			d := remoteForwardRequest{}
+			if err := ssh.Unmarshal(req.Payload, &d); err != nil {
+				req.Reply(false, nil)
+				continue
+			}
+			req.Reply(c.cancelForward(forwardKey(d.BindAddr, d.BindPort)), nil)
+		case "streamlocal-forward@openssh.com":
+			// ssh -R /remote.sock:/local.sock sshserver
+			c.handleStreamLocalForward(req)
+		case "cancel-streamlocal-forward@openssh.com":
+			d := remoteStreamForwardRequest{}
+			if err := ssh.Unmarshal(req.Payload, &d); err != nil {
+				req.Reply(false, nil)
+				continue
+			}
+			req.Reply(c.cancelForward(socketPath(d.SocketPath)), nil)
+		default:
+			// e.g. keepalive@openssh.com, a failure reply is enough
+			req.Reply(false, nil)
+		}
+	}
+	c.forwardsMutex.Lock()
+	defer c.forwardsMutex.Unlock()
+	for key, listener := range c.forwards {
+		listener.Close()
+		delete(c.forwards, key)
+	}
+}
+
+// forwardKey - key of a remote forwarding, by the bind address of the client and the port listened
+func forwardKey(bindAddr string, port uint32) string {
+	return net.JoinHostPort(bindAddr, strconv.FormatUint(uint64(port), 10))
+}
+
+// forwardBindHost - the host to listen for the bind address of the client
+func (c *client) forwardBindHost(bindAddr string) string {
+	if !c.config.GatewayPorts {
+		return "127.0.0.1"
+	}
+	switch bindAddr {
+	case "", "*", "0.0.0.0":
+		// all interfaces
+		return ""
+	case "localhost":
+		return "127.0.0.1"
+	}
+	return bindAddr
+}
+
+// handleTCPIPForward - listen for a remote forwarding, and open a forwarded-tcpip channel to the client for every connection
+func (c *client) handleTCPIPForward(req *ssh.Request) {
+	d := remoteForwardRequest{}
+	if err := ssh.Unmarshal(req.Payload, &d); err != nil || d.BindPort > 65535 {
+		req.Reply(false, nil)
+		return
+	}
+	if c.restrictions.noPortForwarding {
+		log.Printf("Client %s tcpip-forward is not permitted", c.conn.RemoteAddr().String())
+		req.Reply(false, nil)
+		return
+	}
+	listener, err := net.Listen("tcp", net.JoinHostPort(c.forwardBindHost(d.BindAddr), strconv.FormatUint(uint64(d.BindPort), 10)))
+	if err != nil {
+		log.Printf("Client %s tcpip-forward error: %s", c.conn.RemoteAddr().String(), err)
+		req.Reply(false, nil)
+		return
+	}
+	port := uint32(listener.Addr().(*net.TCPAddr).Port)
+	c.forwardsMutex.Lock()
+	c.forwards[forwardKey(d.BindAddr, port)] = listener
+	c.forwardsMutex.Unlock()
+	if d.BindPort == 0 {
+		req.Reply(true, ssh.Marshal(remoteForwardSuccess{port}))
+	} else {
+		req.Reply(true, nil)
+	}
+	log.Printf("Client %s tcpip-forward listen on %s", c.conn.RemoteAddr().String(), listener.Addr().String())
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			originAddr, originPort, _ := net.SplitHostPort(conn.RemoteAddr().String())
+			originPortUint, _ := strconv.ParseUint(originPort, 10, 32)
+			go c.openForwardedChannel("forwarded-tcpip", ssh.Marshal(remoteForwardChannelData{
+				DestAddr:   d.BindAddr,
+				DestPort:   port,
+				OriginAddr: originAddr,
+				OriginPort: uint32(originPortUint),
+			}), conn)
+		}
+	}()
+}
+
+// cancelForward - stop the remote forwarding of `key`, false if not found
+func (c *client) cancelForward(key string) bool {
+	c.forwardsMutex.Lock()
+	defer c.forwardsMutex.Unlock()
+	listener, ok := c.forwards[key]
+	if ok {
+		listener.Close()
+		delete(c.forwards, key)
+	}
+	return ok
+}
+
+// openForwardedChannel - open a channel of `channelType` to the client for the accepted `conn`
+func (c *client) openForwardedChannel(channelType string, extraData []byte, conn net.Conn) {
+	connection, requests, err := c.conn.OpenChannel(channelType, extraData)
+	if err != nil {
+		log.Printf("Client %s %s error: %s", c.conn.RemoteAddr().String(), channelType, err)
+		conn.Close()
+		return
+	}
+	pipeChannel(connection, requests, conn)
+}
+
+// direct-streamlocal@openssh.com data struct, see PROTOCOL of OpenSSH, Section 2.4
+type localStreamForwardChannelData struct {
+	SocketPath string
+	Reserved0  string
+	Reserved1  uint32
+}
+
+// streamlocal-forward@openssh.com and cancel-streamlocal-forward@openssh.com data struct
+type remoteStreamForwardRequest struct {
+	SocketPath string
+}
+
+// forwarded-streamlocal@openssh.com data struct
+type remoteStreamForwardChannelData struct {
+	SocketPath string
+	Reserved   string
+}
+
+// socketPath - the unix socket path of the client, a relative path is relative to the home dir as the shell
+func socketPath(name string) string {
+	if path.IsAbs(name) {
+		return path.Clean(name)
+	}
+	home := "/"
+	if u, err := user.Current(); err == nil {
+		home = u.HomeDir
+	}
+	return path.Join(home, name)
+}
+
+// https://github.com/openssh/openssh-portable/blob/master/PROTOCOL
+func handleDirectStreamLocal(newChannel ssh.NewChannel, c *client) {
+	d := localStreamForwardChannelData{}
+	if err := ssh.Unmarshal(newChannel.ExtraData(), &d); err != nil {
+		newChannel.Reject(ssh.ConnectionFailed, "error parsing forward data: "+err.Error())
+		return
+	}
+	// permitopen is for TCP only, as sshd
+	if c.restrictions.noPortForwarding {
+		newChannel.Reject(ssh.Prohibited, "port forwarding is not permitted")
+		log.Printf("Client %s direct-streamlocal to %s is not permitted", c.conn.RemoteAddr().String(), d.SocketPath)
+		return
+	}
+	destConnection, err := net.Dial("unix", socketPath(d.SocketPath))
+	if err != nil {
+		newChannel.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	connection, requests, err := newChannel.Accept()
+	if err != nil {
+		destConnection.Close()
+		return
+	}
+	log.Printf("A direct-streamlocal connection success, to %s", socketPath(d.SocketPath))
+	pipeChannel(connection, requests, destConnection)
+}
+
+// handleStreamLocalForward - listen on a unix socket for a remote forwarding, and open a forwarded-streamlocal channel to the client for every connection
+// an existing socket file is not removed, as StreamLocalBindUnlink of sshd_config defaults to no
+func (c *client) handleStreamLocalForward(req *ssh.Request) {
+	d := remoteStreamForwardRequest{}
+	if err := ssh.Unmarshal(req.Payload, &d); err != nil {
+		req.Reply(false, nil)
+		return
+	}
+	if c.restrictions.noPortForwarding {
+		log.Printf("Client %s streamlocal-forward is not permitted", c.conn.RemoteAddr().String())
+		req.Reply(false, nil)
+		return
+	}
+	name := socketPath(d.SocketPath)
+	listener, err := net.Listen("unix", name)
+	if err != nil {
+		log.Printf("Client %s streamlocal-forward error: %s", c.conn.RemoteAddr().String(), err)
+		req.Reply(false, nil)
+		return
+	}
+	c.forwardsMutex.Lock()
+	// keys of unix sockets are absolute paths, which a key of TCP never is
+	c.forwards[name] = listener
+	c.forwardsMutex.Unlock()
+	req.Reply(true, nil)
+	log.Printf("Client %s streamlocal-forward listen on %s", c.conn.RemoteAddr().String(), name)
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go c.openForwardedChannel("forwarded-streamlocal@openssh.com", ssh.Marshal(remoteStreamForwardChannelData{SocketPath: d.SocketPath}), conn)
+		}
+	}()
+}
@@ -0,0 +1,102 @@
+package simplesshd
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// echoLine - send a line on `conn` and check the echo
+func echoLine(t *testing.T, conn net.Conn) {
+	defer conn.Close()
+	conn.Write([]byte("ping\n"))
+	if line, err := bufio.NewReader(conn).ReadString('\n'); err != nil || line != "ping\n" {
+		t.Errorf("echo = %q, %v", line, err)
+	}
+}
+
+// serveEcho - echo every connection of `listener` until it is closed
+func serveEcho(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go io.Copy(conn, conn)
+	}
+}
+
+func TestRemoteForward(t *testing.T) {
+	t.Run("echo", func(t *testing.T) {
+		sshClient := dialTestServer(t, Config{}, restrictions{})
+		listener, err := sshClient.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer listener.Close()
+		go serveEcho(listener)
+		for i := 0; i < 2; i++ {
+			conn, err := net.Dial("tcp", listener.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			echoLine(t, conn)
+		}
+		// cancel-tcpip-forward stops listening
+		listener.Close()
+		if conn, err := net.Dial("tcp", listener.Addr().String()); err == nil {
+			conn.Close()
+			t.Error("forwarded port is still listening after cancel")
+		}
+	})
+	t.Run("no-port-forwarding", func(t *testing.T) {
+		sshClient := dialTestServer(t, Config{}, restrictions{noPortForwarding: true})
+		if listener, err := sshClient.Listen("tcp", "127.0.0.1:0"); err == nil {
+			listener.Close()
+			t.Error("tcpip-forward is permitted")
+		}
+	})
+}
+
+func TestStreamLocalForward(t *testing.T) {
+	dir, err := ioutil.TempDir("", "streamlocal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sshClient := dialTestServer(t, Config{}, restrictions{})
+	t.Run("direct", func(t *testing.T) {
+		listener, err := net.Listen("unix", filepath.Join(dir, "server.sock"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer listener.Close()
+		go serveEcho(listener)
+		conn, err := sshClient.Dial("unix", filepath.Join(dir, "server.sock"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		echoLine(t, conn)
+	})
+	t.Run("forward", func(t *testing.T) {
+		listener, err := sshClient.ListenUnix(filepath.Join(dir, "forward.sock"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		go serveEcho(listener)
+		conn, err := net.Dial("unix", filepath.Join(dir, "forward.sock"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		echoLine(t, conn)
+		// cancel-streamlocal-forward removes the socket
+		listener.Close()
+		if _, err := os.Stat(filepath.Join(dir, "forward.sock")); !os.IsNotExist(err) {
+			t.Errorf("socket exists after cancel: %v", err)
+		}
+	})
+}
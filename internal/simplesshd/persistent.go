@@ -0,0 +1,222 @@
+package simplesshd
+
+import (
+	"errors"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/creack/pty"
+	"github.com/rectcircle/stdiotunnel/internal/variable"
+	"golang.org/x/crypto/ssh"
+)
+
+// Persistent sessions are pty shells which survive disconnection, like a tmux session.
+// A pty session asks one by the env request variable.SSHSessionEnvName, or the exec command `variable.SSHSessionCommand NAME`.
+// The first session of a name starts the shell, a later one of the same identity reattaches it and gets the scrollback first.
+// Forwardings of agent and X11 belong to the connection which started the shell, they stop when it is closed.
+
+// persistentSessionName - a valid name of a persistent session
+var persistentSessionName = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// persistentWriteQueueSize - outputs queued for an attached channel, a client which can't keep up is detached
+const persistentWriteQueueSize = 64
+
+// persistentSessionKey - a persistent session is attachable by the same identity with the same name only
+type persistentSessionKey struct {
+	identity string
+	name     string
+}
+
+// persistentSession - a pty shell which survives disconnection, attached by name
+type persistentSession struct {
+	key     persistentSessionKey
+	name    string
+	shell   *exec.Cmd
+	ptyFile *os.File
+	mutex   sync.Mutex
+	// scrollback - the last output of the shell, replayed on attach
+	scrollback []byte
+	// attached - the writer of the channel showing the shell, nil if detached
+	attached *channelWriter
+	// exited - the shell has exited, the session can not be attached
+	exited bool
+}
+
+var (
+	// persistentSessions - running persistent sessions by identity and name
+	persistentSessions      = map[persistentSessionKey]*persistentSession{}
+	persistentSessionsMutex sync.Mutex
+)
+
+// channelWriter - writes the output to an attached channel in order, outside of the lock of the session
+type channelWriter struct {
+	channel ssh.Channel
+	queue   chan []byte
+	// done - closed when the queue is finished and every output is written or dropped
+	done chan struct{}
+}
+
+func newChannelWriter(channel ssh.Channel) *channelWriter {
+	w := &channelWriter{channel: channel, queue: make(chan []byte, persistentWriteQueueSize), done: make(chan struct{})}
+	go func() {
+		defer close(w.done)
+		var err error
+		for data := range w.queue {
+			// after an error the queue is still drained
+			if err == nil {
+				_, err = w.channel.Write(data)
+			}
+		}
+	}()
+	return w
+}
+
+// write - queue `data`, which must not be modified later, false if the queue is full
+func (w *channelWriter) write(data []byte) bool {
+	select {
+	case w.queue <- data:
+		return true
+	default:
+		return false
+	}
+}
+
+// finish - no more writes, the queued ones are still written
+func (w *channelWriter) finish() {
+	close(w.queue)
+}
+
+// abandon - close the channel at once, so that a blocked write returns and the queued ones are dropped
+func (w *channelWriter) abandon() {
+	w.channel.Close()
+	close(w.queue)
+}
+
+// persistentSessionOf - the name of the persistent session the client asks, empty if none
+func persistentSessionOf(env []string, command string) string {
+	if strings.HasPrefix(command, variable.SSHSessionCommand+" ") {
+		return strings.TrimSpace(strings.TrimPrefix(command, variable.SSHSessionCommand+" "))
+	}
+	for _, e := range env {
+		if strings.HasPrefix(e, variable.SSHSessionEnvName+"=") {
+			return strings.TrimPrefix(e, variable.SSHSessionEnvName+"=")
+		}
+	}
+	return ""
+}
+
+// attachPersistentSession - attach `connection` to the session `name` of `identity`, whose shell is `newShell()` if it is not running
+func attachPersistentSession(identity string, name string, connection ssh.Channel, newShell func() *exec.Cmd, ptyRequest *ptyRequestData) (*persistentSession, error) {
+	if !persistentSessionName.MatchString(name) {
+		return nil, errors.New("invalid persistent session name " + name)
+	}
+	key := persistentSessionKey{identity: identity, name: name}
+	persistentSessionsMutex.Lock()
+	s, ok := persistentSessions[key]
+	if !ok {
+		shell := newShell()
+		log.Printf("Creating persistent pty shell %s (%s)...", name, shell.Path)
+		ptyFile, err := pty.Start(shell)
+		if err != nil {
+			persistentSessionsMutex.Unlock()
+			return nil, err
+		}
+		s = &persistentSession{key: key, name: name, shell: shell, ptyFile: ptyFile}
+		persistentSessions[key] = s
+		go s.pipeOutput()
+	}
+	persistentSessionsMutex.Unlock()
+
+	SetWinsize(s.ptyFile.Fd(), ptyRequest.Columns, ptyRequest.Rows)
+	if err := s.attach(connection); err != nil {
+		return nil, err
+	}
+	// The input of a detached channel ends as it is closed
+	go io.Copy(s.ptyFile, connection)
+	return s, nil
+}
+
+// attach - show the shell on `connection` from the scrollback, the channel attached before is closed
+func (s *persistentSession) attach(connection ssh.Channel) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.exited {
+		return errors.New("persistent session " + s.name + " has exited")
+	}
+	if previous := s.attached; previous != nil {
+		previous.write([]byte("\r\n[detached by another client]\r\n"))
+		previous.finish()
+		go func() {
+			<-previous.done
+			previous.channel.Close()
+		}()
+	}
+	log.Printf("Attach persistent session %s", s.name)
+	s.attached = newChannelWriter(connection)
+	s.attached.write(append([]byte{}, s.scrollback...))
+	return nil
+}
+
+// detach - `connection` is closed, the shell keeps running
+func (s *persistentSession) detach(connection ssh.Channel) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.attached != nil && s.attached.channel == connection {
+		log.Printf("Detach persistent session %s", s.name)
+		s.attached.finish()
+		s.attached = nil
+	}
+}
+
+// output - keep `data` of the shell in the scrollback and queue it for the attached channel
+func (s *persistentSession) output(data []byte) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.scrollback = append(s.scrollback, data...)
+	if over := len(s.scrollback) - variable.SSHSessionScrollbackSize; over > 0 {
+		s.scrollback = s.scrollback[:copy(s.scrollback, s.scrollback[over:])]
+	}
+	if s.attached != nil && !s.attached.write(append([]byte{}, data...)) {
+		// the client can reattach and get the scrollback
+		log.Printf("Detach persistent session %s from a stalled client", s.name)
+		s.attached.abandon()
+		s.attached = nil
+	}
+}
+
+// pipeOutput - show the output of the shell, until the shell exits
+func (s *persistentSession) pipeOutput() {
+	buffer := make([]byte, 32*1024)
+	for {
+		n, err := s.ptyFile.Read(buffer)
+		if n > 0 {
+			s.output(buffer[:n])
+		}
+		if err != nil {
+			break
+		}
+	}
+	persistentSessionsMutex.Lock()
+	delete(persistentSessions, s.key)
+	persistentSessionsMutex.Unlock()
+	s.mutex.Lock()
+	s.exited = true
+	attached := s.attached
+	s.attached = nil
+	s.mutex.Unlock()
+	// The attached channel is told how the shell ended after the output, as a session without persistence
+	if attached != nil {
+		attached.finish()
+		<-attached.done
+		finishShell(attached.channel, s.shell)
+	} else if err := s.shell.Wait(); err != nil {
+		log.Printf("Shell exited (%s)", err)
+	}
+	s.ptyFile.Close()
+	log.Printf("Persistent session %s exited", s.name)
+}
@@ -0,0 +1,179 @@
+package simplesshd
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rectcircle/stdiotunnel/internal/variable"
+	"golang.org/x/crypto/ssh"
+)
+
+// readUntil - read `reader` until the output contains `want`
+func readUntil(t *testing.T, reader io.Reader, want string) {
+	found := make(chan bool)
+	go func() {
+		output := ""
+		buffer := make([]byte, 1024)
+		for {
+			n, err := reader.Read(buffer)
+			output += string(buffer[:n])
+			if strings.Contains(output, want) || err != nil {
+				found <- strings.Contains(output, want)
+				return
+			}
+		}
+	}()
+	select {
+	case ok := <-found:
+		if !ok {
+			t.Fatalf("output ends without %q", want)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("timeout waiting for %q", want)
+	}
+}
+
+// startPersistentSession - a pty session attached to the persistent session `name`, by the env request or the exec command
+func startPersistentSession(t *testing.T, sshClient *ssh.Client, name string, byEnv bool) (*ssh.Session, io.WriteCloser, io.Reader) {
+	session, err := sshClient.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := session.RequestPty("xterm", 24, 80, ssh.TerminalModes{}); err != nil {
+		t.Fatal(err)
+	}
+	if byEnv {
+		if err := session.Setenv(variable.SSHSessionEnvName, name); err != nil {
+			t.Fatal(err)
+		}
+		err = session.Shell()
+	} else {
+		err = session.Start(variable.SSHSessionCommand + " " + name)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return session, stdin, stdout
+}
+
+func TestPersistentSession(t *testing.T) {
+	session, stdin, stdout := startPersistentSession(t, dialTestServer(t, Config{}, restrictions{}), "test", true)
+	io.WriteString(stdin, "echo before:$((6*7))\n")
+	readUntil(t, stdout, "before:42")
+	// the tunnel drops
+	session.Close()
+
+	sshClient := dialTestServer(t, Config{}, restrictions{})
+	session, stdin, stdout = startPersistentSession(t, sshClient, "test", false)
+	defer session.Close()
+	// the scrollback, then the same shell
+	readUntil(t, stdout, "before:42")
+	io.WriteString(stdin, "echo after:$((6*7)):$"+variable.SSHSessionEnvName+"\n")
+	readUntil(t, stdout, "after:42:test")
+	io.WriteString(stdin, "exit 4\n")
+	var exitError *ssh.ExitError
+	if err := session.Wait(); !errors.As(err, &exitError) || exitError.ExitStatus() != 4 {
+		t.Errorf("exit = %v, want status 4", err)
+	}
+
+	persistentSessionsMutex.Lock()
+	_, ok := persistentSessions[persistentSessionKey{identity: "user test", name: "test"}]
+	persistentSessionsMutex.Unlock()
+	if ok {
+		t.Error("exited session is still attachable")
+	}
+
+	bad, err := sshClient.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bad.Close()
+	// no pty
+	if err := bad.Start(variable.SSHSessionCommand + " test"); err == nil {
+		t.Error("persistent session without pty is started")
+	}
+}
+
+func TestPersistentSessionIdentity(t *testing.T) {
+	first, stdin, stdout := startPersistentSession(t, dialTestServer(t, Config{}, restrictions{}), "shared", true)
+	defer first.Close()
+	io.WriteString(stdin, "MARK=first; echo mark:$MARK\n")
+	readUntil(t, stdout, "mark:first")
+
+	// another identity gets its own shell of the same name
+	other, otherStdin, otherStdout := startPersistentSession(t, dialTestServerAs(t, "other", Config{}, restrictions{}), "shared", true)
+	defer other.Close()
+	io.WriteString(otherStdin, "echo mark:${MARK:-none}\n")
+	readUntil(t, otherStdout, "mark:none")
+	defer io.WriteString(otherStdin, "exit\n")
+
+	// the same identity takes the shell over, the previous client is told
+	second, secondStdin, secondStdout := startPersistentSession(t, dialTestServer(t, Config{}, restrictions{}), "shared", false)
+	defer second.Close()
+	readUntil(t, stdout, "[detached by another client]")
+	io.WriteString(secondStdin, "echo again:$MARK\n")
+	readUntil(t, secondStdout, "again:first")
+	io.WriteString(secondStdin, "exit\n")
+	second.Wait()
+}
+
+// stalledChannel - a channel whose writes block until it is closed
+type stalledChannel struct {
+	ssh.Channel
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (c *stalledChannel) Write(data []byte) (int, error) {
+	<-c.closed
+	return 0, io.EOF
+}
+
+func (c *stalledChannel) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	return nil
+}
+
+func TestPersistentSessionStalledClient(t *testing.T) {
+	s := &persistentSession{name: "stalled"}
+	stalled := &stalledChannel{closed: make(chan struct{})}
+	if err := s.attach(stalled); err != nil {
+		t.Fatal(err)
+	}
+	// the output never blocks on the stalled client, which is detached once its queue is full
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i <= persistentWriteQueueSize+1; i++ {
+			s.output([]byte("x"))
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("output is blocked by a stalled client")
+	}
+	select {
+	case <-stalled.closed:
+	default:
+		t.Error("stalled client is not closed")
+	}
+	s.mutex.Lock()
+	attached := s.attached
+	s.mutex.Unlock()
+	if attached != nil {
+		t.Error("stalled client is still attached")
+	}
+}
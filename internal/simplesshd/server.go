@@ -24,20 +24,46 @@ import (
 	"golang.org/x/crypto/ssh"
 )
 
-// ListenAndServe - start a simple and no auth ssh server
-// bind to `host:port` of TCP
+// Config - config of the simple ssh server
+type Config struct {
+	// Host, Port - bind to `host:port` of TCP
+	Host string
+	Port uint16
+	// NoAuth - accept every client, otherwise clients authenticate by keys of `~/.stdiotunnel/authorized_keys` or passwords of `~/.stdiotunnel/sshd_passwd`,
+	// if neither file exists, a loopback Host accepts every client too and any other Host fails to start
+	NoAuth bool
+	// AcceptEnv - name patterns (path.Match wildcards) of env requests applied to the shell, besides LANG and LC_*
+	AcceptEnv []string
+	// SFTPRoot - the `/` of the file system of the sftp subsystem, empty means the real file system
+	SFTPRoot string
+	// GatewayPorts - remote forwardings listen on the address the client asks, otherwise on loopback, as GatewayPorts of sshd_config
+	GatewayPorts bool
+	// X11Forwarding - accept x11-req, as X11Forwarding of sshd_config
+	X11Forwarding bool
+}
+
+// client - an authenticated connection, with what it is allowed to do
+type client struct {
+	conn   *ssh.ServerConn
+	config Config
+	// identity - who the client authenticated as, persistent sessions of other identities are not attachable
+	identity     string
+	restrictions restrictions
+	// forwards - listeners of remote forwardings, by the bind address of the client
+	forwards      map[string]net.Listener
+	forwardsMutex sync.Mutex
+}
+
+// ListenAndServe - start a simple ssh server
 // reference https://gist.github.com/jpillora/b480fde82bff51a06238
-func ListenAndServe(host string, port uint16) {
-	addr := tools.ToAddressString(host, port)
+func ListenAndServe(serverConfig Config) {
+	config, err := authConfig(serverConfig.NoAuth, isLoopback(serverConfig.Host))
+	tools.LogAndExitIfErr(err)
+	addr := tools.ToAddressString(serverConfig.Host, serverConfig.Port)
 	// Listen to tcp addr
 	listener, err := net.Listen("tcp", addr)
 	tools.LogAndExitIfErr(err)
 	log.Printf("Start a ssh Server Success! on %s\n", addr)
-	// ssh server config: not auth
-	config := &ssh.ServerConfig{
-		// No Auth
-		NoClientAuth: true,
-	}
 	// Config ssh host private key
 	signer, err := ssh.ParsePrivateKey(readOrCreatePrivateKey())
 	tools.LogAndExitIfErr(err)
@@ -54,10 +80,10 @@ func ListenAndServe(host string, port uint16) {
 			continue
 		}
 		log.Printf("New SSH connection from %s (%s)\n", sshConn.RemoteAddr().String(), sshConn.ClientVersion())
-		// Discard all global out-of-band Requests ???
-		go ssh.DiscardRequests(request)
-		// Accept all channels
-		go handleChannels(channel, sshConn.RemoteAddr())
+		// Serve global requests and all channels, within the restrictions of the authorized key
+		c := &client{conn: sshConn, config: serverConfig, identity: identityOf(sshConn), restrictions: restrictionsOf(sshConn.Permissions), forwards: map[string]net.Listener{}}
+		go handleGlobalRequests(request, c)
+		go handleChannels(channel, c)
 	}
 }
 
@@ -77,28 +103,31 @@ func readOrCreatePrivateKey() []byte {
 	return content
 }
 
-func handleChannels(channel <-chan ssh.NewChannel, remoteAttr net.Addr) {
+func handleChannels(channel <-chan ssh.NewChannel, c *client) {
 	// Service the incoming Channel channel in go routine
 	for newChannel := range channel {
-		go handleChannel(newChannel, remoteAttr)
+		go handleChannel(newChannel, c)
 	}
 }
 
-func handleChannel(newChannel ssh.NewChannel, remoteAttr net.Addr) {
+func handleChannel(newChannel ssh.NewChannel, c *client) {
 	// https://tools.ietf.org/html/rfc4254
 	switch t := newChannel.ChannelType(); t {
 	case "direct-tcpip":
 		// ssh -L localport:remotehost:remoteport sshserver -N
 		// user -> localhost:localport (local host) --- ssh tunnel ---> sshserver (sshserver host) --- network ---> remotehost:remoteport (network service)
-		go handleDirectTCPIP(newChannel, remoteAttr)
+		go handleDirectTCPIP(newChannel, c)
+	case "direct-streamlocal@openssh.com":
+		// ssh -L /local.sock:/remote.sock sshserver -N
+		go handleDirectStreamLocal(newChannel, c)
 	case "session":
 		// At this point, we have the opportunity to reject the client's
 		// request for another logical connection
-		go handleSSHSession(newChannel, remoteAttr)
+		go handleSSHSession(newChannel, c)
 	default:
-		// "x11" and "forwarded-tcpip" not support
+		// "x11" and "forwarded-tcpip" are opened by the server only
 		newChannel.Reject(ssh.UnknownChannelType, fmt.Sprintf("unknown channel type: %s", t))
-		log.Printf("Client %s connection error: not support channel type %s", remoteAttr.String(), t)
+		log.Printf("Client %s connection error: not support channel type %s", c.conn.RemoteAddr().String(), t)
 	}
 }
 
@@ -113,7 +142,7 @@ type localForwardChannelData struct {
 
 // https://tools.ietf.org/html/rfc4254#page-17
 // https://github.com/gliderlabs/ssh/blob/fb34512070c56e0b7ff4158d981baf37675e4998/tcpip.go#L28
-func handleDirectTCPIP(newChannel ssh.NewChannel, remoteAttr net.Addr) {
+func handleDirectTCPIP(newChannel ssh.NewChannel, c *client) {
 	d := localForwardChannelData{}
 	if err := ssh.Unmarshal(newChannel.ExtraData(), &d); err != nil {
 		newChannel.Reject(ssh.ConnectionFailed, "error parsing forward data: "+err.Error())
@@ -121,6 +150,11 @@ func handleDirectTCPIP(newChannel ssh.NewChannel, remoteAttr net.Addr) {
 	}
 	sourceAddress := tools.ToAddressString(d.OriginAddr, uint16(d.OriginPort))
 	destAddress := tools.ToAddressString(d.DestAddr, uint16(d.DestPort))
+	if !c.restrictions.canOpen(destAddress) {
+		newChannel.Reject(ssh.Prohibited, "port forwarding to "+destAddress+" is not permitted")
+		log.Printf("Client %s direct-tcpip to %s is not permitted", c.conn.RemoteAddr().String(), destAddress)
+		return
+	}
 
 	var dialer net.Dialer
 	destConnection, err := dialer.Dial("tcp", destAddress)
@@ -135,27 +169,69 @@ func handleDirectTCPIP(newChannel ssh.NewChannel, remoteAttr net.Addr) {
 		return
 	}
 
-	log.Printf("A direct-tcpip connection success, to %s from %s", destConnection, sourceAddress)
+	log.Printf("A direct-tcpip connection success, to %s from %s", destConnection.RemoteAddr().String(), sourceAddress)
+
+	pipeChannel(connection, requests, destConnection)
+}
 
+// pipeChannel - copy between a forwarding channel and its connection until either is closed
+func pipeChannel(connection ssh.Channel, requests <-chan *ssh.Request, conn net.Conn) {
 	go ssh.DiscardRequests(requests)
 	go func() {
 		defer connection.Close()
-		defer destConnection.Close()
-		io.Copy(connection, destConnection)
+		defer conn.Close()
+		io.Copy(connection, conn)
 	}()
 	go func() {
 		defer connection.Close()
-		defer destConnection.Close()
-		io.Copy(destConnection, connection)
+		defer conn.Close()
+		io.Copy(conn, connection)
 	}()
 }
 
+// pty-req data struct as specified in RFC4254, Section 6.2
+type ptyRequestData struct {
+	Term     string
+	Columns  uint32
+	Rows     uint32
+	Width    uint32
+	Height   uint32
+	Modelist string
+}
+
+// exec data struct as specified in RFC4254, Section 6.5
+type execRequestData struct {
+	Command string
+}
+
+// subsystem data struct as specified in RFC4254, Section 6.5
+type subsystemRequestData struct {
+	Name string
+}
+
+// exit-status data struct as specified in RFC4254, Section 6.10
+type exitStatusData struct {
+	Status uint32
+}
+
 // https://tools.ietf.org/html/rfc4254#page-11
-func handleSSHSession(newChannel ssh.NewChannel, remoteAttr net.Addr) {
+func handleSSHSession(newChannel ssh.NewChannel, c *client) {
 
 	var (
-		enablePty          = false
-		ptyFile   *os.File = nil
+		// env - accepted env requests
+		env []string = nil
+		// ptyRequest - the pty-req before the command starts, nil means no pty
+		ptyRequest *ptyRequestData = nil
+		ptyFile    *os.File        = nil
+		shell      *exec.Cmd       = nil
+		// started - the shell, a subsystem or a persistent session has started, requests setting it up are refused
+		started = false
+		// persistent - the attached persistent session, its shell is not hung up with the channel
+		persistent *persistentSession = nil
+		// agent - the socket of agent forwarding, nil if the client does not ask
+		agent *agentForward = nil
+		// x11 - the display of x11 forwarding, nil if the client does not ask
+		x11 *x11Forward = nil
 	)
 
 	connection, requests, err := newChannel.Accept()
@@ -168,117 +244,274 @@ func handleSSHSession(newChannel ssh.NewChannel, remoteAttr net.Addr) {
 	for req := range requests {
 		// log.Println(req.Type)
 		switch req.Type {
-		case "env": // Not supported
-		case "exec": // Not supported
-		case "shell":
-			// We only accept the default shell
-			// (i.e. no command in the Payload)
-			if !enablePty {
-				err := startNoPtyShell(connection)
-				if err != nil {
-					log.Printf("Creating not pty shell error: %s)", err)
+		case "env":
+			d := envRequestData{}
+			if err := ssh.Unmarshal(req.Payload, &d); err != nil || !c.acceptEnv(d.Name) || started {
+				req.Reply(false, nil)
+				continue
+			}
+			env = append(env, d.Name+"="+d.Value)
+			req.Reply(true, nil)
+		case "shell", "exec":
+			// The forced command of the authorized key replaces what the client asks
+			command := c.restrictions.command
+			if req.Type == "exec" {
+				d := execRequestData{}
+				if err := ssh.Unmarshal(req.Payload, &d); err != nil {
+					req.Reply(false, nil)
+					continue
 				}
+				if command == "" {
+					command = d.Command
+				}
+			}
+			// Only one command per session
+			if started {
+				req.Reply(false, nil)
+				continue
 			}
-			if len(req.Payload) == 0 {
+			shellEnv := c.shellEnv(env, ptyRequest)
+			if agent != nil {
+				shellEnv = append(shellEnv, "SSH_AUTH_SOCK="+agent.path)
+			}
+			if x11 != nil {
+				shellEnv = append(shellEnv, x11.env()...)
+			}
+			// A forced command is never persistent
+			if name := persistentSessionOf(env, command); name != "" && c.restrictions.command == "" {
+				if ptyRequest == nil {
+					log.Printf("Persistent session %s requires a pty", name)
+					req.Reply(false, nil)
+					continue
+				}
+				persistent, err = attachPersistentSession(c.identity, name, connection, func() *exec.Cmd {
+					return newShellCommand("", append(shellEnv, variable.SSHSessionEnvName+"="+name))
+				}, ptyRequest)
+				if err != nil {
+					log.Printf("Attaching persistent session error: %s", err)
+					persistent = nil
+					req.Reply(false, nil)
+					continue
+				}
+				ptyFile, started = persistent.ptyFile, true
 				req.Reply(true, nil)
+				continue
 			}
-		case "pty-req":
-			enablePty = true
-			var err error = nil
-			ptyFile, err = startPtyShell(connection)
+			shell = newShellCommand(command, shellEnv)
+			if ptyRequest != nil {
+				ptyFile, err = startPtyShell(connection, shell, ptyRequest)
+			} else {
+				err = startNoPtyShell(connection, shell)
+			}
+			if err != nil {
+				log.Printf("Creating shell error: %s", err)
+				shell = nil
+				req.Reply(false, nil)
+				continue
+			}
+			started = true
+			req.Reply(true, nil)
+		case "subsystem":
+			d := subsystemRequestData{}
+			// A forced command can not be bypassed by a subsystem
+			if ssh.Unmarshal(req.Payload, &d) != nil || d.Name != "sftp" || started || c.restrictions.command != "" {
+				req.Reply(false, nil)
+				continue
+			}
+			server, err := newSFTPServer(c.config.SFTPRoot, connection)
+			if err != nil {
+				log.Printf("Creating sftp server error: %s", err)
+				req.Reply(false, nil)
+				continue
+			}
+			started = true
+			req.Reply(true, nil)
+			go func() {
+				status := uint32(0)
+				if err := server.serve(connection); err != nil {
+					log.Printf("Sftp session from %s error: %s", c.conn.RemoteAddr().String(), err)
+					status = 1
+				}
+				connection.CloseWrite()
+				connection.SendRequest("exit-status", false, ssh.Marshal(exitStatusData{status}))
+				connection.Close()
+			}()
+		case "auth-agent-req@openssh.com":
+			if c.restrictions.noAgentForwarding || agent != nil || started {
+				req.Reply(false, nil)
+				continue
+			}
+			agent, err = c.startAgentForward()
 			if err != nil {
-				return
+				log.Printf("Creating agent forwarding error: %s", err)
+				agent = nil
+				req.Reply(false, nil)
+				continue
+			}
+			req.Reply(true, nil)
+		case "x11-req":
+			d := x11RequestData{}
+			if !c.config.X11Forwarding || c.restrictions.noX11Forwarding || x11 != nil || started || ssh.Unmarshal(req.Payload, &d) != nil {
+				req.Reply(false, nil)
+				continue
+			}
+			x11, err = c.startX11Forward(d)
+			if err != nil {
+				log.Printf("Creating x11 forwarding error: %s", err)
+				x11 = nil
+				req.Reply(false, nil)
+				continue
+			}
+			req.Reply(true, nil)
+		case "pty-req":
+			d := ptyRequestData{}
+			if c.restrictions.noPty || started || ssh.Unmarshal(req.Payload, &d) != nil {
+				req.Reply(false, nil)
+				continue
 			}
-			termLen := req.Payload[3]
-			w, h := parseDims(req.Payload[termLen+4:])
-			SetWinsize(ptyFile.Fd(), w, h)
+			ptyRequest = &d
 			// Responding true (OK) here will let the client
-			// know we have a pty ready for input
+			// know we have a pty ready for the command
 			req.Reply(true, nil)
 		case "window-change":
 			w, h := parseDims(req.Payload)
-			SetWinsize(ptyFile.Fd(), w, h)
+			if ptyFile != nil {
+				SetWinsize(ptyFile.Fd(), w, h)
+			} else if ptyRequest != nil {
+				ptyRequest.Columns, ptyRequest.Rows = w, h
+			}
+		default:
+			req.Reply(false, nil)
 		}
 	}
-	log.Printf("Session closed from %s", remoteAttr.String())
+	// The channel is closed, hang up the command if it is still running
+	if agent != nil {
+		agent.close()
+	}
+	if x11 != nil {
+		x11.close()
+	}
+	if persistent != nil {
+		persistent.detach(connection)
+	} else if ptyFile != nil {
+		ptyFile.Close()
+	} else if shell != nil {
+		shell.Process.Signal(syscall.SIGHUP)
+	}
+	log.Printf("Session closed from %s", c.conn.RemoteAddr().String())
 }
 
-func newShellCommand(connection ssh.Channel) (shell *exec.Cmd, close func()) {
+// newShellCommand - the login shell, or the shell running `command` if it is not empty, with the environment `env`
+func newShellCommand(command string, env []string) *exec.Cmd {
 	// Fire up bash for this session
-	shell = exec.Command(tools.GetUnixUserShell())
+	shell := exec.Command(tools.GetUnixUserShell())
+	if command != "" {
+		shell = exec.Command(tools.GetUnixUserShell(), "-c", command)
+	}
 	// bash := exec.Command("bash")
 	//  Config shell pwd to User Home dir
 	u, err := user.Current()
 	if err == nil {
 		shell.Dir = u.HomeDir
 	}
-	// Prepare teardown function
-	close = func() {
-		connection.Close()
-		_, err := shell.Process.Wait()
-		if err != nil {
-			log.Printf("Failed to exit bash (%s)", err)
-		}
+	shell.Env = env
+	return shell
+}
+
+// exit-signal data struct as specified in RFC4254, Section 6.10
+type exitSignalData struct {
+	Signal     string
+	CoreDumped bool
+	Error      string
+	Lang       string
+}
+
+// signalNames - signal names of RFC4254, Section 6.10
+var signalNames = map[syscall.Signal]string{
+	syscall.SIGABRT: "ABRT",
+	syscall.SIGALRM: "ALRM",
+	syscall.SIGFPE:  "FPE",
+	syscall.SIGHUP:  "HUP",
+	syscall.SIGILL:  "ILL",
+	syscall.SIGINT:  "INT",
+	syscall.SIGKILL: "KILL",
+	syscall.SIGPIPE: "PIPE",
+	syscall.SIGQUIT: "QUIT",
+	syscall.SIGSEGV: "SEGV",
+	syscall.SIGTERM: "TERM",
+	syscall.SIGUSR1: "USR1",
+	syscall.SIGUSR2: "USR2",
+}
+
+// signalName - the name of `signal` in exit-signal, other signals are named as OpenSSH does
+func signalName(signal syscall.Signal) string {
+	if name, ok := signalNames[signal]; ok {
+		return name
 	}
-	return
+	return "SIG@openssh.com"
 }
 
-func startPtyShell(connection ssh.Channel) (*os.File, error) {
-	// New shell command
-	shell, close := newShellCommand(connection)
+// finishShell - wait for the shell whose output is all read, then send EOF, how the shell ended, and close the channel
+func finishShell(connection ssh.Channel, shell *exec.Cmd) {
+	if err := shell.Wait(); err != nil {
+		log.Printf("Shell exited (%s)", err)
+	}
+	connection.CloseWrite()
+	if status, ok := shell.ProcessState.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		connection.SendRequest("exit-signal", false, ssh.Marshal(exitSignalData{
+			Signal:     signalName(status.Signal()),
+			CoreDumped: status.CoreDump(),
+			Error:      status.Signal().String(),
+		}))
+	} else {
+		connection.SendRequest("exit-status", false, ssh.Marshal(exitStatusData{uint32(shell.ProcessState.ExitCode())}))
+	}
+	connection.Close()
+}
 
+func startPtyShell(connection ssh.Channel, shell *exec.Cmd, ptyRequest *ptyRequestData) (*os.File, error) {
 	// Allocate a terminal for this session
 	log.Printf("Creating pty shell(%s)...", shell.Path)
 	ptyFile, err := pty.Start(shell)
 	if err != nil {
 		log.Printf("Could not start pty (%s)", err)
-		close()
 		return nil, err
 	}
+	SetWinsize(ptyFile.Fd(), ptyRequest.Columns, ptyRequest.Rows)
 
 	//pipe session to bash and visa-versa
-	var once sync.Once
 	go func() {
 		io.Copy(connection, ptyFile)
-		once.Do(close)
-	}()
-	go func() {
-		io.Copy(ptyFile, connection)
-		once.Do(close)
+		finishShell(connection, shell)
 	}()
+	// The EOF of the session is ignored, as OpenSSH does, the terminal has no end of input but ^D
+	go io.Copy(ptyFile, connection)
 	return ptyFile, nil
 }
 
-func startNoPtyShell(connection ssh.Channel) error {
-	// New shell command
-	shell, close := newShellCommand(connection)
+func startNoPtyShell(connection ssh.Channel, shell *exec.Cmd) error {
+	shell.Stdout = connection
+	// stderr is sent as extended data
+	shell.Stderr = connection.Stderr()
 
 	// Create pipe
 	writer, err := shell.StdinPipe()
 	if err != nil {
-		connection.Close()
-		return err
-	}
-	reader, err := shell.StdoutPipe()
-	if err != nil {
-		connection.Close()
 		return err
 	}
 
 	// Allocate a no pty shell for this Sessions
 	log.Printf("Creating not pty shell (%s)...", shell.Path)
-	shell.Start()
+	if err := shell.Start(); err != nil {
+		return err
+	}
 
-	//pipe session to bash and visa-versa
-	var once sync.Once
-	go func() {
-		io.Copy(connection, reader)
-		once.Do(close)
-	}()
+	//pipe session to bash, the EOF of the session closes the stdin
 	go func() {
 		io.Copy(writer, connection)
-		once.Do(close)
+		writer.Close()
 	}()
+	go finishShell(connection, shell)
 	return nil
 }
 
@@ -0,0 +1,166 @@
+package simplesshd
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// dialTestServer - a client of the channel handlers over loopback TCP, without auth
+func dialTestServer(t *testing.T, serverConfig Config, r restrictions) *ssh.Client {
+	return dialTestServerAs(t, "test", serverConfig, r)
+}
+
+// dialTestServerAs - dial a server accepting every client, as `user`
+func dialTestServerAs(t *testing.T, user string, serverConfig Config, r restrictions) *ssh.Client {
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &ssh.ServerConfig{NoClientAuth: true}
+	config.AddHostKey(signer)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		serverConn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		sshConn, channels, requests, err := ssh.NewServerConn(serverConn, config)
+		if err != nil {
+			return
+		}
+		c := &client{conn: sshConn, config: serverConfig, identity: identityOf(sshConn), restrictions: r, forwards: map[string]net.Listener{}}
+		go handleGlobalRequests(requests, c)
+		handleChannels(channels, c)
+	}()
+	clientConn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, channels, requests, err := ssh.NewClientConn(clientConn, listener.Addr().String(), &ssh.ClientConfig{
+		User:            user,
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sshClient := ssh.NewClient(conn, channels, requests)
+	t.Cleanup(func() { sshClient.Close() })
+	return sshClient
+}
+
+func TestSessionExec(t *testing.T) {
+	sshClient := dialTestServer(t, Config{}, restrictions{})
+	tests := []struct {
+		name       string
+		command    string
+		stdin      string
+		pty        bool
+		wantStdout string
+		wantStderr string
+		wantStatus int
+		wantSignal string
+	}{
+		{name: "status", command: "echo out; echo err >&2; exit 3", wantStdout: "out\n", wantStderr: "err\n", wantStatus: 3},
+		{name: "stdin eof", command: "cat; echo done", stdin: "in\n", wantStdout: "in\ndone\n"},
+		// the client reports a signal as the status 128+n, like a shell
+		{name: "signal", command: "kill -TERM $$", wantStatus: 143, wantSignal: "TERM"},
+		{name: "pty", command: "test -t 0 && echo tty; exit 5", pty: true, wantStdout: "tty\r\n", wantStatus: 5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			session, err := sshClient.NewSession()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer session.Close()
+			var stdout, stderr bytes.Buffer
+			session.Stdin, session.Stdout, session.Stderr = strings.NewReader(tt.stdin), &stdout, &stderr
+			if tt.pty {
+				if err := session.RequestPty("xterm", 24, 80, ssh.TerminalModes{}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			err = session.Run(tt.command)
+			status, signal := 0, ""
+			var exitError *ssh.ExitError
+			if errors.As(err, &exitError) {
+				status, signal = exitError.ExitStatus(), exitError.Signal()
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if status != tt.wantStatus || signal != tt.wantSignal {
+				t.Errorf("exit = %d %q, want %d %q", status, signal, tt.wantStatus, tt.wantSignal)
+			}
+			// bash runs ~/.bashrc for ssh sessions, which may print something before the command
+			if !strings.HasSuffix(stdout.String(), tt.wantStdout) || !strings.HasSuffix(stderr.String(), tt.wantStderr) {
+				t.Errorf("stdout = %q, stderr = %q, want %q, %q", stdout.String(), stderr.String(), tt.wantStdout, tt.wantStderr)
+			}
+		})
+	}
+}
+
+func TestSessionEnv(t *testing.T) {
+	sshClient := dialTestServer(t, Config{AcceptEnv: []string{"GIT_*"}}, restrictions{})
+	session, err := sshClient.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+	for name, accepted := range map[string]bool{"LANG": true, "LC_ALL": true, "GIT_EDITOR": true, "PATH": false, "SSH_CLIENT": false} {
+		if err := session.Setenv(name, "C"); (err == nil) != accepted {
+			t.Errorf("Setenv(%s) = %v, want accepted %v", name, err, accepted)
+		}
+	}
+	if err := session.RequestPty("vt100", 24, 80, ssh.TerminalModes{}); err != nil {
+		t.Fatal(err)
+	}
+	output, err := session.Output(`echo "$LANG $LC_ALL $GIT_EDITOR $TERM $SSH_CONNECTION" | sed "s/[0-9][0-9.]*/N/g"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "C C C vtN N N N N\r\n"; !strings.HasSuffix(string(output), want) {
+		t.Errorf("output = %q, want %q", output, want)
+	}
+}
+
+// startWaitingCommand - start a command printing the shell words `value`, then it waits until `stdin` is closed
+func startWaitingCommand(t *testing.T, session *ssh.Session, value string) (line string, stdin io.WriteCloser) {
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := session.Start(`echo "value:` + value + `"; read line || true`); err != nil {
+		t.Fatal(err)
+	}
+	// bash runs ~/.bashrc for ssh sessions, which may print something before the command
+	reader := bufio.NewReader(stdout)
+	for {
+		if line, err = reader.ReadString('\n'); err != nil {
+			t.Fatal(err)
+		}
+		if strings.HasPrefix(line, "value:") {
+			return strings.TrimSpace(strings.TrimPrefix(line, "value:")), stdin
+		}
+	}
+}
@@ -0,0 +1,819 @@
+package simplesshd
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/user"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// SFTP version 3 server, see https://tools.ietf.org/html/draft-ietf-secsh-filexfer-02
+// Requests are served one by one in order, relative paths are relative to the home dir.
+// With a root, paths of the client are in a virtual file system whose `/` is the root,
+// symlinks pointing outside the root are refused.
+
+// Packet types
+const (
+	sftpInit          = 1
+	sftpVersion       = 2
+	sftpOpen          = 3
+	sftpClose         = 4
+	sftpRead          = 5
+	sftpWrite         = 6
+	sftpLstat         = 7
+	sftpFstat         = 8
+	sftpSetstat       = 9
+	sftpFsetstat      = 10
+	sftpOpendir       = 11
+	sftpReaddir       = 12
+	sftpRemove        = 13
+	sftpMkdir         = 14
+	sftpRmdir         = 15
+	sftpRealpath      = 16
+	sftpStat          = 17
+	sftpRename        = 18
+	sftpReadlink      = 19
+	sftpSymlink       = 20
+	sftpStatus        = 101
+	sftpHandle        = 102
+	sftpData          = 103
+	sftpName          = 104
+	sftpAttrs         = 105
+	sftpExtended      = 200
+	sftpExtendedReply = 201
+)
+
+// Status codes
+const (
+	sftpOK               = 0
+	sftpEOF              = 1
+	sftpNoSuchFile       = 2
+	sftpPermissionDenied = 3
+	sftpFailure          = 4
+	sftpBadMessage       = 5
+	sftpOpUnsupported    = 8
+)
+
+// Attribute flags
+const (
+	sftpAttrSize        = 0x00000001
+	sftpAttrUIDGID      = 0x00000002
+	sftpAttrPermissions = 0x00000004
+	sftpAttrACModTime   = 0x00000008
+	sftpAttrExtended    = 0x80000000
+)
+
+// Open flags
+const (
+	sftpOpenRead   = 0x00000001
+	sftpOpenWrite  = 0x00000002
+	sftpOpenAppend = 0x00000004
+	sftpOpenCreate = 0x00000008
+	sftpOpenTrunc  = 0x00000010
+	sftpOpenExcl   = 0x00000020
+)
+
+const (
+	// sftpMaxPacketSize - max length of a request, OpenSSH clients send at most 256KiB
+	sftpMaxPacketSize = 256*1024 + 1024
+	// sftpMaxReadSize - max data of a read response
+	sftpMaxReadSize = 256 * 1024
+	// sftpReaddirCount - max names of a readdir response
+	sftpReaddirCount = 128
+	// sftpPosixRename - the extension renaming over an existing file
+	sftpPosixRename = "posix-rename@openssh.com"
+)
+
+var errSFTPBadMessage = errors.New("bad message")
+
+// sftpAttributes - file attributes of a request or a response, fields are valid if their flag is set
+type sftpAttributes struct {
+	flags       uint32
+	size        uint64
+	uid, gid    uint32
+	permissions uint32
+	atime       uint32
+	mtime       uint32
+}
+
+// sftpFileHandle - an open file or dir of the client
+type sftpFileHandle struct {
+	file   *os.File
+	append bool
+}
+
+// sftpServer - state of a SFTP session
+type sftpServer struct {
+	// root - real path of the virtual `/`, empty means the real file system
+	root string
+	// home - the dir of relative paths in the virtual file system
+	home       string
+	handles    map[string]*sftpFileHandle
+	nextHandle uint64
+	writer     io.Writer
+}
+
+// newSFTPServer - a SFTP server whose file system is rooted at `root` if not empty
+func newSFTPServer(root string, writer io.Writer) (*sftpServer, error) {
+	home := "/"
+	if u, err := user.Current(); err == nil {
+		home = u.HomeDir
+	}
+	s := &sftpServer{home: home, handles: map[string]*sftpFileHandle{}, writer: writer}
+	if root == "" {
+		return s, nil
+	}
+	root, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return nil, err
+	}
+	s.root, s.home = root, "/"
+	// start at home if it is in the root
+	if realHome, err := filepath.EvalSymlinks(home); err == nil && s.inRoot(realHome) {
+		s.home = path.Join("/", strings.TrimPrefix(realHome, root))
+	}
+	return s, nil
+}
+
+// serve - serve requests of `reader` until EOF
+func (s *sftpServer) serve(reader io.Reader) error {
+	defer func() {
+		for _, h := range s.handles {
+			h.file.Close()
+		}
+	}()
+	r := bufio.NewReaderSize(reader, 64*1024)
+	header := make([]byte, 4)
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		length := binary.BigEndian.Uint32(header)
+		if length == 0 || length > sftpMaxPacketSize {
+			return fmt.Errorf("sftp packet length %d out of range", length)
+		}
+		packet := make([]byte, length)
+		if _, err := io.ReadFull(r, packet); err != nil {
+			return err
+		}
+		if err := s.handle(packet[0], &sftpBuffer{data: packet[1:]}); err != nil {
+			return err
+		}
+	}
+}
+
+// handle - respond a request, an error is of writing the response
+func (s *sftpServer) handle(packetType byte, request *sftpBuffer) error {
+	if packetType == sftpInit {
+		// extensions are pairs of name and version
+		response := appendSFTPString(appendUint32([]byte{sftpVersion}, 3), sftpPosixRename)
+		return s.send(appendSFTPString(response, "1"))
+	}
+	id, err := request.uint32()
+	if err != nil {
+		// no id to respond
+		return nil
+	}
+	response, err := s.dispatch(packetType, id, request)
+	if err != nil {
+		response = sftpStatusPacket(id, err)
+	}
+	return s.send(response)
+}
+
+// dispatch - the response of a request with id
+func (s *sftpServer) dispatch(packetType byte, id uint32, request *sftpBuffer) ([]byte, error) {
+	switch packetType {
+	case sftpOpen:
+		name, err := request.string()
+		if err != nil {
+			return nil, err
+		}
+		pflags, err := request.uint32()
+		if err != nil {
+			return nil, err
+		}
+		attrs, err := request.attrs()
+		if err != nil {
+			return nil, err
+		}
+		return s.open(id, name, pflags, attrs)
+	case sftpClose:
+		handle, err := request.string()
+		if err != nil {
+			return nil, err
+		}
+		h, ok := s.handles[handle]
+		if !ok {
+			return nil, errSFTPInvalidHandle
+		}
+		delete(s.handles, handle)
+		return sftpStatusPacket(id, h.file.Close()), nil
+	case sftpRead:
+		h, err := s.fileHandle(request)
+		if err != nil {
+			return nil, err
+		}
+		offset, err := request.uint64()
+		if err != nil {
+			return nil, err
+		}
+		length, err := request.uint32()
+		if err != nil {
+			return nil, err
+		}
+		if length > sftpMaxReadSize {
+			length = sftpMaxReadSize
+		}
+		data := make([]byte, length)
+		n, err := h.file.ReadAt(data, int64(offset))
+		if n == 0 && err != nil {
+			return nil, err
+		}
+		return appendSFTPString(appendUint32([]byte{sftpData}, id), string(data[:n])), nil
+	case sftpWrite:
+		h, err := s.fileHandle(request)
+		if err != nil {
+			return nil, err
+		}
+		offset, err := request.uint64()
+		if err != nil {
+			return nil, err
+		}
+		data, err := request.string()
+		if err != nil {
+			return nil, err
+		}
+		// WriteAt is not allowed with O_APPEND, and the offset is ignored by append anyway
+		if h.append {
+			_, err = h.file.Write([]byte(data))
+		} else {
+			_, err = h.file.WriteAt([]byte(data), int64(offset))
+		}
+		return sftpStatusPacket(id, err), nil
+	case sftpLstat, sftpStat:
+		name, err := request.string()
+		if err != nil {
+			return nil, err
+		}
+		realName, err := s.realPath(name, packetType == sftpStat)
+		if err != nil {
+			return nil, err
+		}
+		stat := os.Stat
+		if packetType == sftpLstat {
+			stat = os.Lstat
+		}
+		info, err := stat(realName)
+		if err != nil {
+			return nil, err
+		}
+		return appendSFTPAttrs(appendUint32([]byte{sftpAttrs}, id), info), nil
+	case sftpFstat:
+		h, err := s.fileHandle(request)
+		if err != nil {
+			return nil, err
+		}
+		info, err := h.file.Stat()
+		if err != nil {
+			return nil, err
+		}
+		return appendSFTPAttrs(appendUint32([]byte{sftpAttrs}, id), info), nil
+	case sftpSetstat:
+		name, err := request.string()
+		if err != nil {
+			return nil, err
+		}
+		attrs, err := request.attrs()
+		if err != nil {
+			return nil, err
+		}
+		realName, err := s.realPath(name, true)
+		if err != nil {
+			return nil, err
+		}
+		return sftpStatusPacket(id, setSFTPAttrs(realName, attrs)), nil
+	case sftpFsetstat:
+		h, err := s.fileHandle(request)
+		if err != nil {
+			return nil, err
+		}
+		attrs, err := request.attrs()
+		if err != nil {
+			return nil, err
+		}
+		return sftpStatusPacket(id, fsetSFTPAttrs(h.file, attrs)), nil
+	case sftpOpendir:
+		name, err := request.string()
+		if err != nil {
+			return nil, err
+		}
+		realName, err := s.realPath(name, true)
+		if err != nil {
+			return nil, err
+		}
+		if info, err := os.Stat(realName); err != nil {
+			return nil, err
+		} else if !info.IsDir() {
+			return nil, &os.PathError{Op: "opendir", Path: name, Err: syscall.ENOTDIR}
+		}
+		file, err := os.Open(realName)
+		if err != nil {
+			return nil, err
+		}
+		return s.newHandle(id, &sftpFileHandle{file: file}), nil
+	case sftpReaddir:
+		h, err := s.fileHandle(request)
+		if err != nil {
+			return nil, err
+		}
+		infos, err := h.file.Readdir(sftpReaddirCount)
+		if len(infos) == 0 {
+			return nil, err
+		}
+		response := appendUint32(appendUint32([]byte{sftpName}, id), uint32(len(infos)))
+		for _, info := range infos {
+			response = appendSFTPString(response, info.Name())
+			response = appendSFTPString(response, sftpLongName(info))
+			response = appendSFTPAttrs(response, info)
+		}
+		return response, nil
+	case sftpRemove, sftpRmdir:
+		name, err := request.string()
+		if err != nil {
+			return nil, err
+		}
+		realName, err := s.realPath(name, false)
+		if err != nil {
+			return nil, err
+		}
+		if packetType == sftpRemove {
+			err = syscall.Unlink(realName)
+		} else {
+			err = syscall.Rmdir(realName)
+		}
+		return sftpStatusPacket(id, err), nil
+	case sftpMkdir:
+		name, err := request.string()
+		if err != nil {
+			return nil, err
+		}
+		attrs, err := request.attrs()
+		if err != nil {
+			return nil, err
+		}
+		realName, err := s.realPath(name, false)
+		if err != nil {
+			return nil, err
+		}
+		mode := os.FileMode(0777)
+		if attrs.flags&sftpAttrPermissions != 0 {
+			mode = os.FileMode(attrs.permissions & 0777)
+		}
+		return sftpStatusPacket(id, os.Mkdir(realName, mode)), nil
+	case sftpRealpath:
+		name, err := request.string()
+		if err != nil {
+			return nil, err
+		}
+		return sftpNamePacket(id, s.virtualPath(name)), nil
+	case sftpRename:
+		oldName, err := request.string()
+		if err != nil {
+			return nil, err
+		}
+		newName, err := request.string()
+		if err != nil {
+			return nil, err
+		}
+		return sftpStatusPacket(id, s.rename(oldName, newName, false)), nil
+	case sftpReadlink:
+		name, err := request.string()
+		if err != nil {
+			return nil, err
+		}
+		realName, err := s.realPath(name, false)
+		if err != nil {
+			return nil, err
+		}
+		target, err := os.Readlink(realName)
+		if err != nil {
+			return nil, err
+		}
+		if s.root != "" && path.IsAbs(target) && s.inRoot(target) {
+			target = path.Join("/", strings.TrimPrefix(target, s.root))
+		}
+		return sftpNamePacket(id, target), nil
+	case sftpSymlink:
+		// OpenSSH sends the target first, reversed from the draft, and other clients follow it
+		target, err := request.string()
+		if err != nil {
+			return nil, err
+		}
+		name, err := request.string()
+		if err != nil {
+			return nil, err
+		}
+		realName, err := s.realPath(name, false)
+		if err != nil {
+			return nil, err
+		}
+		if s.root != "" && path.IsAbs(target) {
+			target = filepath.Join(s.root, path.Clean(target))
+		}
+		return sftpStatusPacket(id, os.Symlink(target, realName)), nil
+	case sftpExtended:
+		name, err := request.string()
+		if err != nil {
+			return nil, err
+		}
+		if name != sftpPosixRename {
+			return sftpStatusCode(id, sftpOpUnsupported, "unsupported extension "+name), nil
+		}
+		oldName, err := request.string()
+		if err != nil {
+			return nil, err
+		}
+		newName, err := request.string()
+		if err != nil {
+			return nil, err
+		}
+		return sftpStatusPacket(id, s.rename(oldName, newName, true)), nil
+	}
+	return sftpStatusCode(id, sftpOpUnsupported, fmt.Sprintf("unsupported request type %d", packetType)), nil
+}
+
+var errSFTPInvalidHandle = errors.New("invalid handle")
+
+// open - open a file for the client
+func (s *sftpServer) open(id uint32, name string, pflags uint32, attrs sftpAttributes) ([]byte, error) {
+	realName, err := s.realPath(name, true)
+	if err != nil {
+		return nil, err
+	}
+	flags := 0
+	switch {
+	case pflags&sftpOpenRead != 0 && pflags&sftpOpenWrite != 0:
+		flags = os.O_RDWR
+	case pflags&sftpOpenWrite != 0:
+		flags = os.O_WRONLY
+	}
+	if pflags&sftpOpenAppend != 0 {
+		flags |= os.O_APPEND
+	}
+	if pflags&sftpOpenCreate != 0 {
+		flags |= os.O_CREATE
+	}
+	if pflags&sftpOpenTrunc != 0 {
+		flags |= os.O_TRUNC
+	}
+	if pflags&sftpOpenExcl != 0 {
+		flags |= os.O_EXCL
+	}
+	mode := os.FileMode(0666)
+	if attrs.flags&sftpAttrPermissions != 0 {
+		mode = os.FileMode(attrs.permissions & 0777)
+	}
+	file, err := os.OpenFile(realName, flags, mode)
+	if err != nil {
+		return nil, err
+	}
+	return s.newHandle(id, &sftpFileHandle{file: file, append: pflags&sftpOpenAppend != 0}), nil
+}
+
+// rename - rename a file, without `overwrite` an existing new name is a failure as the draft requires
+func (s *sftpServer) rename(oldName, newName string, overwrite bool) error {
+	realOld, err := s.realPath(oldName, false)
+	if err != nil {
+		return err
+	}
+	realNew, err := s.realPath(newName, false)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Lstat(realNew); err == nil && !overwrite {
+		return &os.LinkError{Op: "rename", Old: oldName, New: newName, Err: syscall.EEXIST}
+	}
+	return os.Rename(realOld, realNew)
+}
+
+// newHandle - a handle response of the open file `h`
+func (s *sftpServer) newHandle(id uint32, h *sftpFileHandle) []byte {
+	s.nextHandle++
+	handle := strconv.FormatUint(s.nextHandle, 10)
+	s.handles[handle] = h
+	return appendSFTPString(appendUint32([]byte{sftpHandle}, id), handle)
+}
+
+// fileHandle - the open file of the handle in `request`
+func (s *sftpServer) fileHandle(request *sftpBuffer) (*sftpFileHandle, error) {
+	handle, err := request.string()
+	if err != nil {
+		return nil, err
+	}
+	h, ok := s.handles[handle]
+	if !ok {
+		return nil, errSFTPInvalidHandle
+	}
+	return h, nil
+}
+
+// virtualPath - the clean absolute path of the client path `name`
+func (s *sftpServer) virtualPath(name string) string {
+	if !path.IsAbs(name) {
+		name = path.Join(s.home, name)
+	}
+	return path.Clean(name)
+}
+
+// inRoot - whether the real path `name` is in the root
+func (s *sftpServer) inRoot(name string) bool {
+	return name == s.root || strings.HasPrefix(name, s.root+"/") || s.root == "/"
+}
+
+// realPath - the real path of the client path `name`
+// with a root, the dir of `name` must resolve into the root, and with `follow`, `name` itself must too
+func (s *sftpServer) realPath(name string, follow bool) (string, error) {
+	virtual := s.virtualPath(name)
+	if s.root == "" {
+		return virtual, nil
+	}
+	realName := filepath.Join(s.root, virtual)
+	check := realName
+	// the virtual `/` is the root itself, even if it is not followed
+	if !follow && virtual != "/" {
+		check = filepath.Dir(realName)
+	}
+	// the deepest existing path must resolve into the root, a dangling symlink is refused as its target is unknown
+	for {
+		resolved, err := filepath.EvalSymlinks(check)
+		if err == nil {
+			if !s.inRoot(resolved) {
+				return "", &os.PathError{Op: "resolve", Path: name, Err: syscall.EACCES}
+			}
+			return realName, nil
+		}
+		if _, lstatErr := os.Lstat(check); !os.IsNotExist(lstatErr) {
+			return "", &os.PathError{Op: "resolve", Path: name, Err: syscall.EACCES}
+		}
+		if parent := filepath.Dir(check); parent != check {
+			check = parent
+		} else {
+			return realName, nil
+		}
+	}
+}
+
+// send - write a response packet
+func (s *sftpServer) send(packet []byte) error {
+	_, err := s.writer.Write(append(appendUint32(make([]byte, 0, 4+len(packet)), uint32(len(packet))), packet...))
+	return err
+}
+
+// sftpStatusPacket - the status response of `err`, nil means OK
+func sftpStatusPacket(id uint32, err error) []byte {
+	var (
+		pathError    *os.PathError
+		linkError    *os.LinkError
+		syscallError *os.SyscallError
+	)
+	switch {
+	case err == nil:
+		return sftpStatusCode(id, sftpOK, "Success")
+	case err == io.EOF:
+		return sftpStatusCode(id, sftpEOF, "End of file")
+	case err == errSFTPBadMessage:
+		return sftpStatusCode(id, sftpBadMessage, err.Error())
+	case os.IsNotExist(err):
+		return sftpStatusCode(id, sftpNoSuchFile, "No such file")
+	case os.IsPermission(err):
+		return sftpStatusCode(id, sftpPermissionDenied, "Permission denied")
+	// the real path of the error is not told to the client
+	case errors.As(err, &pathError):
+		err = pathError.Err
+	case errors.As(err, &linkError):
+		err = linkError.Err
+	case errors.As(err, &syscallError):
+		err = syscallError.Err
+	}
+	return sftpStatusCode(id, sftpFailure, err.Error())
+}
+
+// sftpStatusCode - the status response of `code`
+func sftpStatusCode(id uint32, code uint32, message string) []byte {
+	response := appendUint32(appendUint32([]byte{sftpStatus}, id), code)
+	return appendSFTPString(appendSFTPString(response, message), "")
+}
+
+// sftpNamePacket - the name response of one name without attributes
+func sftpNamePacket(id uint32, name string) []byte {
+	response := appendUint32(appendUint32([]byte{sftpName}, id), 1)
+	return appendUint32(appendSFTPString(appendSFTPString(response, name), name), 0)
+}
+
+// sftpLongName - the name of a readdir response, in the format of `ls -l`
+func sftpLongName(info os.FileInfo) string {
+	mode := []byte(info.Mode().String())
+	// `ls` shows the type by a lower letter in the first column, and a dash for a regular file
+	switch {
+	case info.Mode()&os.ModeSymlink != 0:
+		mode = append([]byte{'l'}, mode[len(mode)-9:]...)
+	case info.Mode()&os.ModeDevice != 0 && info.Mode()&os.ModeCharDevice == 0:
+		mode = append([]byte{'b'}, mode[len(mode)-9:]...)
+	case info.Mode()&os.ModeCharDevice != 0:
+		mode = append([]byte{'c'}, mode[len(mode)-9:]...)
+	case info.Mode()&os.ModeNamedPipe != 0:
+		mode = append([]byte{'p'}, mode[len(mode)-9:]...)
+	case info.Mode()&os.ModeSocket != 0:
+		mode = append([]byte{'s'}, mode[len(mode)-9:]...)
+	case info.IsDir():
+		mode = append([]byte{'d'}, mode[len(mode)-9:]...)
+	default:
+		mode = append([]byte{'-'}, mode[len(mode)-9:]...)
+	}
+	nlink, uid, gid := uint64(1), uint32(0), uint32(0)
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		nlink, uid, gid = uint64(stat.Nlink), stat.Uid, stat.Gid
+	}
+	modTime := info.ModTime().Format("Jan _2 15:04")
+	if time.Since(info.ModTime()) > 180*24*time.Hour {
+		modTime = info.ModTime().Format("Jan _2  2006")
+	}
+	return fmt.Sprintf("%s %4d %-8d %-8d %8d %s %s", mode, nlink, uid, gid, info.Size(), modTime, info.Name())
+}
+
+// appendSFTPAttrs - append the attributes of `info`
+func appendSFTPAttrs(b []byte, info os.FileInfo) []byte {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		b = appendUint32(b, sftpAttrSize|sftpAttrPermissions|sftpAttrACModTime)
+		b = appendUint64(b, uint64(info.Size()))
+		b = appendUint32(b, uint32(info.Mode().Perm()))
+	} else {
+		b = appendUint32(b, sftpAttrSize|sftpAttrUIDGID|sftpAttrPermissions|sftpAttrACModTime)
+		b = appendUint64(b, uint64(info.Size()))
+		b = appendUint32(appendUint32(b, stat.Uid), stat.Gid)
+		// the mode of stat has the file type bits which clients expect
+		b = appendUint32(b, uint32(stat.Mode))
+	}
+	// the access time of Stat_t differs between platforms, the modification time is used for both
+	mtime := uint32(info.ModTime().Unix())
+	return appendUint32(appendUint32(b, mtime), mtime)
+}
+
+// setSFTPAttrs - apply attributes of a setstat request to the real path `name`
+func setSFTPAttrs(name string, attrs sftpAttributes) error {
+	if attrs.flags&sftpAttrSize != 0 {
+		if err := os.Truncate(name, int64(attrs.size)); err != nil {
+			return err
+		}
+	}
+	if attrs.flags&sftpAttrUIDGID != 0 {
+		if err := os.Chown(name, int(attrs.uid), int(attrs.gid)); err != nil {
+			return err
+		}
+	}
+	if attrs.flags&sftpAttrPermissions != 0 {
+		if err := os.Chmod(name, os.FileMode(attrs.permissions&0777)); err != nil {
+			return err
+		}
+	}
+	if attrs.flags&sftpAttrACModTime != 0 {
+		if err := os.Chtimes(name, time.Unix(int64(attrs.atime), 0), time.Unix(int64(attrs.mtime), 0)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fsetSFTPAttrs - apply attributes of a fsetstat request through the open `file`,
+// its name may be removed and replaced by a symlink pointing outside the root since it was opened
+func fsetSFTPAttrs(file *os.File, attrs sftpAttributes) error {
+	if attrs.flags&sftpAttrSize != 0 {
+		if err := file.Truncate(int64(attrs.size)); err != nil {
+			return err
+		}
+	}
+	if attrs.flags&sftpAttrUIDGID != 0 {
+		if err := file.Chown(int(attrs.uid), int(attrs.gid)); err != nil {
+			return err
+		}
+	}
+	if attrs.flags&sftpAttrPermissions != 0 {
+		if err := file.Chmod(os.FileMode(attrs.permissions & 0777)); err != nil {
+			return err
+		}
+	}
+	if attrs.flags&sftpAttrACModTime != 0 {
+		times := []syscall.Timeval{
+			syscall.NsecToTimeval(time.Unix(int64(attrs.atime), 0).UnixNano()),
+			syscall.NsecToTimeval(time.Unix(int64(attrs.mtime), 0).UnixNano()),
+		}
+		if err := syscall.Futimes(int(file.Fd()), times); err != nil {
+			return &os.PathError{Op: "futimes", Path: file.Name(), Err: err}
+		}
+	}
+	return nil
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	return append(b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func appendUint64(b []byte, v uint64) []byte {
+	return appendUint32(appendUint32(b, uint32(v>>32)), uint32(v))
+}
+
+func appendSFTPString(b []byte, s string) []byte {
+	return append(appendUint32(b, uint32(len(s))), s...)
+}
+
+// sftpBuffer - a request being parsed, a short request is errSFTPBadMessage
+type sftpBuffer struct {
+	data []byte
+}
+
+func (b *sftpBuffer) uint32() (uint32, error) {
+	if len(b.data) < 4 {
+		return 0, errSFTPBadMessage
+	}
+	v := binary.BigEndian.Uint32(b.data)
+	b.data = b.data[4:]
+	return v, nil
+}
+
+func (b *sftpBuffer) uint64() (uint64, error) {
+	if len(b.data) < 8 {
+		return 0, errSFTPBadMessage
+	}
+	v := binary.BigEndian.Uint64(b.data)
+	b.data = b.data[8:]
+	return v, nil
+}
+
+func (b *sftpBuffer) string() (string, error) {
+	length, err := b.uint32()
+	if err != nil || uint32(len(b.data)) < length {
+		return "", errSFTPBadMessage
+	}
+	v := string(b.data[:length])
+	b.data = b.data[length:]
+	return v, nil
+}
+
+func (b *sftpBuffer) attrs() (attrs sftpAttributes, err error) {
+	if attrs.flags, err = b.uint32(); err != nil {
+		return
+	}
+	if attrs.flags&sftpAttrSize != 0 {
+		if attrs.size, err = b.uint64(); err != nil {
+			return
+		}
+	}
+	if attrs.flags&sftpAttrUIDGID != 0 {
+		if attrs.uid, err = b.uint32(); err != nil {
+			return
+		}
+		if attrs.gid, err = b.uint32(); err != nil {
+			return
+		}
+	}
+	if attrs.flags&sftpAttrPermissions != 0 {
+		if attrs.permissions, err = b.uint32(); err != nil {
+			return
+		}
+	}
+	if attrs.flags&sftpAttrACModTime != 0 {
+		if attrs.atime, err = b.uint32(); err != nil {
+			return
+		}
+		if attrs.mtime, err = b.uint32(); err != nil {
+			return
+		}
+	}
+	if attrs.flags&sftpAttrExtended != 0 {
+		var count uint32
+		if count, err = b.uint32(); err != nil {
+			return
+		}
+		// extended attributes are pairs of strings, ignored
+		for i := uint32(0); i < 2*count; i++ {
+			if _, err = b.string(); err != nil {
+				return
+			}
+		}
+	}
+	return
+}
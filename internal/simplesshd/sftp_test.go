@@ -0,0 +1,193 @@
+package simplesshd
+
+import (
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// sftpTestClient - send requests to a sftp server and read its responses
+type sftpTestClient struct {
+	t      *testing.T
+	writer io.Writer
+	reader io.Reader
+	id     uint32
+}
+
+func newSFTPTestClient(t *testing.T, root string) *sftpTestClient {
+	requestReader, requestWriter := io.Pipe()
+	responseReader, responseWriter := io.Pipe()
+	server, err := newSFTPServer(root, responseWriter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		responseWriter.CloseWithError(server.serve(requestReader))
+	}()
+	t.Cleanup(func() { requestWriter.Close() })
+	c := &sftpTestClient{t: t, writer: requestWriter, reader: responseReader}
+	if packetType, _ := c.call(sftpInit, appendUint32(nil, 3)); packetType != sftpVersion {
+		t.Fatalf("init response type %d", packetType)
+	}
+	return c
+}
+
+// call - send a request with fields `b`, the response type and fields after the id
+func (c *sftpTestClient) call(packetType byte, b []byte) (byte, *sftpBuffer) {
+	packet := []byte{packetType}
+	if packetType != sftpInit {
+		c.id++
+		packet = appendUint32(packet, c.id)
+	}
+	packet = append(packet, b...)
+	if _, err := c.writer.Write(append(appendUint32(nil, uint32(len(packet))), packet...)); err != nil {
+		c.t.Fatal(err)
+	}
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(c.reader, header); err != nil {
+		c.t.Fatal(err)
+	}
+	response := make([]byte, binary.BigEndian.Uint32(header))
+	if _, err := io.ReadFull(c.reader, response); err != nil {
+		c.t.Fatal(err)
+	}
+	buffer := &sftpBuffer{data: response[1:]}
+	if response[0] != sftpVersion {
+		if id, _ := buffer.uint32(); id != c.id {
+			c.t.Fatalf("response id %d, want %d", id, c.id)
+		}
+	}
+	return response[0], buffer
+}
+
+// status - the status code of a request which must respond a status
+func (c *sftpTestClient) status(packetType byte, b []byte) uint32 {
+	responseType, response := c.call(packetType, b)
+	if responseType != sftpStatus {
+		c.t.Fatalf("response type %d, want status", responseType)
+	}
+	code, _ := response.uint32()
+	return code
+}
+
+func (c *sftpTestClient) open(name string, pflags uint32) string {
+	responseType, response := c.call(sftpOpen, appendUint32(appendUint32(appendSFTPString(nil, name), pflags), 0))
+	if responseType != sftpHandle {
+		c.t.Fatalf("open %s response type %d", name, responseType)
+	}
+	handle, _ := response.string()
+	return handle
+}
+
+func TestSFTPServer(t *testing.T) {
+	root, err := ioutil.TempDir("", "sftp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	outside, err := ioutil.TempDir("", "outside")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(outside)
+	os.Symlink(outside, filepath.Join(root, "escape"))
+	os.Symlink("escape/x", filepath.Join(root, "dangling"))
+	c := newSFTPTestClient(t, root)
+
+	t.Run("write and read", func(t *testing.T) {
+		handle := c.open("/a.txt", sftpOpenWrite|sftpOpenCreate|sftpOpenTrunc)
+		if code := c.status(sftpWrite, appendSFTPString(appendUint64(appendSFTPString(nil, handle), 0), "hello sftp")); code != sftpOK {
+			t.Fatalf("write status %d", code)
+		}
+		c.status(sftpClose, appendSFTPString(nil, handle))
+		handle = c.open("a.txt", sftpOpenRead)
+		responseType, response := c.call(sftpRead, appendUint32(appendUint64(appendSFTPString(nil, handle), 6), 100))
+		if data, _ := response.string(); responseType != sftpData || data != "sftp" {
+			t.Errorf("read = %d %q", responseType, data)
+		}
+		if code := c.status(sftpRead, appendUint32(appendUint64(appendSFTPString(nil, handle), 10), 100)); code != sftpEOF {
+			t.Errorf("read at end status %d, want EOF", code)
+		}
+	})
+	t.Run("realpath", func(t *testing.T) {
+		responseType, response := c.call(sftpRealpath, appendSFTPString(nil, "/../escape/.."))
+		response.uint32()
+		if name, _ := response.string(); responseType != sftpName || name != "/" {
+			t.Errorf("realpath = %d %q", responseType, name)
+		}
+	})
+	t.Run("escape", func(t *testing.T) {
+		for _, name := range []string{"/escape/b.txt", "dangling", "/../../escape/b.txt"} {
+			if code := c.status(sftpOpen, appendUint32(appendUint32(appendSFTPString(nil, name), sftpOpenWrite|sftpOpenCreate), 0)); code != sftpPermissionDenied {
+				t.Errorf("open %s status %d, want permission denied", name, code)
+			}
+		}
+		// the symlink itself is in the root
+		if responseType, _ := c.call(sftpLstat, appendSFTPString(nil, "escape")); responseType != sftpAttrs {
+			t.Errorf("lstat response type %d", responseType)
+		}
+		if _, err := os.Stat(filepath.Join(outside, "b.txt")); !os.IsNotExist(err) {
+			t.Errorf("file is created outside of the root")
+		}
+	})
+	t.Run("fsetstat of a replaced file", func(t *testing.T) {
+		victim := filepath.Join(outside, "victim.txt")
+		if err := ioutil.WriteFile(victim, []byte("keep"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		realRoot, _ := filepath.EvalSymlinks(root)
+		realVictim, _ := filepath.EvalSymlinks(victim)
+		target, err := filepath.Rel(realRoot, realVictim)
+		if err != nil {
+			t.Fatal(err)
+		}
+		handle := c.open("f.txt", sftpOpenWrite|sftpOpenCreate)
+		if code := c.status(sftpRemove, appendSFTPString(nil, "f.txt")); code != sftpOK {
+			t.Fatalf("remove status %d", code)
+		}
+		if code := c.status(sftpSymlink, appendSFTPString(appendSFTPString(nil, target), "f.txt")); code != sftpOK {
+			t.Fatalf("symlink status %d", code)
+		}
+		attrs := appendUint32(appendUint32(appendUint32(appendUint64(appendUint32(nil, sftpAttrSize|sftpAttrPermissions|sftpAttrACModTime), 0), 0600), 1), 1)
+		if code := c.status(sftpFsetstat, append(appendSFTPString(nil, handle), attrs...)); code != sftpOK {
+			t.Errorf("fsetstat status %d", code)
+		}
+		c.status(sftpClose, appendSFTPString(nil, handle))
+		info, err := os.Stat(victim)
+		if content, _ := ioutil.ReadFile(victim); err != nil || string(content) != "keep" || info.Mode().Perm() != 0644 || info.ModTime().Unix() == 1 {
+			t.Errorf("file outside of the root is changed by fsetstat: %q, %v", content, info.Mode())
+		}
+		os.Remove(filepath.Join(root, "f.txt"))
+	})
+	t.Run("readdir", func(t *testing.T) {
+		responseType, response := c.call(sftpOpendir, appendSFTPString(nil, "/"))
+		handle, _ := response.string()
+		if responseType != sftpHandle {
+			t.Fatalf("opendir response type %d", responseType)
+		}
+		names := 0
+		for {
+			responseType, response := c.call(sftpReaddir, appendSFTPString(nil, handle))
+			if responseType != sftpName {
+				break
+			}
+			count, _ := response.uint32()
+			names += int(count)
+		}
+		if names != 3 {
+			t.Errorf("readdir %d names, want 3", names)
+		}
+	})
+	t.Run("rename", func(t *testing.T) {
+		c.open("b.txt", sftpOpenWrite|sftpOpenCreate)
+		if code := c.status(sftpRename, appendSFTPString(appendSFTPString(nil, "a.txt"), "b.txt")); code != sftpFailure {
+			t.Errorf("rename over a file status %d, want failure", code)
+		}
+		if code := c.status(sftpExtended, appendSFTPString(appendSFTPString(appendSFTPString(nil, sftpPosixRename), "a.txt"), "b.txt")); code != sftpOK {
+			t.Errorf("posix-rename status %d", code)
+		}
+	})
+}
@@ -0,0 +1,344 @@
+package simplesshd
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// x11-req data struct as specified in RFC4254, Section 6.3.1
+type x11RequestData struct {
+	SingleConnection bool
+	AuthProtocol     string
+	AuthCookie       string
+	ScreenNumber     uint32
+}
+
+// x11 channel data struct as specified in RFC4254, Section 6.3.2
+type x11ChannelData struct {
+	OriginAddr string
+	OriginPort uint32
+}
+
+const (
+	// x11DisplayOffset - the first display number, as X11DisplayOffset of sshd_config, so that local X servers are not shadowed
+	x11DisplayOffset = 10
+	// x11MaxDisplays - display numbers to try
+	x11MaxDisplays = 1000
+	// x11BasePort - the TCP port of display 0
+	x11BasePort = 6000
+	// x11SetupTimeout - an X client must send its setup request in time after it connects
+	x11SetupTimeout = 30 * time.Second
+)
+
+// x11UnixDir - the dir of unix sockets of X servers, `X<N>` is the socket of display N
+var x11UnixDir = "/tmp/.X11-unix"
+
+// Address families of Xauthority entries
+const (
+	xauthFamilyInternet = 0
+	xauthFamilyLocal    = 256
+)
+
+// x11Forward - a display of a session, whose connections are forwarded to the X server of the client
+// as OpenSSH, X clients authenticate by a fake cookie in the Xauthority file, which is replaced by the cookie of the client
+// in the setup request of every connection, so that the real cookie never leaves the ssh client
+type x11Forward struct {
+	// listeners - the loopback TCP port and the unix socket of the display
+	listeners []net.Listener
+	display   int
+	screen    uint32
+	// entries - Xauthority entries added for the display
+	entries []xauthEntry
+}
+
+// startX11Forward - listen on the first free display, and add a fake cookie of the display to the Xauthority file
+func (c *client) startX11Forward(d x11RequestData) (*x11Forward, error) {
+	cookie, err := hex.DecodeString(d.AuthCookie)
+	if err != nil || len(cookie) == 0 || len(cookie) > math.MaxUint16 {
+		return nil, errors.New("invalid x11 auth cookie")
+	}
+	fake := make([]byte, len(cookie))
+	if _, err := rand.Read(fake); err != nil {
+		return nil, err
+	}
+	x := &x11Forward{screen: d.ScreenNumber}
+	for display := x11DisplayOffset; display < x11DisplayOffset+x11MaxDisplays && x.listeners == nil; display++ {
+		x.display, x.listeners = display, listenX11Display(display)
+	}
+	if x.listeners == nil {
+		return nil, errors.New("no free x11 display")
+	}
+	// Xlib looks up the local family with the host name for a display on loopback, some clients look up the address
+	hostname, _ := os.Hostname()
+	number := []byte(strconv.Itoa(x.display))
+	x.entries = []xauthEntry{
+		{family: xauthFamilyLocal, address: []byte(hostname), number: number, name: []byte(d.AuthProtocol), data: fake},
+		{family: xauthFamilyInternet, address: []byte{127, 0, 0, 1}, number: number, name: []byte(d.AuthProtocol), data: fake},
+	}
+	if err := updateXauthority(x.entries, nil); err != nil {
+		x.closeListeners()
+		return nil, err
+	}
+	log.Printf("Client %s x11 forwarding on display %d", c.conn.RemoteAddr().String(), x.display)
+	var once sync.Once
+	for _, listener := range x.listeners {
+		go func(listener net.Listener) {
+			for {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				if !d.SingleConnection {
+					go c.forwardX11(conn, d.AuthProtocol, fake, cookie)
+					continue
+				}
+				// only the first connection of either listener is forwarded
+				first := false
+				once.Do(func() { first = true })
+				x.closeListeners()
+				if first {
+					go c.forwardX11(conn, d.AuthProtocol, fake, cookie)
+				} else {
+					conn.Close()
+				}
+				return
+			}
+		}(listener)
+	}
+	return x, nil
+}
+
+// listenX11Display - listen on the TCP port and the unix socket of `display`, nil if it is used
+// the display is still served by TCP if the unix socket dir is not writable
+func listenX11Display(display int) []net.Listener {
+	socket := filepath.Join(x11UnixDir, "X"+strconv.Itoa(display))
+	if _, err := os.Stat(socket); err == nil {
+		// used by a local X server
+		return nil
+	}
+	listener, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", x11BasePort+display))
+	if err != nil {
+		return nil
+	}
+	if _, err := os.Stat(x11UnixDir); os.IsNotExist(err) {
+		// shared by the users as the X servers create it
+		if os.Mkdir(x11UnixDir, 0777) == nil {
+			os.Chmod(x11UnixDir, 01777)
+		}
+	}
+	unixListener, err := net.Listen("unix", socket)
+	if errors.Is(err, syscall.EADDRINUSE) {
+		listener.Close()
+		return nil
+	}
+	if err != nil {
+		log.Printf("Listening x11 unix socket error: %s", err)
+		return []net.Listener{listener}
+	}
+	return []net.Listener{listener, unixListener}
+}
+
+// forwardX11 - open a x11 channel for the X client `conn` whose setup request has the `fake` cookie, which is replaced by `cookie`
+func (c *client) forwardX11(conn net.Conn, authProtocol string, fake []byte, cookie []byte) {
+	conn.SetReadDeadline(time.Now().Add(x11SetupTimeout))
+	setup, err := spoofX11Setup(conn, authProtocol, fake, cookie)
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		log.Printf("Client %s x11 connection refused: %s", c.conn.RemoteAddr().String(), err)
+		conn.Close()
+		return
+	}
+	// a unix socket has no origin, as OpenSSH
+	originAddr, originPort := "127.0.0.1", 0
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		originAddr, originPort = addr.IP.String(), addr.Port
+	}
+	c.openForwardedChannel("x11", ssh.Marshal(x11ChannelData{originAddr, uint32(originPort)}), &x11Conn{conn, io.MultiReader(bytes.NewReader(setup), conn)})
+}
+
+// x11Conn - an X client connection whose setup request is read and replaced by `reader`
+type x11Conn struct {
+	net.Conn
+	reader io.Reader
+}
+
+func (c *x11Conn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+// spoofX11Setup - read the setup request of an X client, check the auth protocol and the `fake` cookie,
+// and return the request with the real `cookie`, see Connection Setup of the X Window System Protocol
+func spoofX11Setup(reader io.Reader, authProtocol string, fake []byte, cookie []byte) ([]byte, error) {
+	// byte order, unused, major and minor version, length of the auth protocol name and data, unused
+	header := make([]byte, 12)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, err
+	}
+	var order binary.ByteOrder
+	switch header[0] {
+	case 'B':
+		order = binary.BigEndian
+	case 'l':
+		order = binary.LittleEndian
+	default:
+		return nil, fmt.Errorf("invalid x11 byte order %d", header[0])
+	}
+	nameLength, dataLength := int(order.Uint16(header[6:])), int(order.Uint16(header[8:]))
+	body := make([]byte, x11Pad(nameLength)+x11Pad(dataLength))
+	if _, err := io.ReadFull(reader, body); err != nil {
+		return nil, err
+	}
+	name, data := body[:nameLength], body[x11Pad(nameLength):x11Pad(nameLength)+dataLength]
+	if string(name) != authProtocol || subtle.ConstantTimeCompare(data, fake) != 1 {
+		return nil, errors.New("wrong x11 auth cookie")
+	}
+	order.PutUint16(header[8:], uint16(len(cookie)))
+	setup := append(append(header, body[:x11Pad(nameLength)]...), cookie...)
+	return append(setup, make([]byte, x11Pad(len(cookie))-len(cookie))...), nil
+}
+
+// x11Pad - `n` padded to a multiple of 4
+func x11Pad(n int) int {
+	return (n + 3) &^ 3
+}
+
+// env - environment variables of the shell for the display
+func (x *x11Forward) env() []string {
+	return []string{fmt.Sprintf("DISPLAY=localhost:%d.%d", x.display, x.screen), "XAUTHORITY=" + xauthorityPath()}
+}
+
+// closeListeners - stop listening on the display, the unix socket is removed
+func (x *x11Forward) closeListeners() {
+	for _, listener := range x.listeners {
+		listener.Close()
+	}
+}
+
+// close - stop listening and remove the cookie
+func (x *x11Forward) close() {
+	x.closeListeners()
+	if err := updateXauthority(nil, x.entries); err != nil {
+		log.Printf("Removing x11 auth cookie error: %s", err)
+	}
+}
+
+// xauthEntry - an entry of the Xauthority file, see Xauth(3)
+type xauthEntry struct {
+	family                      uint16
+	address, number, name, data []byte
+}
+
+// sameDisplay - whether `e` is of the same display as `other`, whose entry is replaced
+func (e xauthEntry) sameDisplay(other xauthEntry) bool {
+	return e.family == other.family && bytes.Equal(e.address, other.address) && bytes.Equal(e.number, other.number)
+}
+
+// xauthorityPath - the Xauthority file, XAUTHORITY of the server or `~/.Xauthority`
+func xauthorityPath() string {
+	if name := os.Getenv("XAUTHORITY"); name != "" {
+		return name
+	}
+	home := "/"
+	if u, err := user.Current(); err == nil {
+		home = u.HomeDir
+	}
+	return filepath.Join(home, ".Xauthority")
+}
+
+// xauthorityMutex - sessions update the Xauthority file one by one
+var xauthorityMutex sync.Mutex
+
+// updateXauthority - replace entries of the displays of `add` by them, and remove entries of `remove`, as `xauth add` and `xauth remove`
+// the file is replaced at once, so that X clients never read a partial file
+func updateXauthority(add []xauthEntry, remove []xauthEntry) error {
+	xauthorityMutex.Lock()
+	defer xauthorityMutex.Unlock()
+	name := xauthorityPath()
+	entries, err := readXauthority(name)
+	if err != nil {
+		return err
+	}
+	kept := make([]xauthEntry, 0, len(entries)+len(add))
+	for _, entry := range entries {
+		drop := false
+		for _, other := range append(append([]xauthEntry{}, add...), remove...) {
+			drop = drop || entry.sameDisplay(other)
+		}
+		if !drop {
+			kept = append(kept, entry)
+		}
+	}
+	kept = append(kept, add...)
+	file, err := ioutil.TempFile(filepath.Dir(name), filepath.Base(name)+"-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	writer := bufio.NewWriter(file)
+	for _, entry := range kept {
+		binary.Write(writer, binary.BigEndian, entry.family)
+		for _, field := range [][]byte{entry.address, entry.number, entry.name, entry.data} {
+			binary.Write(writer, binary.BigEndian, uint16(len(field)))
+			writer.Write(field)
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), name)
+}
+
+// readXauthority - entries of the Xauthority file, none if it does not exist
+func readXauthority(name string) ([]xauthEntry, error) {
+	content, err := ioutil.ReadFile(name)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	reader := bytes.NewReader(content)
+	entries := []xauthEntry{}
+	for reader.Len() > 0 {
+		entry := xauthEntry{}
+		if err := binary.Read(reader, binary.BigEndian, &entry.family); err != nil {
+			return nil, fmt.Errorf("corrupted %s: %w", name, err)
+		}
+		for _, field := range []*[]byte{&entry.address, &entry.number, &entry.name, &entry.data} {
+			var length uint16
+			if err := binary.Read(reader, binary.BigEndian, &length); err != nil {
+				return nil, fmt.Errorf("corrupted %s: %w", name, err)
+			}
+			*field = make([]byte, length)
+			if _, err := io.ReadFull(reader, *field); err != nil {
+				return nil, fmt.Errorf("corrupted %s: %w", name, err)
+			}
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
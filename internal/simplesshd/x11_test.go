@@ -0,0 +1,148 @@
+package simplesshd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// x11SetupRequest - the setup request of an X client in byte `order` 'B' or 'l', with a MIT-MAGIC-COOKIE-1 `cookie`
+func x11SetupRequest(order byte, cookie []byte) []byte {
+	var byteOrder binary.ByteOrder = binary.LittleEndian
+	if order == 'B' {
+		byteOrder = binary.BigEndian
+	}
+	name := "MIT-MAGIC-COOKIE-1"
+	header := make([]byte, 12)
+	header[0] = order
+	byteOrder.PutUint16(header[2:], 11)
+	byteOrder.PutUint16(header[6:], uint16(len(name)))
+	byteOrder.PutUint16(header[8:], uint16(len(cookie)))
+	setup := append(append(header, name...), make([]byte, x11Pad(len(name))-len(name))...)
+	return append(append(setup, cookie...), make([]byte, x11Pad(len(cookie))-len(cookie))...)
+}
+
+func TestX11Forward(t *testing.T) {
+	dir, err := ioutil.TempDir("", "x11")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	xauthority := filepath.Join(dir, ".Xauthority")
+	os.Setenv("XAUTHORITY", xauthority)
+	defer os.Unsetenv("XAUTHORITY")
+	// an entry of another display is kept
+	other := xauthEntry{family: xauthFamilyLocal, address: []byte("other"), number: []byte("0"), name: []byte("MIT-MAGIC-COOKIE-1"), data: []byte{1}}
+	if err := updateXauthority([]xauthEntry{other}, nil); err != nil {
+		t.Fatal(err)
+	}
+	unixDir := x11UnixDir
+	x11UnixDir = filepath.Join(dir, ".X11-unix")
+	defer func() { x11UnixDir = unixDir }()
+	cookie := []byte{0x00, 0x11, 0x22, 0x33, 0x44, 0x55, 0x66, 0x77, 0x88, 0x99, 0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff}
+	request := ssh.Marshal(x11RequestData{AuthProtocol: "MIT-MAGIC-COOKIE-1", AuthCookie: hex.EncodeToString(cookie)})
+
+	t.Run("disabled", func(t *testing.T) {
+		session, err := dialTestServer(t, Config{}, restrictions{}).NewSession()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer session.Close()
+		if ok, _ := session.SendRequest("x11-req", true, request); ok {
+			t.Error("x11-req is accepted without X11Forwarding")
+		}
+	})
+	t.Run("forward", func(t *testing.T) {
+		sshClient := dialTestServer(t, Config{X11Forwarding: true}, restrictions{})
+		channels := sshClient.HandleChannelOpen("x11")
+		// the X server of the client echoes
+		go func() {
+			for newChannel := range channels {
+				channel, requests, err := newChannel.Accept()
+				if err != nil {
+					continue
+				}
+				go ssh.DiscardRequests(requests)
+				go func() {
+					io.Copy(channel, channel)
+					channel.Close()
+				}()
+			}
+		}()
+		session, err := sshClient.NewSession()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer session.Close()
+		if ok, err := session.SendRequest("x11-req", true, request); !ok || err != nil {
+			t.Fatalf("x11-req = %v, %v", ok, err)
+		}
+		line, stdin := startWaitingCommand(t, session, "$DISPLAY $XAUTHORITY")
+		var display int
+		if _, err := fmt.Sscanf(line, "localhost:%d.0 "+xauthority, &display); err != nil || display < x11DisplayOffset {
+			t.Fatalf("DISPLAY XAUTHORITY = %q, %v", line, err)
+		}
+		// the Xauthority file has a fake cookie of the same length
+		entries, err := readXauthority(xauthority)
+		if err != nil || len(entries) != 3 || len(entries[1].data) != len(cookie) || bytes.Equal(entries[1].data, cookie) {
+			t.Fatalf("Xauthority entries = %v, %v", entries, err)
+		}
+		fake := entries[1].data
+		for _, tt := range []struct {
+			network, address string
+			order            byte
+		}{
+			{"tcp", fmt.Sprintf("127.0.0.1:%d", x11BasePort+display), 'l'},
+			{"unix", filepath.Join(x11UnixDir, fmt.Sprintf("X%d", display)), 'B'},
+		} {
+			conn, err := net.Dial(tt.network, tt.address)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// the X server receives the setup request with the real cookie
+			conn.Write(append(x11SetupRequest(tt.order, fake), "ping\n"...))
+			want := append(x11SetupRequest(tt.order, cookie), "ping\n"...)
+			got := make([]byte, len(want))
+			if _, err := io.ReadFull(conn, got); err != nil || !bytes.Equal(got, want) {
+				t.Errorf("%s x11 setup = %q, %v, want %q", tt.network, got, err, want)
+			}
+			conn.Close()
+		}
+		// a wrong cookie is refused
+		conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", x11BasePort+display))
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Write(x11SetupRequest('l', cookie))
+		if n, err := conn.Read(make([]byte, 1)); err == nil {
+			t.Errorf("x11 connection with the real cookie read %d bytes, want closed", n)
+		}
+		conn.Close()
+		stdin.Close()
+		if err := session.Wait(); err != nil {
+			t.Fatal(err)
+		}
+		// the cookie is removed after the session is closed
+		for i := 0; ; i++ {
+			if entries, err = readXauthority(xauthority); err == nil && len(entries) == 1 && string(entries[0].address) == "other" {
+				break
+			} else if i == 100 {
+				t.Fatalf("Xauthority entries after the session = %v, %v", entries, err)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if _, err := os.Stat(filepath.Join(x11UnixDir, fmt.Sprintf("X%d", display))); !os.IsNotExist(err) {
+			t.Errorf("x11 unix socket is not removed after the session: %v", err)
+		}
+	})
+}
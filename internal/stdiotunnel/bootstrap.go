@@ -0,0 +1,304 @@
+package stdiotunnel
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/rectcircle/stdiotunnel/internal/variable"
+)
+
+// The bootstrap drives the remote POSIX shell in the pty during the init stage:
+//  1. wait the shell prompt, probe the remote OS and arch by `uname`
+//  2. if the matching binary is not cached under `~/.stdiotunnel/bin` of the remote, upload it in base64 chunks,
+//     every chunk is decoded by `base64 -d` from the tty and verified by `cksum` before it is appended
+//  3. exec the cached binary as server, with the tty in raw mode
+// Every reply of the shell is a marker `::stdiotunnel-NAME:VALUE::`, the command echoes `::stdio""tunnel-...`
+// so that the terminal echo of the command never matches.
+
+const (
+	bootstrapWaitPrompt = iota
+	bootstrapWaitProbe
+	bootstrapWaitCache
+	bootstrapWaitRecv
+	bootstrapWaitChunk
+	bootstrapWaitInstall
+	bootstrapDone
+)
+
+// bootstrapMarkerPattern - marker of a shell reply
+var bootstrapMarkerPattern = regexp.MustCompile(`::stdiotunnel-([a-z]+):([^:\r\n]*)::`)
+
+// bootstrapEcho - shell command printing the marker `NAME:VALUE`, VALUE may contain shell expansions
+func bootstrapEcho(name string, value string) string {
+	return fmt.Sprintf(`echo "::stdio""tunnel-%s:%s::"`, name, value)
+}
+
+// bootstrapper - state of a bootstrap during an init stage
+type bootstrapper struct {
+	config ClientConfig
+	prompt *regexp.Regexp
+	input  io.Writer
+	state  int
+	// window - output since the last command
+	window []byte
+	binary []byte
+	chunk  int
+	// retries - resend count of the current chunk
+	retries int
+	// written - closed when the last write to the shell is done, the next write waits it, see write
+	written <-chan struct{}
+	// writeMutex - guard writeErr
+	writeMutex sync.Mutex
+	// writeErr - the first failed write to the shell
+	writeErr error
+}
+
+func newBootstrapper(config ClientConfig, input io.Writer) (*bootstrapper, error) {
+	pattern := config.BootstrapPrompt
+	if pattern == "" {
+		pattern = variable.BootstrapPrompt
+	}
+	prompt, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	return &bootstrapper{config: config, prompt: prompt, input: input}, nil
+}
+
+// started - whether the shell prompt has appeared, so the auth is over
+func (b *bootstrapper) started() bool {
+	return b.state != bootstrapWaitPrompt
+}
+
+func (b *bootstrapper) send(command string) error {
+	b.window = b.window[:0]
+	return b.write(command + "\n")
+}
+
+// write - write `data` to the shell aside, the tty applies back pressure until the remote reads, so the output must still be read
+// writes are done in order, a failed write is returned by the next write or feed
+func (b *bootstrapper) write(data string) error {
+	if err := b.writeError(); err != nil {
+		return err
+	}
+	previous, done := b.written, make(chan struct{})
+	b.written = done
+	go func() {
+		defer close(done)
+		if previous != nil {
+			<-previous
+		}
+		if b.writeError() != nil {
+			return
+		}
+		if _, err := io.WriteString(b.input, data); err != nil {
+			b.writeMutex.Lock()
+			b.writeErr = fmt.Errorf("bootstrap: write to the shell: %w", err)
+			b.writeMutex.Unlock()
+		}
+	}()
+	return nil
+}
+
+func (b *bootstrapper) writeError() error {
+	b.writeMutex.Lock()
+	defer b.writeMutex.Unlock()
+	return b.writeErr
+}
+
+// feed - match the new output and run the next step
+func (b *bootstrapper) feed(data []byte) error {
+	if b.state == bootstrapDone {
+		return nil
+	}
+	if err := b.writeError(); err != nil {
+		return err
+	}
+	b.window = append(b.window, data...)
+	if len(b.window) > maxPromptWindow {
+		b.window = b.window[len(b.window)-maxPromptWindow:]
+	}
+	if b.state == bootstrapWaitPrompt {
+		if !b.prompt.Match(b.window) {
+			return nil
+		}
+		b.state = bootstrapWaitProbe
+		return b.send(bootstrapEcho("probe", "$(uname -s)/$(uname -m)"))
+	}
+	match := bootstrapMarkerPattern.FindSubmatch(b.window)
+	if match == nil {
+		return nil
+	}
+	name, value := string(match[1]), string(match[2])
+	switch {
+	case b.state == bootstrapWaitProbe && name == "probe":
+		if err := b.loadBinary(value); err != nil {
+			return err
+		}
+		sum := sha256.Sum256(b.binary)
+		b.state = bootstrapWaitCache
+		return b.send(fmt.Sprintf(`f="$HOME/.stdiotunnel/bin/stdiotunnel-%s"; [ -x "$f" ] && %s || { mkdir -p "$HOME/.stdiotunnel/bin" && rm -f "$f.tmp" && %s || %s; }`,
+			hex.EncodeToString(sum[:8]), bootstrapEcho("cache", "hit"), bootstrapEcho("cache", "miss"), bootstrapEcho("cache", "error")))
+	case b.state == bootstrapWaitCache && name == "cache":
+		switch value {
+		case "hit":
+			return b.exec()
+		case "miss":
+			return b.nextChunk()
+		}
+		return fmt.Errorf("bootstrap: can not create the cache dir on the remote")
+	case b.state == bootstrapWaitRecv && name == "recv":
+		b.state = bootstrapWaitChunk
+		b.window = b.window[:0]
+		data := b.chunkData()
+		encoded := base64.StdEncoding.EncodeToString(data)
+		lines := []string{}
+		for len(encoded) > 76 {
+			lines, encoded = append(lines, encoded[:76]), encoded[76:]
+		}
+		lines = append(lines, encoded)
+		// ^D at the beginning of a line is the EOF of `base64 -d`
+		return b.write(strings.Join(lines, "\n") + "\n\x04")
+	case b.state == bootstrapWaitChunk && name == "chunk":
+		if value != "ok-"+strconv.Itoa(b.chunk) {
+			if b.retries++; b.retries > variable.BootstrapChunkRetries {
+				return fmt.Errorf("bootstrap: chunk %d is corrupted after %d retries", b.chunk, variable.BootstrapChunkRetries)
+			}
+			return b.sendChunk()
+		}
+		b.chunk++
+		b.retries = 0
+		return b.nextChunk()
+	case b.state == bootstrapWaitInstall && name == "install":
+		if value != "ok" {
+			return fmt.Errorf("bootstrap: can not install the binary on the remote")
+		}
+		return b.exec()
+	}
+	return nil
+}
+
+// loadBinary - load the local binary of the remote `uname -s`/`uname -m`
+func (b *bootstrapper) loadBinary(uname string) error {
+	goos, goarch, err := parseUname(uname)
+	if err != nil {
+		return err
+	}
+	name := fmt.Sprintf("stdiotunnel-%s-%s", goos, goarch)
+	path := ""
+	if b.config.BootstrapDir != "" {
+		if _, err := os.Stat(filepath.Join(b.config.BootstrapDir, name)); err == nil {
+			path = filepath.Join(b.config.BootstrapDir, name)
+		}
+	}
+	if path == "" && goos == runtime.GOOS && goarch == runtime.GOARCH {
+		if path, err = os.Executable(); err != nil {
+			return err
+		}
+	}
+	if path == "" {
+		return fmt.Errorf("bootstrap: no binary for remote %s, put %s in the bootstrap dir %q", uname, name, b.config.BootstrapDir)
+	}
+	b.binary, err = ioutil.ReadFile(path)
+	return err
+}
+
+// parseUname - GOOS and GOARCH of `uname -s`/`uname -m`
+func parseUname(uname string) (goos string, goarch string, err error) {
+	i := strings.LastIndexByte(uname, '/')
+	if i < 0 {
+		return "", "", fmt.Errorf("bootstrap: invalid uname %q", uname)
+	}
+	goos = strings.ToLower(uname[:i])
+	switch machine := uname[i+1:]; machine {
+	case "x86_64", "amd64":
+		goarch = "amd64"
+	case "aarch64", "arm64":
+		goarch = "arm64"
+	case "i386", "i486", "i586", "i686":
+		goarch = "386"
+	default:
+		if strings.HasPrefix(machine, "armv") {
+			goarch = "arm"
+		} else {
+			goarch = machine
+		}
+	}
+	return goos, goarch, nil
+}
+
+func (b *bootstrapper) chunkData() []byte {
+	start := b.chunk * variable.BootstrapChunkSize
+	end := start + variable.BootstrapChunkSize
+	if end > len(b.binary) {
+		end = len(b.binary)
+	}
+	return b.binary[start:end]
+}
+
+// nextChunk - upload the next chunk, or install after the last one
+func (b *bootstrapper) nextChunk() error {
+	if b.chunk*variable.BootstrapChunkSize >= len(b.binary) {
+		b.state = bootstrapWaitInstall
+		return b.send(fmt.Sprintf(`rm -f "$f.part"; chmod 700 "$f.tmp" && mv "$f.tmp" "$f" && %s || %s`, bootstrapEcho("install", "ok"), bootstrapEcho("install", "error")))
+	}
+	return b.sendChunk()
+}
+
+// sendChunk - ask the shell to receive the current chunk
+func (b *bootstrapper) sendChunk() error {
+	data := b.chunkData()
+	b.state = bootstrapWaitRecv
+	n := strconv.Itoa(b.chunk)
+	return b.send(fmt.Sprintf(`stty -echo; %s; base64 -d > "$f.part"; stty echo; [ "$(cksum < "$f.part")" = "%d %d" ] && cat "$f.part" >> "$f.tmp" && %s || %s`,
+		bootstrapEcho("recv", n), posixCksum(data), len(data), bootstrapEcho("chunk", "ok-"+n), bootstrapEcho("chunk", "bad-"+n)))
+}
+
+// exec - replace the shell by the server, every argument of BootstrapServerArgs is quoted
+func (b *bootstrapper) exec() error {
+	b.state = bootstrapDone
+	command := `stty raw -echo; exec "$f" server`
+	for _, arg := range strings.Fields(b.config.BootstrapServerArgs) {
+		command += " " + shellQuote(arg)
+	}
+	return b.send(command)
+}
+
+// shellQuote - quote `s` as one word of a POSIX shell
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// posixCksum - CRC of POSIX `cksum`
+func posixCksum(data []byte) uint32 {
+	var crc uint32
+	update := func(b byte) {
+		crc ^= uint32(b) << 24
+		for i := 0; i < 8; i++ {
+			if crc&0x80000000 != 0 {
+				crc = crc<<1 ^ 0x04C11DB7
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	for _, b := range data {
+		update(b)
+	}
+	// the length is appended, least significant byte first
+	for n := len(data); n > 0; n >>= 8 {
+		update(byte(n))
+	}
+	return ^crc
+}
@@ -0,0 +1,162 @@
+package stdiotunnel
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/rectcircle/stdiotunnel/internal/variable"
+)
+
+func Test_posixCksum(t *testing.T) {
+	// from `printf abc | cksum` and `printf '' | cksum`
+	if got := posixCksum([]byte("abc")); got != 1219131554 {
+		t.Errorf("posixCksum(abc) = %d, want 1219131554", got)
+	}
+	if got := posixCksum(nil); got != 4294967295 {
+		t.Errorf("posixCksum() = %d, want 4294967295", got)
+	}
+}
+
+func Test_parseUname(t *testing.T) {
+	tests := []struct {
+		uname, goos, goarch string
+	}{
+		{"Linux/x86_64", "linux", "amd64"},
+		{"Darwin/arm64", "darwin", "arm64"},
+		{"Linux/aarch64", "linux", "arm64"},
+		{"Linux/armv7l", "linux", "arm"},
+		{"FreeBSD/i686", "freebsd", "386"},
+	}
+	for _, tt := range tests {
+		goos, goarch, err := parseUname(tt.uname)
+		if err != nil || goos != tt.goos || goarch != tt.goarch {
+			t.Errorf("parseUname(%q) = %s, %s, %v, want %s, %s", tt.uname, goos, goarch, err, tt.goos, tt.goarch)
+		}
+	}
+	if _, _, err := parseUname("Linux"); err == nil {
+		t.Errorf("parseUname() want error for invalid uname")
+	}
+}
+
+// fakeShell - a remote POSIX shell for the bootstrap: it replies the markers of the commands,
+// receives base64 chunks and corrupts the first one, `commands` are the lines it has read
+func fakeShell(t *testing.T, cached bool) (output io.Reader, input io.Writer, commands chan string, received *bytes.Buffer) {
+	outputReader, outputWriter := io.Pipe()
+	inputReader, inputWriter := io.Pipe()
+	commands = make(chan string, 16)
+	received = &bytes.Buffer{}
+	reply := func(name, value string) { fmt.Fprintf(outputWriter, "::stdiotunnel-%s:%s::\r\n$ ", name, value) }
+	chunkMarker := regexp.MustCompile(`::stdio""tunnel-chunk:ok-([0-9]+)::`)
+	go func() {
+		defer close(commands)
+		in := bufio.NewReader(inputReader)
+		io.WriteString(outputWriter, "Last login: today\r\n$ ")
+		corrupted := false
+		for {
+			command, err := in.ReadString('\n')
+			if err != nil {
+				return
+			}
+			commands <- command
+			switch {
+			case strings.Contains(command, "uname"):
+				reply("probe", "Linux/x86_64")
+			case strings.Contains(command, "[ -x"):
+				reply("cache", map[bool]string{true: "hit", false: "miss"}[cached])
+			case strings.Contains(command, "base64 -d"):
+				reply("recv", "")
+				payload, err := in.ReadString('\x04')
+				if err != nil {
+					return
+				}
+				chunk, err := base64.StdEncoding.DecodeString(strings.ReplaceAll(strings.TrimSuffix(payload, "\x04"), "\n", ""))
+				if err != nil {
+					t.Errorf("chunk is not base64: %v", err)
+				}
+				n := chunkMarker.FindStringSubmatch(command)[1]
+				// `cksum` fails once
+				if !corrupted {
+					corrupted = true
+					reply("chunk", "bad-"+n)
+					continue
+				}
+				received.Write(chunk)
+				reply("chunk", "ok-"+n)
+			case strings.Contains(command, "mv "):
+				reply("install", "ok")
+			case strings.Contains(command, "exec "):
+				return
+			}
+		}
+	}()
+	return outputReader, inputWriter, commands, received
+}
+
+func TestBootstrapperFeed(t *testing.T) {
+	chunkSize := variable.BootstrapChunkSize
+	variable.BootstrapChunkSize = 64
+	defer func() { variable.BootstrapChunkSize = chunkSize }()
+	dir, err := ioutil.TempDir("", "stdiotunnel-bootstrap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	binary := bytes.Repeat([]byte("\x7fELF binary "), 10)
+	if err := ioutil.WriteFile(filepath.Join(dir, "stdiotunnel-linux-amd64"), binary, 0755); err != nil {
+		t.Fatal(err)
+	}
+	config := ClientConfig{BootstrapDir: dir, BootstrapServerArgs: "-p 22 -log /tmp/a;b -permit 'x'"}
+
+	for _, cached := range []bool{false, true} {
+		t.Run(fmt.Sprintf("cached %v", cached), func(t *testing.T) {
+			output, input, commands, received := fakeShell(t, cached)
+			b, err := newBootstrapper(config, input)
+			if err != nil {
+				t.Fatal(err)
+			}
+			buffer := make([]byte, 4096)
+			for b.state != bootstrapDone {
+				n, err := output.Read(buffer)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := b.feed(buffer[:n]); err != nil {
+					t.Fatal(err)
+				}
+			}
+			last := ""
+			for command := range commands {
+				last = command
+			}
+			if want := `stty raw -echo; exec "$f" server '-p' '22' '-log' '/tmp/a;b' '-permit' ''\''x'\'''` + "\n"; last != want {
+				t.Errorf("exec command = %q, want %q", last, want)
+			}
+			if want := map[bool][]byte{false: binary, true: nil}[cached]; !bytes.Equal(received.Bytes(), want) {
+				t.Errorf("received %q, want %q", received.Bytes(), want)
+			}
+		})
+	}
+
+	t.Run("write error", func(t *testing.T) {
+		reader, writer := io.Pipe()
+		reader.CloseWithError(io.ErrClosedPipe)
+		b, _ := newBootstrapper(config, writer)
+		if err := b.feed([]byte("$ ")); err != nil {
+			t.Fatal(err)
+		}
+		// the failed write of the probe is returned by a later feed
+		<-b.written
+		if err := b.feed([]byte("output")); err == nil || !strings.Contains(err.Error(), "write to the shell") {
+			t.Errorf("feed() = %v, want write error", err)
+		}
+	})
+}
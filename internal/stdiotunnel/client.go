@@ -3,6 +3,7 @@ package stdiotunnel
 import (
 	"bytes"
 	"errors"
+	"fmt"
 	"io"
 	"log"
 	"net"
@@ -10,70 +11,385 @@ import (
 	"os/exec"
 	"os/signal"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
+	"time"
 
 	"github.com/creack/pty"
+	"github.com/rectcircle/stdiotunnel/internal/stdiotunnel/control"
+	"github.com/rectcircle/stdiotunnel/internal/stdiotunnel/protocol"
 	"github.com/rectcircle/stdiotunnel/internal/variable"
 	"github.com/rectcircle/stdiotunnel/tools"
 	"golang.org/x/term"
 )
 
-// StartClient - run client
-func StartClient(host string, port uint16, interactive bool, command string) {
-	// Split command
-	commandAndArgs := strings.Fields(command)
-	if len(commandAndArgs) == 0 {
-		tools.LogAndExitIfErr(errors.New("The command is not allowed to be an empty string"))
+// ClientConfig - config of client
+type ClientConfig struct {
+	// Forwards - listeners of the client and the server, the listener at index i is in rate limit group i+1
+	Forwards []Forward
+	// Interactive - whether start command with pty to initialize
+	Interactive bool
+	// Command - command to be launched, its stdio is the link to server
+	Command string
+	// Priority - scheduling weight of the virtual connections accepted by this listener, 0 means default
+	Priority uint8
+	// Limits - rate limits
+	Limits Limits
+	// ControlSocket - unix socket path of control interface, empty means disable
+	ControlSocket string
+	// OpenTimeout - max wait for server to open a virtual connection, 0 means no timeout
+	OpenTimeout time.Duration
+	// IdleTimeout - close virtual connections of this listener without data for this duration, 0 means never
+	IdleTimeout time.Duration
+	// KeepAlive - TCP keepalive period of connections of this listener on both sides, 0 means system default
+	KeepAlive time.Duration
+	// Bootstrap - upload the server binary through the remote shell of Interactive command and execute it
+	Bootstrap bool
+	// BootstrapDir - local dir of server binaries named `stdiotunnel-GOOS-GOARCH`, this binary is used for the same platform
+	BootstrapDir string
+	// BootstrapPrompt - regexp of the remote shell prompt, empty means variable.BootstrapPrompt
+	BootstrapPrompt string
+	// BootstrapServerArgs - space separated arguments of the bootstrapped server, e.g. `-p 22`, each one is quoted for the remote shell
+	BootstrapServerArgs string
+	// InitTimeout - the server must be ready within it after the command started, 0 means no timeout,
+	// InitTimeoutDefault means variable.InitTimeout without a terminal and no timeout at a terminal, see initTimeoutOf
+	InitTimeout time.Duration
+	// Auth - scripted responses to prompts of the init stage, e.g. password of ssh
+	Auth []AuthRule
+	// AuthTimeout - with Auth, the next prompt or the ready trigger must appear within it, 0 means no timeout
+	AuthTimeout time.Duration
+	// Encoding - link encoding asked to the server, EncodingBase64 or EncodingEscape for links which are not 8-bit clean, empty means EncodingRaw
+	Encoding string
+	// Checksum - ask the server to checksum every segment, so that a lossy link resyncs instead of corrupting data, see protocol.BridgeOptions
+	Checksum bool
+}
+
+// InitTimeoutDefault - ClientConfig.InitTimeout not set by a flag or the profile
+const InitTimeoutDefault time.Duration = -1
+
+// initTimeoutOf - the init timeout of `config`, by default the user at the terminal may be slow to log in,
+// and ends a stuck init with ^C, so only a detached init stage times out
+func initTimeoutOf(config ClientConfig, attached bool) time.Duration {
+	if config.InitTimeout != InitTimeoutDefault {
+		return config.InitTimeout
+	}
+	if attached {
+		return 0
+	}
+	return variable.InitTimeout
+}
+
+// Limits - rate limits in bytes per second, 0 means unlimited
+// up is from client to server, down is from server to client, listener limits apply to every listener
+type Limits struct {
+	GlobalUp, GlobalDown     uint64
+	ListenerUp, ListenerDown uint64
+	TunnelUp, TunnelDown     uint64
+}
+
+// listenerGroup - the rate limit group of the listener at index `i` of ClientConfig.Forwards
+func listenerGroup(i int) uint16 {
+	return uint16(i + 1)
+}
+
+// StartClient - run client, exit on error
+func StartClient(config ClientConfig) {
+	// without a terminal (e.g. cron), the init stage relies on Auth rules
+	attached := term.IsTerminal(int(os.Stdin.Fd()))
+	session, err := StartSession(config, log.New(os.Stderr, "", log.LstdFlags), attached)
+	if err != nil {
+		exitWithInitError(err)
 	}
+	// Start control interface
+	if config.ControlSocket != "" {
+		controlServer := control.NewServer()
+		controlServer.Handle("limit", limitUsage, func(args []string) (string, error) {
+			return "", session.handleLimit(args)
+		})
+		go func() {
+			tools.LogAndExitIfErr(controlServer.ListenAndServe(config.ControlSocket))
+		}()
+		defer controlServer.Close()
+	}
+	tools.LogAndExitIfErr(session.Wait())
+}
+
+// exitWithInitError - log the error and the output tail of an init stage failure, exit with the code of its kind
+func exitWithInitError(err error) {
+	var initError *InitError
+	if !errors.As(err, &initError) {
+		tools.LogAndExitIfErr(err)
+	}
+	log.Printf("error: %s\n", err.Error())
+	if len(initError.Tail) > 0 {
+		log.Printf("last output of the command:\n%s\n", initError.Tail)
+	}
+	os.Exit(initError.Kind.ExitCode())
+}
 
-	cmd := exec.Command(commandAndArgs[0], commandAndArgs[1:]...)
-	var (
-		writer io.WriteCloser = nil
-		reader io.ReadCloser  = nil
-	)
+// Session - a running client: the command, the Bridge on its stdio and the listeners of forwards
+type Session struct {
+	config    ClientConfig
+	logger    *log.Logger
+	cmd       *exec.Cmd
+	link      io.ReadWriteCloser
+	bridge    *protocol.Bridge
+	limits    Limits
+	listeners []net.Listener
+	done      chan struct{}
+	closeOnce sync.Once
+	err       error
+}
 
-	if interactive {
+// StartSession - start the command, wait the server ready and listen all forwards
+// if `attached`, the init stage is relayed to the terminal of this process, otherwise the init output goes to `logger`
+func StartSession(config ClientConfig, logger *log.Logger, attached bool) (*Session, error) {
+	// Split command
+	commandAndArgs := strings.Fields(config.Command)
+	if len(commandAndArgs) == 0 {
+		return nil, &InitError{Kind: InitSpawnFailed, Err: errors.New("The command is not allowed to be an empty string")}
+	}
+	s := &Session{
+		config: config,
+		logger: logger,
+		cmd:    exec.Command(commandAndArgs[0], commandAndArgs[1:]...),
+		limits: config.Limits,
+		done:   make(chan struct{}),
+	}
+	if err := CheckEncoding(config.Encoding); err != nil {
+		return nil, &InitError{Kind: InitSpawnFailed, Err: err}
+	}
+	stage := &initStage{output: os.Stdout, auth: config.Auth, authTimeout: config.AuthTimeout, initTimeout: initTimeoutOf(config, attached), encoding: config.Encoding, checksum: config.Checksum}
+	if !attached {
+		stage.output = logger.Writer()
+	}
+	if config.Bootstrap {
+		if !config.Interactive {
+			return nil, &InitError{Kind: InitSpawnFailed, Err: errors.New("bootstrap requires interactive mode")}
+		}
+		b, err := newBootstrapper(config, nil)
+		if err != nil {
+			return nil, &InitError{Kind: InitSpawnFailed, Err: err}
+		}
+		stage.bootstrap = b
+	}
+	if config.Interactive {
 		// Enable interactive
-		f := startCommandWithPtyAndInit(cmd)
-		writer = f
-		reader = f
+		link, err := startCommandWithPtyAndInit(s.cmd, attached, stage)
+		if err != nil {
+			return nil, err
+		}
+		s.link = link
 	} else {
 		// Disable interactive
-		var err error = nil
-		writer, err = cmd.StdinPipe()
+		writer, err := s.cmd.StdinPipe()
+		if err != nil {
+			return nil, &InitError{Kind: InitSpawnFailed, Err: err}
+		}
+		reader, err := s.cmd.StdoutPipe()
 		if err != nil {
-			tools.LogAndExitIfErr(err)
+			return nil, &InitError{Kind: InitSpawnFailed, Err: err}
+		}
+		if err := s.cmd.Start(); err != nil {
+			return nil, &InitError{Kind: InitSpawnFailed, Err: err}
 		}
-		reader, err = cmd.StdoutPipe()
+		s.link = &stdioConn{reader, writer}
+		leftover, err := stage.wait(reader, writer, func() { s.cmd.Process.Kill() })
 		if err != nil {
-			tools.LogAndExitIfErr(err)
+			return nil, abortInit(s.cmd, s.link, err)
+		}
+		s.link = withLeftover(s.link, leftover)
+	}
+	// Start Bridge on the command stdio
+	s.link = encodeLink(s.link, config.Encoding)
+	s.bridge = protocol.NewBridgeWithOptions(s.link, true, protocol.BridgeOptions{
+		Checksum:     config.Checksum,
+		OnCorruption: func(err error) { logger.Printf("%v\n", err) },
+	})
+	s.bridge.OpenTimeout = config.OpenTimeout
+	s.bridge.SetRateLimit(protocol.LimitScopeGlobal, 0, 0, protocol.DirectionUp, s.limits.GlobalUp)
+	s.bridge.SetRateLimit(protocol.LimitScopeGlobal, 0, 0, protocol.DirectionDown, s.limits.GlobalDown)
+	for i := range config.Forwards {
+		s.bridge.SetRateLimit(protocol.LimitScopeGroup, 0, listenerGroup(i), protocol.DirectionUp, s.limits.ListenerUp)
+		s.bridge.SetRateLimit(protocol.LimitScopeGroup, 0, listenerGroup(i), protocol.DirectionDown, s.limits.ListenerDown)
+	}
+	go func() {
+		s.bridge.ClientServe()
+		s.stop(errors.New("line break: the command stdio has closed"))
+	}()
+	// Start Tunnel Server, listen all local forwards before accepting
+	listeners := make([]net.Listener, len(config.Forwards))
+	for i, forward := range config.Forwards {
+		if forward.Type == ForwardRemote {
+			continue
 		}
-		err = cmd.Start()
+		listener, err := net.Listen("tcp", tools.ToAddressString(forward.Host, forward.Port))
 		if err != nil {
-			tools.LogAndExitIfErr(err)
+			s.stop(err)
+			return nil, err
 		}
+		listeners[i] = listener
+		s.listeners = append(s.listeners, listener)
+		logger.Printf("Start a Stdio Tunnel Client Success! on %s\n", forward)
 	}
-	log.Println(reader, writer)
-	// Start Tunnel Server
-	addr := tools.ToAddressString(host, port)
-	// Listen to tcp addr
-	listener, err := net.Listen("tcp", addr)
-	tools.LogAndExitIfErr(err)
+	for i, forward := range config.Forwards {
+		options := protocol.TunnelOptions{
+			Priority:    config.Priority,
+			Group:       listenerGroup(i),
+			IdleTimeout: config.IdleTimeout,
+			KeepAlive:   config.KeepAlive,
+			Target:      forward.Target,
+		}
+		if forward.Type == ForwardRemote {
+			// the server listens, its connections are opened by the bridge, like ssh -R a failure is only logged
+			forward := forward
+			s.bridge.RemoteListen(forward.Port, forward.Target, options, s.track, func(err error) {
+				logger.Printf("Remote forward %s: %v\n", forward, err)
+			})
+			logger.Printf("Ask the server to listen for %s\n", forward)
+			continue
+		}
+		go s.accept(listeners[i], forward, options)
+	}
+	return s, nil
+}
+
+func (s *Session) accept(listener net.Listener, forward Forward, options protocol.TunnelOptions) {
 	for {
 		// Wait accept connection
 		conn, err := listener.Accept()
-		tools.LogAndExitIfErr(err)
-		log.Printf("Client %s connection success\n", conn.RemoteAddr().String())
+		if err != nil {
+			s.stop(err)
+			return
+		}
+		s.logger.Printf("Client %s connection success\n", conn.RemoteAddr().String())
 		// Serve a client connection
-		// go serve(ctx, conn)
+		go s.serve(conn, forward, options)
+	}
+}
+
+func (s *Session) serve(conn net.Conn, forward Forward, options protocol.TunnelOptions) {
+	var onOpen func(err error)
+	if forward.Type == ForwardDynamic {
+		target, err := socksHandshake(conn)
+		if err != nil {
+			conn.Close()
+			s.logger.Printf("Client %s socks handshake failed: %v\n", conn.RemoteAddr().String(), err)
+			return
+		}
+		options.Target = target
+		// the SOCKS client sees why the server can't open the target
+		onOpen = func(err error) { socksReply(conn, err) }
 	}
+	VID, Closed := s.bridge.ClientOpenTunnel(conn, options, onOpen)
+	s.track(conn, VID, Closed)
 }
 
-func startCommandWithPtyAndInit(cmd *exec.Cmd) (ptyFile *os.File) {
-	var err error
-	ptyFile, err = pty.Start(cmd)
+// track - limit a new tunnel and log its close
+func (s *Session) track(conn net.Conn, VID uint16, Closed <-chan error) {
+	// MethodSetLimit follow MethodReqConn of the same VID, so server has registered the tunnel
+	// a new tunnel is unlimited, so nothing is sent for rate 0
+	if rate := atomic.LoadUint64(&s.limits.TunnelUp); rate != 0 {
+		s.bridge.SetRateLimit(protocol.LimitScopeTunnel, VID, 0, protocol.DirectionUp, rate)
+	}
+	if rate := atomic.LoadUint64(&s.limits.TunnelDown); rate != 0 {
+		s.bridge.SetRateLimit(protocol.LimitScopeTunnel, VID, 0, protocol.DirectionDown, rate)
+	}
+	err := <-Closed
+	s.logger.Printf("Client %s connection close, VID = %d, reason: %v\n", conn.RemoteAddr().String(), VID, err)
+}
+
+// Pid - process id of the command
+func (s *Session) Pid() int {
+	return s.cmd.Process.Pid
+}
+
+// Done - closed when the session has stopped
+func (s *Session) Done() <-chan struct{} {
+	return s.done
+}
+
+// Wait - wait the session stop and return the reason
+func (s *Session) Wait() error {
+	<-s.done
+	return s.err
+}
+
+// Close - stop the session, close listeners and virtual connections and kill the command
+func (s *Session) Close() {
+	s.stop(errors.New("session closed"))
+}
+
+func (s *Session) stop(err error) {
+	s.closeOnce.Do(func() {
+		s.err = err
+		for _, listener := range s.listeners {
+			listener.Close()
+		}
+		s.kill()
+		s.bridge.CloseTunnels()
+		close(s.done)
+	})
+}
+
+// kill - close the stdio link and kill the command
+func (s *Session) kill() {
+	s.link.Close()
+	s.cmd.Process.Kill()
+	s.cmd.Wait()
+}
+
+// stdioConn - combine stdout and stdin of command to a io.ReadWriteCloser
+type stdioConn struct {
+	io.ReadCloser
+	writer io.WriteCloser
+}
+
+func (c *stdioConn) Write(p []byte) (int, error) {
+	return c.writer.Write(p)
+}
+
+func (c *stdioConn) Close() error {
+	err := c.writer.Close()
+	if err2 := c.ReadCloser.Close(); err == nil {
+		err = err2
+	}
+	return err
+}
+
+// leftoverConn - a link whose first bytes have been read by the init stage after the ready token
+type leftoverConn struct {
+	io.ReadWriteCloser
+	reader io.Reader
+}
+
+func (c *leftoverConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+// withLeftover - hand the bytes read after the ready token back to the segment decoder of `link`
+func withLeftover(link io.ReadWriteCloser, leftover []byte) io.ReadWriteCloser {
+	if len(leftover) == 0 {
+		return link
+	}
+	return &leftoverConn{link, io.MultiReader(bytes.NewReader(leftover), link)}
+}
+
+// startCommandWithPtyAndInit - start `cmd` with pty and wait the server ready
+// if `attached`, the terminal of this process is in raw mode and relayed to the pty during the init stage
+func startCommandWithPtyAndInit(cmd *exec.Cmd, attached bool, stage *initStage) (io.ReadWriteCloser, error) {
+	ptyFile, err := pty.Start(cmd)
 	if err != nil {
-		tools.LogAndExitIfErr(err)
+		return nil, &InitError{Kind: InitSpawnFailed, Err: err}
+	}
+	abort := func() { cmd.Process.Kill() }
+	if !attached {
+		leftover, err := stage.wait(ptyFile, ptyFile, abort)
+		if err != nil {
+			return nil, abortInit(cmd, ptyFile, err)
+		}
+		return withLeftover(ptyFile, leftover), nil
 	}
 
 	// Handle pty size.
@@ -91,17 +407,17 @@ func startCommandWithPtyAndInit(cmd *exec.Cmd) (ptyFile *os.File) {
 	// Set stdin in raw mode.
 	oldState, err := term.MakeRaw(int(os.Stdin.Fd()))
 	if err != nil {
-		panic(err)
-	}
-
-	closeAndRestore := func() {
 		signal.Stop(termWinChangeChannel)
 		close(termWinChangeChannel)
-		term.Restore(int(os.Stdin.Fd()), oldState)
+		return nil, abortInit(cmd, ptyFile, &InitError{Kind: InitSpawnFailed, Err: err})
 	}
 
 	// Close and restore
-	defer closeAndRestore()
+	defer func() {
+		signal.Stop(termWinChangeChannel)
+		close(termWinChangeChannel)
+		term.Restore(int(os.Stdin.Fd()), oldState)
+	}()
 
 	initDone := make(chan bool)
 
@@ -114,8 +430,9 @@ func startCommandWithPtyAndInit(cmd *exec.Cmd) (ptyFile *os.File) {
 				case <-initDone:
 					return
 				default:
-					_, err := ptyFile.Write(buffer)
-					tools.LogAndExitIfErr(err)
+					if _, err := ptyFile.Write(buffer); err != nil {
+						return
+					}
 				}
 			case <-initDone:
 				return
@@ -125,34 +442,23 @@ func startCommandWithPtyAndInit(cmd *exec.Cmd) (ptyFile *os.File) {
 
 	// Handle stdout
 	// check trigger and notice stdin handle return
-	var (
-		buffer           = make([]byte, 4096, 4096)
-		targetTrigger    = []byte(variable.StdoutReadyTrigger)
-		needCheckTrigger = make([]byte, 0, 4096)
-	)
-	for {
-		n, err := ptyFile.Read(buffer)
-		if err != nil {
-			closeAndRestore()
-			if err.Error() == "EOF" {
-				tools.LogAndExitIfErr(errors.New("EOF: command not allow exit on init stage"))
-			}
-			tools.LogAndExitIfErr(err)
-		}
-		for _, b := range buffer[:n] {
-			if len(needCheckTrigger) > 0 {
-				l := len(targetTrigger) - 1
-				if l > len(needCheckTrigger)-1 {
-					l = len(needCheckTrigger)
-				}
-				needCheckTrigger = needCheckTrigger[1:l:cap(needCheckTrigger)]
-			}
-			needCheckTrigger = append(needCheckTrigger, b)
-			if bytes.Equal(needCheckTrigger, targetTrigger) {
-				close(initDone)
-				return
-			}
-		}
-		os.Stdout.Write(buffer[:n])
+	leftover, err := stage.wait(ptyFile, ptyFile, abort)
+	close(initDone)
+	if err != nil {
+		return nil, abortInit(cmd, ptyFile, err)
+	}
+	return withLeftover(ptyFile, leftover), nil
+}
+
+// abortInit - close the stdio link and kill the command after the init stage failed,
+// the exit status of the command is added to an InitEarlyExit error
+func abortInit(cmd *exec.Cmd, link io.Closer, err error) error {
+	link.Close()
+	cmd.Process.Kill()
+	cmd.Wait()
+	var initError *InitError
+	if errors.As(err, &initError) && initError.Kind == InitEarlyExit && cmd.ProcessState != nil {
+		initError.Err = fmt.Errorf("command exited (%s) before ready: %w", cmd.ProcessState, initError.Err)
 	}
+	return err
 }
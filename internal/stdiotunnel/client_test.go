@@ -0,0 +1,29 @@
+package stdiotunnel
+
+import (
+	"testing"
+	"time"
+
+	"github.com/rectcircle/stdiotunnel/internal/variable"
+)
+
+func Test_initTimeoutOf(t *testing.T) {
+	tests := []struct {
+		initTimeout time.Duration
+		attached    bool
+		want        time.Duration
+	}{
+		{InitTimeoutDefault, false, variable.InitTimeout},
+		// the user at the terminal ends a stuck init with ^C
+		{InitTimeoutDefault, true, 0},
+		// an explicit value applies at a terminal too
+		{30 * time.Second, true, 30 * time.Second},
+		{30 * time.Second, false, 30 * time.Second},
+		{0, false, 0},
+	}
+	for _, tt := range tests {
+		if got := initTimeoutOf(ClientConfig{InitTimeout: tt.initTimeout}, tt.attached); got != tt.want {
+			t.Errorf("initTimeoutOf(%v, attached %v) = %v, want %v", tt.initTimeout, tt.attached, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+/*
+Package config - MIT License Copyright (c) 2020, Rectcircle. All rights reserved.
+
+Config file of named profiles, default path is `~/.stdiotunnel/config`, the syntax is like ssh_config:
+
+	# comment
+	OpenTimeout 5s
+
+	Profile prod-db
+	    Command ssh prod stdiotunnel server -permit db.internal:5432
+	    Interactive no
+	    LocalForward 15432 db.internal:5432
+
+Every line is `Key value` or `Key=value`, keys are case insensitive.
+Options before the first `Profile` line are defaults of all profiles, the options of a profile are applied after them.
+*/
+package config
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Option - a `Key value` line, Key is lower case
+type Option struct {
+	Key   string
+	Value string
+	// Source - `path:line` for error messages
+	Source string
+}
+
+// Errorf - an error of this option with its source
+func (o Option) Errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("%s: %s: %s", o.Source, o.Key, fmt.Sprintf(format, args...))
+}
+
+// File - a parsed config file
+type File struct {
+	defaults []Option
+	profiles map[string][]Option
+}
+
+// Load - parse the config file `path`
+func Load(path string) (*File, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return Parse(f, path)
+}
+
+// Parse - parse a config file from `reader`, `name` is used in error messages
+func Parse(reader io.Reader, name string) (*File, error) {
+	file := &File{profiles: map[string][]Option{}}
+	// current - profile of following lines, empty means defaults
+	current := ""
+	scanner := bufio.NewScanner(reader)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		key, value := text, ""
+		if i := strings.IndexAny(text, " \t="); i >= 0 {
+			key, value = text[:i], strings.TrimSpace(text[i:])
+			value = strings.TrimSpace(strings.TrimPrefix(value, "="))
+		}
+		option := Option{Key: strings.ToLower(key), Value: value, Source: fmt.Sprintf("%s:%d", name, line)}
+		if option.Key == "profile" {
+			if value == "" || strings.ContainsAny(value, " \t") {
+				return nil, option.Errorf("want one profile name, got %q", value)
+			}
+			if _, ok := file.profiles[value]; ok {
+				return nil, option.Errorf("duplicate profile %q", value)
+			}
+			file.profiles[value] = []Option{}
+			current = value
+			continue
+		}
+		if value == "" {
+			return nil, option.Errorf("missing value")
+		}
+		if current == "" {
+			file.defaults = append(file.defaults, option)
+		} else {
+			file.profiles[current] = append(file.profiles[current], option)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+// Names - sorted profile names
+func (file *File) Names() []string {
+	names := make([]string, 0, len(file.profiles))
+	for name := range file.profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Profile - options of profile `name`, the defaults come first
+func (file *File) Profile(name string) ([]Option, error) {
+	options, ok := file.profiles[name]
+	if !ok {
+		return nil, fmt.Errorf("profile %q not found", name)
+	}
+	return append(append([]Option{}, file.defaults...), options...), nil
+}
@@ -0,0 +1,70 @@
+package config
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testConfig = `# defaults
+OpenTimeout 5s
+
+Profile prod-db
+    Command ssh prod stdiotunnel server
+    LocalForward=15432 db.internal:5432
+  localforward 16379 cache:6379
+
+Profile dev
+    Interactive no
+    OpenTimeout 1s
+`
+
+func TestParse(t *testing.T) {
+	file, err := Parse(strings.NewReader(testConfig), "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := file.Names(), []string{"dev", "prod-db"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Names() = %v, want %v", got, want)
+	}
+	options, err := file.Profile("prod-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Option{
+		{Key: "opentimeout", Value: "5s", Source: "config:2"},
+		{Key: "command", Value: "ssh prod stdiotunnel server", Source: "config:5"},
+		{Key: "localforward", Value: "15432 db.internal:5432", Source: "config:6"},
+		{Key: "localforward", Value: "16379 cache:6379", Source: "config:7"},
+	}
+	if !reflect.DeepEqual(options, want) {
+		t.Errorf("Profile() = %v, want %v", options, want)
+	}
+	options, _ = file.Profile("dev")
+	if len(options) != 3 || options[2].Value != "1s" {
+		t.Errorf("Profile() = %v, want defaults then profile options", options)
+	}
+	if _, err := file.Profile("nope"); err == nil {
+		t.Errorf("Profile() want error for unknown profile")
+	}
+}
+
+func TestParseError(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  string
+		wantErr string
+	}{
+		{name: "missing value", config: "Profile a\nCommand\n", wantErr: "config:2: command: missing value"},
+		{name: "duplicate profile", config: "Profile a\nProfile a\n", wantErr: "config:2: profile: duplicate profile \"a\""},
+		{name: "profile name", config: "Profile a b\n", wantErr: "config:1: profile: want one profile name, got \"a b\""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Parse(strings.NewReader(tt.config), "config")
+			if err == nil || err.Error() != tt.wantErr {
+				t.Errorf("Parse() error = %v, want %s", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,68 @@
+package stdiotunnel
+
+import (
+	"fmt"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/rectcircle/stdiotunnel/internal/stdiotunnel/protocol"
+	"github.com/rectcircle/stdiotunnel/tools"
+)
+
+const limitUsage = "limit global|listener [N]|tunnel [VID] up|down RATE - set rate limit in bytes per second (e.g. 512K, 0 is unlimited), `listener` without N sets all listeners, `tunnel` without VID sets the default of new tunnels"
+
+// handleLimit - the `limit` control command, `limits` of new tunnels are updated
+func (s *Session) handleLimit(args []string) error {
+	bridge, limits, listeners := s.bridge, &s.limits, len(s.listeners)
+	var (
+		scope protocol.LimitScope
+		ID    uint64
+		err   error
+	)
+	if len(args) == 4 && (args[0] == "tunnel" || args[0] == "listener") {
+		ID, err = strconv.ParseUint(args[1], 10, 16)
+		if err != nil || (args[0] == "listener" && (ID == 0 || ID > uint64(listeners))) {
+			return fmt.Errorf("invalid %s %q", tools.If(args[0] == "tunnel", "VID", "listener number"), args[1])
+		}
+		args = append(args[:1], args[2:]...)
+	} else if len(args) != 3 {
+		return fmt.Errorf("usage: %s", limitUsage)
+	}
+	rate, err := tools.ParseByteSize(args[2])
+	if err != nil {
+		return err
+	}
+	var direction protocol.Direction
+	switch args[1] {
+	case "up":
+		direction = protocol.DirectionUp
+	case "down":
+		direction = protocol.DirectionDown
+	default:
+		return fmt.Errorf("unknown direction %q", args[1])
+	}
+	switch args[0] {
+	case "global":
+		scope = protocol.LimitScopeGlobal
+	case "listener":
+		if ID != 0 {
+			return bridge.SetRateLimit(protocol.LimitScopeGroup, 0, listenerGroup(int(ID-1)), direction, rate)
+		}
+		for i := 0; i < listeners; i++ {
+			if err := bridge.SetRateLimit(protocol.LimitScopeGroup, 0, listenerGroup(i), direction, rate); err != nil {
+				return err
+			}
+		}
+		return nil
+	case "tunnel":
+		if ID == 0 {
+			// default of new tunnels
+			atomic.StoreUint64(tools.If(direction == protocol.DirectionUp, &limits.TunnelUp, &limits.TunnelDown).(*uint64), rate)
+			return nil
+		}
+		scope = protocol.LimitScopeTunnel
+	default:
+		return fmt.Errorf("unknown scope %q", args[0])
+	}
+	return bridge.SetRateLimit(scope, uint16(ID), 0, direction, rate)
+}
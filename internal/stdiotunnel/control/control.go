@@ -0,0 +1,169 @@
+/*
+Package control - MIT License Copyright (c) 2020, Rectcircle. All rights reserved.
+
+Runtime control interface of a running stdiotunnel, served on a unix socket.
+
+A request is one line of whitespace separated words, the first word is the command.
+The response is `OK` or `ERR <message>` on the first line, followed by the command output.
+*/
+package control
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Handler - handle the arguments of a command and return the output
+type Handler func(args []string) (string, error)
+
+type command struct {
+	usage   string
+	handler Handler
+}
+
+// Server - serve commands on a unix socket
+type Server struct {
+	mutex    sync.RWMutex
+	commands map[string]command
+	listener net.Listener
+	closed   bool
+}
+
+// NewServer - new a Server with a built-in `help` command
+func NewServer() *Server {
+	s := &Server{commands: map[string]command{}}
+	s.Handle("help", "help - list commands", func(args []string) (string, error) {
+		s.mutex.RLock()
+		defer s.mutex.RUnlock()
+		usages := []string{}
+		for _, c := range s.commands {
+			usages = append(usages, c.usage)
+		}
+		sort.Strings(usages)
+		return strings.Join(usages, "\n"), nil
+	})
+	return s
+}
+
+// Handle - register a command, `usage` is shown by `help`
+func (s *Server) Handle(name string, usage string, handler Handler) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.commands[name] = command{usage, handler}
+}
+
+// ListenAndServe - listen on unix socket `path` and serve until Close, then return nil
+// a stale socket file is removed, a socket in use is an error
+func (s *Server) ListenAndServe(path string) error {
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		return fmt.Errorf("control socket %s is in use", path)
+	}
+	os.Remove(path)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return err
+	}
+	// only the owner may control the tunnel
+	if err := os.Chmod(path, 0600); err != nil {
+		listener.Close()
+		return err
+	}
+	s.mutex.Lock()
+	if s.closed {
+		s.mutex.Unlock()
+		return listener.Close()
+	}
+	s.listener = listener
+	s.mutex.Unlock()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			s.mutex.RLock()
+			defer s.mutex.RUnlock()
+			if s.closed {
+				return nil
+			}
+			return err
+		}
+		go s.serve(conn)
+	}
+}
+
+// Close - stop listening and remove the socket file
+func (s *Server) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.closed = true
+	if s.listener == nil {
+		return nil
+	}
+	return s.listener.Close()
+}
+
+func (s *Server) serve(conn net.Conn) {
+	defer conn.Close()
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil && line == "" {
+		return
+	}
+	output, err := s.Call(strings.Fields(line))
+	if err != nil {
+		fmt.Fprintf(conn, "ERR %s\n%s", err.Error(), output)
+		return
+	}
+	fmt.Fprintf(conn, "OK\n%s", output)
+}
+
+// Call - run a command in process
+func (s *Server) Call(args []string) (string, error) {
+	if len(args) == 0 {
+		return "", errors.New("empty command, try `help`")
+	}
+	s.mutex.RLock()
+	c, ok := s.commands[args[0]]
+	s.mutex.RUnlock()
+	if !ok {
+		return "", fmt.Errorf("unknown command %q, try `help`", args[0])
+	}
+	return c.handler(args[1:])
+}
+
+// Request - send a command to the control socket `path` and return the output
+func Request(path string, args []string) (string, error) {
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	if _, err := fmt.Fprintf(conn, "%s\n", strings.Join(args, " ")); err != nil {
+		return "", err
+	}
+	response, err := ioutil.ReadAll(conn)
+	if err != nil {
+		return "", err
+	}
+	status := string(response)
+	output := ""
+	if i := strings.IndexByte(status, '\n'); i >= 0 {
+		status, output = status[:i], status[i+1:]
+	}
+	if status == "OK" {
+		return output, nil
+	}
+	if strings.HasPrefix(status, "ERR ") {
+		return output, errors.New(strings.TrimPrefix(status, "ERR "))
+	}
+	return output, fmt.Errorf("invalid control response %q", status)
+}
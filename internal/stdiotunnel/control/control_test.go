@@ -0,0 +1,59 @@
+package control
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServer(t *testing.T) {
+	path := filepath.Join(os.TempDir(), "stdiotunnel-control-"+strconv.Itoa(os.Getpid())+".sock")
+	s := NewServer()
+	s.Handle("echo", "echo ARGS... - echo args", func(args []string) (string, error) {
+		return strings.Join(args, " "), nil
+	})
+	s.Handle("fail", "fail - always fail", func(args []string) (string, error) {
+		return "", errors.New("failed")
+	})
+	served := make(chan error, 1)
+	go func() { served <- s.ListenAndServe(path) }()
+	for i := 0; i < 100; i++ {
+		if _, err := os.Stat(path); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	tests := []struct {
+		name    string
+		args    []string
+		want    string
+		wantErr string
+	}{
+		{name: "command", args: []string{"echo", "a", "b"}, want: "a b"},
+		{name: "help", args: []string{"help"}, want: "echo ARGS... - echo args\nfail - always fail\nhelp - list commands"},
+		{name: "handler error", args: []string{"fail"}, wantErr: "failed"},
+		{name: "unknown command", args: []string{"nope"}, wantErr: "unknown command \"nope\", try `help`"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Request(path, tt.args)
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Errorf("Request() error = %v, wantErr %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Errorf("Request() = %q, %v, want %q", got, err, tt.want)
+			}
+		})
+	}
+	s.Close()
+	if err := <-served; err != nil {
+		t.Errorf("ListenAndServe() after Close = %v, want nil", err)
+	}
+}
@@ -0,0 +1,375 @@
+package stdiotunnel
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/signal"
+	"reflect"
+	"sort"
+	"sync"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/rectcircle/stdiotunnel/internal/stdiotunnel/config"
+	"github.com/rectcircle/stdiotunnel/internal/stdiotunnel/control"
+	"github.com/rectcircle/stdiotunnel/internal/variable"
+	"github.com/rectcircle/stdiotunnel/tools"
+)
+
+// DaemonConfig - config of daemon
+type DaemonConfig struct {
+	// ConfigFile - config file of profiles, reloaded on change or SIGHUP
+	ConfigFile string
+	// Profiles - names of profiles to run, empty means all profiles of ConfigFile
+	Profiles []string
+	// ControlSocket - unix socket path of control interface of all profiles, empty means disable
+	ControlSocket string
+	// LogFile - log file path, empty means stderr
+	LogFile string
+}
+
+// StartDaemon - run the sessions of profiles, restart failed ones and reload on config change, exit on SIGINT or SIGTERM
+func StartDaemon(config DaemonConfig) {
+	if config.LogFile != "" {
+		f, err := os.OpenFile(config.LogFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		tools.LogAndExitIfErr(err)
+		defer f.Close()
+		log.SetOutput(f)
+	}
+	d := &daemon{config: config, supervisors: map[string]*supervisor{}}
+	tools.LogAndExitIfErr(d.reload())
+	if config.ControlSocket != "" {
+		controlServer := d.controlServer()
+		go func() {
+			tools.LogAndExitIfErr(controlServer.ListenAndServe(config.ControlSocket))
+		}()
+		defer controlServer.Close()
+	}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
+	poll := time.NewTicker(variable.DaemonConfigPollInterval)
+	defer poll.Stop()
+	for {
+		select {
+		case sig := <-signals:
+			if sig != syscall.SIGHUP {
+				log.Printf("Stdio Tunnel Daemon exit: %v\n", sig)
+				d.stopAll()
+				return
+			}
+			log.Printf("Reload config on %v\n", sig)
+			if err := d.reload(); err != nil {
+				log.Printf("Reload config failed: %v\n", err)
+			}
+		case <-poll.C:
+			if !d.configChanged() {
+				continue
+			}
+			log.Printf("Reload config on change of %s\n", config.ConfigFile)
+			if err := d.reload(); err != nil {
+				log.Printf("Reload config failed: %v\n", err)
+			}
+		}
+	}
+}
+
+type daemon struct {
+	config      DaemonConfig
+	mutex       sync.Mutex
+	supervisors map[string]*supervisor
+	// configContent - content of config file at last reload
+	configContent []byte
+}
+
+// configChanged - whether the content of config file differs from the last reload
+func (d *daemon) configChanged() bool {
+	content, err := ioutil.ReadFile(d.config.ConfigFile)
+	if err != nil {
+		return false
+	}
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return !bytes.Equal(content, d.configContent)
+}
+
+// loadConfigs - client config of every selected profile
+func (d *daemon) loadConfigs() (map[string]ClientConfig, error) {
+	content, err := ioutil.ReadFile(d.config.ConfigFile)
+	if err != nil {
+		return nil, err
+	}
+	file, err := config.Parse(bytes.NewReader(content), d.config.ConfigFile)
+	if err != nil {
+		return nil, err
+	}
+	d.mutex.Lock()
+	d.configContent = content
+	d.mutex.Unlock()
+	names := d.config.Profiles
+	if len(names) == 0 {
+		names = file.Names()
+	}
+	configs := map[string]ClientConfig{}
+	for _, name := range names {
+		options, err := file.Profile(name)
+		if err != nil {
+			return nil, err
+		}
+		c := ClientConfig{OpenTimeout: variable.OpenTimeout, AuthTimeout: variable.AuthTimeout, InitTimeout: InitTimeoutDefault}
+		if err := ApplyProfile(&c, options); err != nil {
+			return nil, err
+		}
+		if c.Command == "" || len(c.Forwards) == 0 {
+			return nil, fmt.Errorf("profile %s: Command and a forward are required", name)
+		}
+		// the daemon serves one control socket for all profiles
+		c.ControlSocket = ""
+		configs[name] = c
+	}
+	return configs, nil
+}
+
+// reload - start new profiles, stop removed ones and restart changed ones, an invalid config changes nothing
+func (d *daemon) reload() error {
+	configs, err := d.loadConfigs()
+	if err != nil {
+		return err
+	}
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	// stopped - a changed profile starts after its previous supervisor exited
+	stopped := map[string]*supervisor{}
+	for name, s := range d.supervisors {
+		if c, ok := configs[name]; !ok || !reflect.DeepEqual(c, s.config) {
+			log.Printf("Stop profile %s\n", name)
+			s.stop()
+			stopped[name] = s
+			delete(d.supervisors, name)
+		}
+	}
+	for name, c := range configs {
+		if _, ok := d.supervisors[name]; ok {
+			continue
+		}
+		log.Printf("Start profile %s\n", name)
+		d.supervisors[name] = startSupervisor(name, c, stopped[name])
+	}
+	return nil
+}
+
+func (d *daemon) stopAll() {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	for _, s := range d.supervisors {
+		s.stop()
+	}
+	for _, s := range d.supervisors {
+		<-s.exited
+	}
+}
+
+func (d *daemon) supervisor(name string) (*supervisor, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	s, ok := d.supervisors[name]
+	if !ok {
+		return nil, fmt.Errorf("profile %q is not running", name)
+	}
+	return s, nil
+}
+
+func (d *daemon) controlServer() *control.Server {
+	server := control.NewServer()
+	server.Handle("status", "status - list profiles", func(args []string) (string, error) {
+		return d.status(), nil
+	})
+	server.Handle("reload", "reload - reload config file", func(args []string) (string, error) {
+		return "", d.reload()
+	})
+	server.Handle("restart", "restart PROFILE - restart the session of a profile", func(args []string) (string, error) {
+		if len(args) != 1 {
+			return "", errors.New("usage: restart PROFILE")
+		}
+		d.mutex.Lock()
+		defer d.mutex.Unlock()
+		s, ok := d.supervisors[args[0]]
+		if !ok {
+			return "", fmt.Errorf("profile %q is not running", args[0])
+		}
+		s.stop()
+		d.supervisors[args[0]] = startSupervisor(args[0], s.config, s)
+		return "", nil
+	})
+	server.Handle("stop", "stop PROFILE - stop the session of a profile until `restart` or a change of the profile", func(args []string) (string, error) {
+		if len(args) != 1 {
+			return "", errors.New("usage: stop PROFILE")
+		}
+		s, err := d.supervisor(args[0])
+		if err != nil {
+			return "", err
+		}
+		s.stop()
+		<-s.exited
+		return "", nil
+	})
+	server.Handle("limit", "limit PROFILE global|listener [N]|tunnel [VID] up|down RATE - set rate limit of a profile, see `limit` of client", func(args []string) (string, error) {
+		if len(args) == 0 {
+			return "", errors.New("usage: limit PROFILE ...")
+		}
+		s, err := d.supervisor(args[0])
+		if err != nil {
+			return "", err
+		}
+		session := s.current()
+		if session == nil {
+			return "", fmt.Errorf("profile %q has no running session", args[0])
+		}
+		return "", session.handleLimit(args[1:])
+	})
+	return server
+}
+
+func (d *daemon) status() string {
+	d.mutex.Lock()
+	names := make([]string, 0, len(d.supervisors))
+	for name := range d.supervisors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	supervisors := make([]*supervisor, len(names))
+	for i, name := range names {
+		supervisors[i] = d.supervisors[name]
+	}
+	d.mutex.Unlock()
+	var buffer bytes.Buffer
+	w := tabwriter.NewWriter(&buffer, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "PROFILE\tSTATE\tPID\tRESTARTS\tSINCE\tLAST ERROR")
+	for i, s := range supervisors {
+		s.mutex.Lock()
+		pid, lastErr := "-", "-"
+		if s.session != nil {
+			pid = fmt.Sprint(s.session.Pid())
+		}
+		if s.lastErr != nil {
+			lastErr = s.lastErr.Error()
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\t%s\n", names[i], s.state, pid, s.restarts, s.since.Format(time.RFC3339), lastErr)
+		s.mutex.Unlock()
+	}
+	w.Flush()
+	return buffer.String()
+}
+
+// supervisor - keep the session of a profile alive
+type supervisor struct {
+	name     string
+	config   ClientConfig
+	logger   *log.Logger
+	stopped  chan struct{}
+	stopOnce sync.Once
+	// exited - closed when run returns, the listeners of the session have been closed
+	exited chan struct{}
+
+	mutex    sync.Mutex
+	state    string
+	session  *Session
+	restarts int
+	since    time.Time
+	lastErr  error
+}
+
+// startSupervisor - run a supervisor of profile `name` after `previous` (may be nil) exited, so listen ports are free
+func startSupervisor(name string, c ClientConfig, previous *supervisor) *supervisor {
+	s := &supervisor{
+		name:    name,
+		config:  c,
+		logger:  log.New(log.Writer(), "["+name+"] ", log.Flags()),
+		stopped: make(chan struct{}),
+		exited:  make(chan struct{}),
+		state:   "starting",
+		since:   time.Now(),
+	}
+	if previous != nil {
+		s.restarts, s.lastErr = previous.restarts, previous.lastErr
+	}
+	go func() {
+		if previous != nil {
+			<-previous.exited
+		}
+		s.run()
+	}()
+	return s
+}
+
+func (s *supervisor) setState(state string, session *Session, err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.state, s.session, s.since = state, session, time.Now()
+	if err != nil {
+		s.lastErr = err
+	}
+}
+
+func (s *supervisor) current() *Session {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.session
+}
+
+func (s *supervisor) run() {
+	defer close(s.exited)
+	delay := variable.DaemonRestartMinDelay
+	for {
+		select {
+		case <-s.stopped:
+			s.setState("stopped", nil, nil)
+			return
+		default:
+		}
+		started := time.Now()
+		s.setState("starting", nil, nil)
+		session, err := StartSession(s.config, s.logger, false)
+		if err == nil {
+			s.setState("running", session, nil)
+			select {
+			case <-session.Done():
+				err = session.Wait()
+			case <-s.stopped:
+				session.Close()
+				s.setState("stopped", nil, nil)
+				return
+			}
+		}
+		if time.Since(started) > variable.DaemonRestartMaxDelay {
+			delay = variable.DaemonRestartMinDelay
+		}
+		s.logger.Printf("Session failed: %v, restart in %v\n", err, delay)
+		var initError *InitError
+		if errors.As(err, &initError) && len(initError.Tail) > 0 {
+			s.logger.Printf("last output of the command:\n%s\n", initError.Tail)
+		}
+		s.setState("waiting", nil, err)
+		select {
+		case <-time.After(delay):
+		case <-s.stopped:
+			s.setState("stopped", nil, nil)
+			return
+		}
+		s.mutex.Lock()
+		s.restarts++
+		s.mutex.Unlock()
+		if delay *= 2; delay > variable.DaemonRestartMaxDelay {
+			delay = variable.DaemonRestartMaxDelay
+		}
+	}
+}
+
+// stop - ask run to stop, `exited` is closed after the current session closed, calling it again is a no-op
+func (s *supervisor) stop() {
+	s.stopOnce.Do(func() { close(s.stopped) })
+}
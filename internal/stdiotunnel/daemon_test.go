@@ -0,0 +1,228 @@
+package stdiotunnel
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rectcircle/stdiotunnel/internal/stdiotunnel/control"
+	"github.com/rectcircle/stdiotunnel/internal/stdiotunnel/protocol"
+	"github.com/rectcircle/stdiotunnel/internal/variable"
+)
+
+// testServerArg - the test binary runs as the command of a session, see TestMain
+const testServerArg = "stdiotunnel-test-server"
+
+func TestMain(m *testing.M) {
+	if len(os.Args) == 3 && os.Args[1] == testServerArg {
+		if os.Args[2] == "exit" {
+			// the server can't start
+			os.Stdout.WriteString("no such command\n")
+			os.Exit(1)
+		}
+		if _, _, err := serverHandshake(os.Stdin, os.Stdout); err != nil {
+			os.Exit(1)
+		}
+		protocol.NewBridge(&stdioConn{os.Stdin, os.Stdout}, false).ServerServe("127.0.0.1", 1)
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// testServerCommand - a command which serves a stdio tunnel server, or exits at once if `mode` is exit
+func testServerCommand(mode string) string {
+	return fmt.Sprintf("%s %s %s", os.Args[0], testServerArg, mode)
+}
+
+// testPort - a free loopback port
+func testPort(t *testing.T) int {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+func newTestDaemon(t *testing.T, content string) *daemon {
+	dir, err := ioutil.TempDir("", "stdiotunnel-daemon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	d := &daemon{config: DaemonConfig{ConfigFile: filepath.Join(dir, "config")}, supervisors: map[string]*supervisor{}}
+	writeTestConfig(t, d, content)
+	t.Cleanup(d.stopAll)
+	return d
+}
+
+func writeTestConfig(t *testing.T, d *daemon, content string) {
+	if err := ioutil.WriteFile(d.config.ConfigFile, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// waitState - wait the supervisor of profile `name` in `state`
+func waitState(t *testing.T, d *daemon, name string, state string) *supervisor {
+	for i := 0; ; i++ {
+		s, err := d.supervisor(name)
+		if err == nil {
+			s.mutex.Lock()
+			current := s.state
+			s.mutex.Unlock()
+			if current == state {
+				return s
+			}
+		}
+		if i == 500 {
+			t.Fatalf("profile %s is not %s: %v", name, state, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestDaemonReload(t *testing.T) {
+	d := newTestDaemon(t, fmt.Sprintf("Interactive no\nProfile a\n  Command %s\n  LocalForward %d\n", testServerCommand("serve"), testPort(t)))
+	if err := d.reload(); err != nil {
+		t.Fatal(err)
+	}
+	a := waitState(t, d, "a", "running")
+	if d.configChanged() {
+		t.Errorf("configChanged() = true right after reload")
+	}
+
+	// a is changed and b is added
+	writeTestConfig(t, d, fmt.Sprintf("Interactive no\nProfile a\n  Command %s\n  LocalForward %d\nProfile b\n  Command %s\n  LocalForward %d\n",
+		testServerCommand("serve"), testPort(t), testServerCommand("serve"), testPort(t)))
+	if !d.configChanged() {
+		t.Fatal("configChanged() = false after the config file changed")
+	}
+	if err := d.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if a2 := waitState(t, d, "a", "running"); a2 == a {
+		t.Errorf("changed profile a is not restarted")
+	}
+	b := waitState(t, d, "b", "running")
+	select {
+	case <-a.exited:
+	default:
+		t.Errorf("the previous supervisor of a has not exited")
+	}
+
+	// an invalid config changes nothing
+	writeTestConfig(t, d, "Profile a\n  LocalForward http\n")
+	if err := d.reload(); err == nil {
+		t.Errorf("reload() of an invalid config = nil")
+	}
+	if s, err := d.supervisor("b"); err != nil || s != b {
+		t.Errorf("profile b is changed by an invalid config: %v", err)
+	}
+
+	// a is removed, b is kept
+	writeTestConfig(t, d, fmt.Sprintf("Interactive no\nProfile b\n  Command %s\n  LocalForward %d\n", b.config.Command, b.config.Forwards[0].Port))
+	if err := d.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.supervisor("a"); err == nil {
+		t.Errorf("removed profile a is running")
+	}
+	if s, _ := d.supervisor("b"); s != b {
+		t.Errorf("unchanged profile b is restarted")
+	}
+}
+
+func TestDaemonRestartBackoff(t *testing.T) {
+	minDelay, maxDelay := variable.DaemonRestartMinDelay, variable.DaemonRestartMaxDelay
+	// restored after the supervisors stopped
+	t.Cleanup(func() { variable.DaemonRestartMinDelay, variable.DaemonRestartMaxDelay = minDelay, maxDelay })
+	variable.DaemonRestartMinDelay, variable.DaemonRestartMaxDelay = 40*time.Millisecond, 80*time.Millisecond
+
+	d := newTestDaemon(t, fmt.Sprintf("Interactive no\nProfile a\n  Command %s\n  LocalForward %d\n", testServerCommand("exit"), testPort(t)))
+	start := time.Now()
+	if err := d.reload(); err != nil {
+		t.Fatal(err)
+	}
+	s := waitState(t, d, "a", "waiting")
+	for {
+		s.mutex.Lock()
+		restarts, lastErr := s.restarts, s.lastErr
+		s.mutex.Unlock()
+		if restarts >= 3 {
+			// delays are 40ms, 80ms and 80ms, doubled up to the max
+			if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+				t.Errorf("3 restarts after %v, want backoff of at least 200ms", elapsed)
+			}
+			var initError *InitError
+			if !errors.As(lastErr, &initError) || initError.Kind != InitEarlyExit {
+				t.Errorf("last error = %v, want early exit", lastErr)
+			}
+			break
+		}
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("restarts = %d after 5s", restarts)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestDaemonControl(t *testing.T) {
+	d := newTestDaemon(t, fmt.Sprintf("Interactive no\nProfile a\n  Command %s\n  LocalForward %d\nProfile b\n  Command %s\n  LocalForward %d\n",
+		testServerCommand("serve"), testPort(t), testServerCommand("serve"), testPort(t)))
+	if err := d.reload(); err != nil {
+		t.Fatal(err)
+	}
+	waitState(t, d, "a", "running")
+	waitState(t, d, "b", "running")
+	path := filepath.Join(filepath.Dir(d.config.ConfigFile), "control.sock")
+	server := d.controlServer()
+	go server.ListenAndServe(path)
+	defer server.Close()
+	for i := 0; i < 100; i++ {
+		if _, err := os.Stat(path); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	output, err := control.Request(path, []string{"status"})
+	lines := strings.Split(strings.TrimSpace(output), "\n")
+	if err != nil || len(lines) != 3 || !strings.HasPrefix(lines[0], "PROFILE") {
+		t.Fatalf("status = %q, %v", output, err)
+	}
+	for i, name := range []string{"a", "b"} {
+		if fields := strings.Fields(lines[i+1]); fields[0] != name || fields[1] != "running" || fields[2] == "-" {
+			t.Errorf("status of %s = %q, want running with a pid", name, lines[i+1])
+		}
+	}
+
+	if _, err := control.Request(path, []string{"stop", "a"}); err != nil {
+		t.Errorf("stop a = %v", err)
+	}
+	output, _ = control.Request(path, []string{"status"})
+	if fields := strings.Fields(strings.Split(output, "\n")[1]); fields[1] != "stopped" || fields[2] != "-" {
+		t.Errorf("status after stop = %q, want a stopped", output)
+	}
+	// stopping again is not an error, an unknown profile is
+	if _, err := control.Request(path, []string{"stop", "a"}); err != nil {
+		t.Errorf("stop a again = %v", err)
+	}
+	if _, err := control.Request(path, []string{"stop", "c"}); err == nil || err.Error() != `profile "c" is not running` {
+		t.Errorf("stop c = %v, want not running", err)
+	}
+	if _, err := control.Request(path, []string{"stop"}); err == nil || err.Error() != "usage: stop PROFILE" {
+		t.Errorf("stop = %v, want usage", err)
+	}
+
+	// a stopped profile starts again by restart
+	if _, err := control.Request(path, []string{"restart", "a"}); err != nil {
+		t.Errorf("restart a = %v", err)
+	}
+	waitState(t, d, "a", "running")
+}
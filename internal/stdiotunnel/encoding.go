@@ -0,0 +1,186 @@
+package stdiotunnel
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"sync"
+
+	"github.com/rectcircle/stdiotunnel/internal/variable"
+	"github.com/rectcircle/stdiotunnel/tools"
+)
+
+// Link encodings for stdio links which are not 8-bit clean, e.g. serial consoles, telnet and terminal multiplexers.
+// The client asks one in the nonce line of the handshake, the segments after the ready token are carried in printable frames
+//   ~BODY~CRC\n
+// BODY is the encoding of at most variable.FrameDataSize bytes, CRC is the hex CRC32 (IEEE) of these bytes.
+// A frame is a line ending with `~CRC`, so text the terminal injects between frames is skipped,
+// and `\r` added by the line discipline is ignored.
+// A frame failing to decode or the CRC check is dropped, the link keeps going, the checksum mode detects the lost segment.
+
+const (
+	// EncodingRaw - segments as they are, for 8-bit clean links
+	EncodingRaw = "raw"
+	// EncodingBase64 - frames of base64
+	EncodingBase64 = "base64"
+	// EncodingEscape - frames of printable ASCII, other bytes as `\XX`, smaller than base64 for mostly text payloads
+	EncodingEscape = "escape"
+)
+
+// CheckEncoding - check the name of a link encoding, empty means EncodingRaw
+func CheckEncoding(name string) error {
+	switch name {
+	case "", EncodingRaw, EncodingBase64, EncodingEscape:
+		return nil
+	}
+	return fmt.Errorf("unknown encoding %q, want %s, %s or %s", name, EncodingRaw, EncodingBase64, EncodingEscape)
+}
+
+// encodeLink - wrap `link` with the encoding `name`, which has been checked
+func encodeLink(link io.ReadWriteCloser, name string) io.ReadWriteCloser {
+	switch name {
+	case EncodingBase64:
+		return newFrameLink(link, encodeBase64, base64.StdEncoding.DecodeString)
+	case EncodingEscape:
+		return newFrameLink(link, encodeEscape, decodeEscape)
+	}
+	return link
+}
+
+// frameLink - a link carrying bytes in printable frames
+type frameLink struct {
+	link   io.ReadWriteCloser
+	reader *bufio.Reader
+	encode func(buffer *bytes.Buffer, data []byte)
+	decode func(body string) ([]byte, error)
+	// pending - decoded bytes not read yet
+	pending []byte
+	// skipping - inside a line longer than any frame
+	skipping   bool
+	writeMutex sync.Mutex
+}
+
+func newFrameLink(link io.ReadWriteCloser, encode func(buffer *bytes.Buffer, data []byte), decode func(body string) ([]byte, error)) *frameLink {
+	return &frameLink{
+		link: link,
+		// a frame line is at most 3 times of FrameDataSize, with `~`, CRC and `\r\n`
+		reader: bufio.NewReaderSize(link, 3*variable.FrameDataSize+16),
+		encode: encode,
+		decode: decode,
+	}
+}
+
+func (f *frameLink) Read(p []byte) (int, error) {
+	for len(f.pending) == 0 {
+		line, err := f.reader.ReadSlice('\n')
+		if err == bufio.ErrBufferFull {
+			f.skipping = true
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		if f.skipping {
+			f.skipping = false
+			continue
+		}
+		f.pending = f.parseFrame(line)
+	}
+	n := copy(p, f.pending)
+	f.pending = f.pending[n:]
+	return n, nil
+}
+
+// parseFrame - the bytes of a frame line, nil for a line of noise or a corrupted frame
+func (f *frameLink) parseFrame(line []byte) []byte {
+	line = bytes.TrimRight(line, "\r\n")
+	if len(line) < 10 || line[len(line)-9] != '~' {
+		return nil
+	}
+	start := bytes.LastIndexByte(line[:len(line)-9], '~')
+	if start < 0 {
+		return nil
+	}
+	sum := make([]byte, 4)
+	if _, err := hex.Decode(sum, line[len(line)-8:]); err != nil {
+		return nil
+	}
+	data, err := f.decode(string(line[start+1 : len(line)-9]))
+	if err != nil {
+		tools.TraceF("Drop corrupted frame: %v\n", err)
+		return nil
+	}
+	if crc32.ChecksumIEEE(data) != binary.BigEndian.Uint32(sum) {
+		tools.TraceF("Drop corrupted frame: checksum mismatch\n")
+		return nil
+	}
+	return data
+}
+
+// Write - write `p` as frames in one write of the link
+func (f *frameLink) Write(p []byte) (int, error) {
+	f.writeMutex.Lock()
+	defer f.writeMutex.Unlock()
+	var buffer bytes.Buffer
+	for data := p; len(data) > 0; {
+		chunk := data
+		if len(chunk) > variable.FrameDataSize {
+			chunk = chunk[:variable.FrameDataSize]
+		}
+		data = data[len(chunk):]
+		buffer.WriteByte('~')
+		f.encode(&buffer, chunk)
+		fmt.Fprintf(&buffer, "~%08x\n", crc32.ChecksumIEEE(chunk))
+	}
+	if _, err := f.link.Write(buffer.Bytes()); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (f *frameLink) Close() error {
+	return f.link.Close()
+}
+
+func encodeBase64(buffer *bytes.Buffer, data []byte) {
+	encoder := base64.NewEncoder(base64.StdEncoding, buffer)
+	encoder.Write(data)
+	encoder.Close()
+}
+
+// encodeEscape - keep printable ASCII except space, `~` and `\`, other bytes are `\XX`
+func encodeEscape(buffer *bytes.Buffer, data []byte) {
+	for _, b := range data {
+		if b > ' ' && b < 0x7f && b != '~' && b != '\\' {
+			buffer.WriteByte(b)
+		} else {
+			fmt.Fprintf(buffer, "\\%02x", b)
+		}
+	}
+}
+
+func decodeEscape(body string) ([]byte, error) {
+	data := make([]byte, 0, len(body))
+	for i := 0; i < len(body); i++ {
+		if body[i] != '\\' {
+			data = append(data, body[i])
+			continue
+		}
+		if i+3 > len(body) {
+			return nil, errors.New("truncated escape")
+		}
+		b, err := hex.DecodeString(body[i+1 : i+3])
+		if err != nil {
+			return nil, err
+		}
+		data = append(data, b[0])
+		i += 2
+	}
+	return data, nil
+}
@@ -0,0 +1,64 @@
+package stdiotunnel
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+// bufferLink - a link writing to `output` and reading from `input`
+type bufferLink struct {
+	input  io.Reader
+	output bytes.Buffer
+}
+
+func (l *bufferLink) Read(p []byte) (int, error)  { return l.input.Read(p) }
+func (l *bufferLink) Write(p []byte) (int, error) { return l.output.Write(p) }
+func (l *bufferLink) Close() error                { return nil }
+
+func TestFrameLink(t *testing.T) {
+	data := make([]byte, 0, 4*256)
+	for i := 0; i < 4*256; i++ {
+		data = append(data, byte(i))
+	}
+	for _, encoding := range []string{EncodingBase64, EncodingEscape} {
+		t.Run(encoding, func(t *testing.T) {
+			writer := &bufferLink{}
+			if _, err := encodeLink(writer, encoding).Write(data); err != nil {
+				t.Fatal(err)
+			}
+			for _, b := range writer.output.Bytes() {
+				if b != '\n' && (b < ' ' || b >= 0x7f) {
+					t.Fatalf("frame has unprintable byte %#x", b)
+				}
+			}
+			// a terminal adds `\r`, and a multiplexer injects a status line between frames
+			lines := strings.SplitAfter(writer.output.String(), "\n")
+			mangled := strings.Join(lines[:1], "") + "status ~ 12:00\r\n" + strings.Join(lines[1:], "")
+			mangled = strings.ReplaceAll(mangled, "\n", "\r\n")
+			got, err := ioutil.ReadAll(encodeLink(&bufferLink{input: strings.NewReader(mangled)}, encoding))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Errorf("read %d bytes, want the %d bytes written", len(got), len(data))
+			}
+		})
+	}
+	t.Run("corrupted", func(t *testing.T) {
+		writer := &bufferLink{}
+		link := encodeLink(writer, EncodingEscape)
+		for _, data := range []string{"hello", "world", "again"} {
+			link.Write([]byte(data))
+		}
+		// a changed byte fails the CRC check, an invalid escape fails to decode
+		corrupted := strings.Replace(writer.output.String(), "hello", "hallo", 1)
+		corrupted = strings.Replace(corrupted, "world", `wor\zz`, 1)
+		got, err := ioutil.ReadAll(encodeLink(&bufferLink{input: strings.NewReader(corrupted)}, EncodingEscape))
+		if err != nil || string(got) != "again" {
+			t.Errorf("read = %q, %v, want the frame after the corrupted ones", got, err)
+		}
+	})
+}
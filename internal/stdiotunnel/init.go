@@ -0,0 +1,408 @@
+package stdiotunnel
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/rectcircle/stdiotunnel/internal/variable"
+)
+
+// AuthRule - a scripted response of the init stage: when the command output matches Prompt, send the secret of Source
+type AuthRule struct {
+	// Prompt - regexp matched against the output since the last response
+	Prompt string
+	// Source - `env:NAME`, `file:PATH`, `askpass:PROGRAM [ARGS]` (the prompt is the last argument) or `text:VALUE`
+	Source string
+}
+
+// ParseAuthRule - parse `PROMPT SOURCE`, SOURCE is the last field, PROMPT may be quoted to keep spaces
+func ParseAuthRule(spec string) (AuthRule, error) {
+	spec = strings.TrimSpace(spec)
+	i := strings.LastIndexAny(spec, " \t")
+	if i < 0 {
+		return AuthRule{}, fmt.Errorf("want `PROMPT SOURCE`, got %q", spec)
+	}
+	rule := AuthRule{Prompt: strings.TrimSpace(spec[:i]), Source: spec[i+1:]}
+	// askpass arguments contain spaces, the source starts from `askpass:`
+	if j := strings.Index(spec, " askpass:"); j >= 0 {
+		rule.Prompt, rule.Source = strings.TrimSpace(spec[:j]), spec[j+1:]
+	}
+	if len(rule.Prompt) >= 2 && rule.Prompt[0] == '"' && rule.Prompt[len(rule.Prompt)-1] == '"' {
+		rule.Prompt = rule.Prompt[1 : len(rule.Prompt)-1]
+	}
+	if _, err := regexp.Compile(rule.Prompt); err != nil {
+		return rule, err
+	}
+	kind := rule.Source[:strings.Index(rule.Source+":", ":")]
+	switch kind {
+	case "env", "file", "askpass", "text":
+	default:
+		return rule, fmt.Errorf("unknown secret source %q, want env:, file:, askpass: or text:", rule.Source)
+	}
+	return rule, nil
+}
+
+// secret - read the secret of the rule, `prompt` is passed to askpass, askpass is killed after `timeout`
+func (rule AuthRule) secret(prompt string, timeout time.Duration) (string, error) {
+	kind, value := rule.Source, ""
+	if i := strings.IndexByte(rule.Source, ':'); i >= 0 {
+		kind, value = rule.Source[:i], rule.Source[i+1:]
+	}
+	switch kind {
+	case "env":
+		secret, ok := os.LookupEnv(value)
+		if !ok {
+			return "", fmt.Errorf("env %s is not set", value)
+		}
+		return secret, nil
+	case "file":
+		content, err := ioutil.ReadFile(expandHome(value))
+		return strings.TrimRight(string(content), "\r\n"), err
+	case "askpass":
+		ctx := context.Background()
+		if timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+		args := strings.Fields(value)
+		if len(args) == 0 {
+			return "", errors.New("askpass program is empty")
+		}
+		output, err := exec.CommandContext(ctx, args[0], append(args[1:], prompt)...).Output()
+		if err != nil {
+			return "", fmt.Errorf("askpass %s: %w", args[0], err)
+		}
+		return strings.TrimRight(string(output), "\r\n"), nil
+	case "text":
+		return value, nil
+	}
+	return "", fmt.Errorf("unknown secret source %q", rule.Source)
+}
+
+// InitErrorKind - why the init stage failed
+type InitErrorKind int
+
+const (
+	// InitSpawnFailed - the command can not be started
+	InitSpawnFailed = InitErrorKind(iota)
+	// InitEarlyExit - the command exited before the ready trigger
+	InitEarlyExit
+	// InitTimeout - the ready trigger did not appear in time
+	InitTimeout
+	// InitAuthFailed - an auth rule can not answer, or its answer was rejected
+	InitAuthFailed
+	// InitBootstrapFailed - the server binary can not be uploaded or executed on the remote
+	InitBootstrapFailed
+)
+
+func (k InitErrorKind) String() string {
+	switch k {
+	case InitSpawnFailed:
+		return "spawn failed"
+	case InitEarlyExit:
+		return "early exit"
+	case InitTimeout:
+		return "timeout"
+	case InitAuthFailed:
+		return "auth failed"
+	case InitBootstrapFailed:
+		return "bootstrap failed"
+	}
+	return fmt.Sprintf("InitErrorKind(%d)", int(k))
+}
+
+// ExitCode - exit code of client for the kind, so that wrapper scripts can react
+func (k InitErrorKind) ExitCode() int {
+	switch k {
+	case InitSpawnFailed:
+		return 3
+	case InitEarlyExit:
+		return 4
+	case InitTimeout:
+		return 5
+	case InitAuthFailed:
+		return 6
+	case InitBootstrapFailed:
+		return 7
+	}
+	return 1
+}
+
+// InitError - failure of the init stage
+type InitError struct {
+	Kind InitErrorKind
+	Err  error
+	// Tail - the last output of the command, at most variable.InitOutputTailSize bytes
+	Tail []byte
+}
+
+func (e *InitError) Error() string {
+	return fmt.Sprintf("init stage %s: %v", e.Kind, e.Err)
+}
+
+func (e *InitError) Unwrap() error {
+	return e.Err
+}
+
+// The ready handshake: the server echoes variable.StdoutHelloTrigger and reads a line `NONCE [ENCODING] [checksum]` from stdin,
+// then echoes the ready token of the nonce, the segments in the link encoding start right after the token.
+// The token is a digest of the random nonce, so neither an echo typed by the user nor the terminal echo of the nonce matches it.
+
+// newReadyNonce - random nonce of a ready handshake
+func newReadyNonce() (string, error) {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(nonce), nil
+}
+
+// readyToken - the token echoed by server for `nonce`
+func readyToken(nonce string) string {
+	proof := sha256.Sum256([]byte("stdiotunnel-ready:" + nonce))
+	return fmt.Sprintf(variable.StdoutReadyTrigger, hex.EncodeToString(proof[:16]))
+}
+
+// triggerMatcher - find a trigger in a stream read in pieces
+type triggerMatcher struct {
+	trigger []byte
+	// window - the last len(trigger)-1 bytes, which may be the beginning of the trigger
+	window []byte
+}
+
+// match - the bytes after the trigger if it ends in `data`,
+// `before` is how many bytes of `data` precede the trigger (negative if it starts in the window)
+func (m *triggerMatcher) match(data []byte) (found bool, before int, after []byte) {
+	pending := append(m.window, data...)
+	if i := bytes.Index(pending, m.trigger); i >= 0 {
+		m.window = m.window[:0]
+		return true, i - (len(pending) - len(data)), append([]byte{}, pending[i+len(m.trigger):]...)
+	}
+	if keep := len(m.trigger) - 1; len(pending) > keep {
+		pending = pending[len(pending)-keep:]
+	}
+	m.window = append([]byte{}, pending...)
+	return false, 0, nil
+}
+
+// maxPromptWindow - max bytes of output since the last response kept for prompt matching
+const maxPromptWindow = 4096
+
+// initStage - how to pass the init stage of the command
+type initStage struct {
+	// output - copy of the command output before ready
+	output io.Writer
+	// auth - scripted responses, each rule answers once
+	auth []AuthRule
+	// authTimeout - with auth rules, the next prompt or the ready trigger must appear within it
+	authTimeout time.Duration
+	// initTimeout - the ready trigger must appear within it, 0 means no timeout
+	initTimeout time.Duration
+	// bootstrap - upload and execute the server through the remote shell, nil means disable
+	bootstrap *bootstrapper
+	// encoding - link encoding asked to the server in the handshake, empty means EncodingRaw
+	encoding string
+	// checksum - ask checksummed segments in the handshake
+	checksum bool
+	// tail - the last output of the command
+	tail []byte
+}
+
+// writeOutput - copy output of the command and keep its tail
+func (stage *initStage) writeOutput(data []byte) {
+	stage.output.Write(data)
+	stage.tail = append(stage.tail, data...)
+	if len(stage.tail) > variable.InitOutputTailSize {
+		stage.tail = stage.tail[len(stage.tail)-variable.InitOutputTailSize:]
+	}
+}
+
+// fail - an InitError with the output tail
+func (stage *initStage) fail(kind InitErrorKind, err error) *InitError {
+	return &InitError{Kind: kind, Err: err, Tail: append([]byte{}, stage.tail...)}
+}
+
+// authScript - state of auth rules during an init stage
+type authScript struct {
+	rules   []AuthRule
+	prompts []*regexp.Regexp
+	used    []bool
+	timeout time.Duration
+	input   io.Writer
+	// window - output since the last response
+	window []byte
+	// secrets - answers sent, redacted from the output in case the command echoes them
+	secrets [][]byte
+	// held - output tail which may be the beginning of a secret
+	held []byte
+}
+
+// redact - return `data` with the sent secrets replaced,
+// a tail which may be the beginning of a secret is held until the next call
+func (script *authScript) redact(data []byte) []byte {
+	data = append(script.held, data...)
+	script.held = nil
+	hold := 0
+	for _, secret := range script.secrets {
+		data = bytes.ReplaceAll(data, secret, []byte("********"))
+		for k := len(secret) - 1; k > hold; k-- {
+			if bytes.HasSuffix(data, secret[:k]) {
+				hold = k
+				break
+			}
+		}
+	}
+	script.held = append([]byte{}, data[len(data)-hold:]...)
+	return data[:len(data)-hold]
+}
+
+// feed - match the new output, answer the first unused matching rule
+// a prompt matched only by used rules means the previous answer was rejected
+func (script *authScript) feed(data []byte) (answered bool, err error) {
+	script.window = append(script.window, data...)
+	if len(script.window) > maxPromptWindow {
+		script.window = script.window[len(script.window)-maxPromptWindow:]
+	}
+	var rejected *AuthRule
+	for i, prompt := range script.prompts {
+		if !prompt.Match(script.window) {
+			continue
+		}
+		if script.used[i] {
+			rejected = &script.rules[i]
+			continue
+		}
+		lines := strings.Split(strings.TrimSpace(string(script.window)), "\n")
+		secret, err := script.rules[i].secret(strings.TrimSpace(lines[len(lines)-1]), script.timeout)
+		if err != nil {
+			return false, fmt.Errorf("prompt %q: %w", script.rules[i].Prompt, err)
+		}
+		script.used[i] = true
+		script.window = script.window[:0]
+		if secret != "" && !strings.HasPrefix(script.rules[i].Source, "text:") {
+			script.secrets = append(script.secrets, []byte(secret))
+		}
+		_, err = io.WriteString(script.input, secret+"\n")
+		return true, err
+	}
+	if rejected != nil {
+		return false, fmt.Errorf("prompt %q appeared again, the answer was rejected", rejected.Prompt)
+	}
+	return false, nil
+}
+
+// wait - copy `reader` to output until the ready token appears, answer the hello trigger and auth prompts to `input`
+// return the bytes read after the token, they are the beginning of the segment stream
+// `abort` kills the command on timeout, the error is an *InitError
+func (stage *initStage) wait(reader io.Reader, input io.Writer, abort func()) ([]byte, error) {
+	var (
+		script *authScript
+		// aborted - the *InitError of a timeout, the read error after abort is replaced by it
+		aborted   atomic.Value
+		authTimer *time.Timer
+	)
+	nonce, err := newReadyNonce()
+	if err != nil {
+		return nil, stage.fail(InitSpawnFailed, err)
+	}
+	timeout := func(err *InitError) func() {
+		return func() {
+			aborted.Store(err)
+			abort()
+		}
+	}
+	if stage.initTimeout > 0 {
+		initTimer := time.AfterFunc(stage.initTimeout, timeout(stage.fail(InitTimeout, fmt.Errorf("no ready trigger within %v", stage.initTimeout))))
+		defer initTimer.Stop()
+	}
+	if len(stage.auth) > 0 {
+		script = &authScript{rules: stage.auth, used: make([]bool, len(stage.auth)), timeout: stage.authTimeout, input: input}
+		for _, rule := range stage.auth {
+			script.prompts = append(script.prompts, regexp.MustCompile(rule.Prompt))
+		}
+		if stage.authTimeout > 0 {
+			authTimer = time.AfterFunc(stage.authTimeout, timeout(stage.fail(InitTimeout, fmt.Errorf("no auth prompt or ready trigger within %v", stage.authTimeout))))
+			defer authTimer.Stop()
+		}
+	}
+	if stage.bootstrap != nil {
+		stage.bootstrap.input = input
+	}
+	line := nonce
+	if stage.encoding != "" {
+		line += " " + stage.encoding
+	}
+	if stage.checksum {
+		line += " checksum"
+	}
+	line += "\n"
+	var (
+		buffer = make([]byte, 4096, 4096)
+		hello  = &triggerMatcher{trigger: []byte(variable.StdoutHelloTrigger)}
+		ready  = &triggerMatcher{trigger: []byte(readyToken(nonce))}
+	)
+	for {
+		n, err := reader.Read(buffer)
+		if err, ok := aborted.Load().(*InitError); ok {
+			// the tail when aborted may miss the last read, take it again
+			err.Tail = append([]byte{}, stage.tail...)
+			return nil, err
+		}
+		if err != nil {
+			// EOF of pipe, or EIO of pty
+			return nil, stage.fail(InitEarlyExit, err)
+		}
+		data := buffer[:n]
+		if found, before, after := ready.match(data); found {
+			if before > 0 && script == nil {
+				stage.writeOutput(data[:before])
+			} else if before > 0 {
+				stage.writeOutput(script.redact(data[:before]))
+			}
+			return after, nil
+		}
+		// every hello is answered, a hello typed by the user before the server started must not block the real one
+		if found, _, _ := hello.match(data); found {
+			if _, err := io.WriteString(input, line); err != nil {
+				return nil, stage.fail(InitEarlyExit, err)
+			}
+		}
+		if script == nil {
+			stage.writeOutput(data)
+		} else {
+			stage.writeOutput(script.redact(data))
+			answered, err := script.feed(data)
+			if err != nil {
+				abort()
+				return nil, stage.fail(InitAuthFailed, err)
+			}
+			if answered && authTimer != nil {
+				authTimer.Reset(stage.authTimeout)
+			}
+		}
+		if stage.bootstrap != nil {
+			if err := stage.bootstrap.feed(data); err != nil {
+				abort()
+				return nil, stage.fail(InitBootstrapFailed, err)
+			}
+			// the shell prompt means auth is over, the upload may take longer than authTimeout
+			if authTimer != nil && stage.bootstrap.started() {
+				authTimer.Stop()
+			}
+		}
+	}
+}
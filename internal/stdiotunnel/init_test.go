@@ -0,0 +1,157 @@
+package stdiotunnel
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rectcircle/stdiotunnel/internal/variable"
+)
+
+func TestParseAuthRule(t *testing.T) {
+	tests := []struct {
+		spec    string
+		want    AuthRule
+		wantErr bool
+	}{
+		{spec: "password: env:PW", want: AuthRule{Prompt: "password:", Source: "env:PW"}},
+		{spec: `"Verification code: " askpass:otp --account prod`, want: AuthRule{Prompt: "Verification code: ", Source: "askpass:otp --account prod"}},
+		{spec: "(yes/no) text:yes", want: AuthRule{Prompt: "(yes/no)", Source: "text:yes"}},
+		{spec: "password: PW", wantErr: true},
+		{spec: "env:PW", wantErr: true},
+		{spec: "( env:PW", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseAuthRule(tt.spec)
+		if (err != nil) != tt.wantErr || (!tt.wantErr && got != tt.want) {
+			t.Errorf("ParseAuthRule(%q) = %v, %v, want %v, wantErr %v", tt.spec, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestInitStageWait(t *testing.T) {
+	os.Setenv("STDIOTUNNEL_TEST_PW", "s3cret")
+	defer os.Unsetenv("STDIOTUNNEL_TEST_PW")
+	stage := &initStage{
+		auth:        []AuthRule{{Prompt: "[Pp]assword: $", Source: "env:STDIOTUNNEL_TEST_PW"}, {Prompt: "code: $", Source: "text:42"}},
+		authTimeout: time.Second,
+	}
+	t.Run("answer prompts", func(t *testing.T) {
+		var output bytes.Buffer
+		stage.output = &output
+		answers := []string{}
+		reader, writer := fakeCommand(func(in *bufio.Reader, out io.Writer) {
+			for _, prompt := range []string{"Password: ", "\r\ncode: "} {
+				io.WriteString(out, prompt)
+				line, _ := in.ReadString('\n')
+				answers = append(answers, line)
+				// the terminal echoes the answer
+				io.WriteString(out, line)
+			}
+			io.WriteString(out, "welcome\r\n")
+		}, "")
+		if _, err := stage.wait(&oneByteReader{reader}, writer, func() {}); err != nil {
+			t.Fatal(err)
+		}
+		if strings.Join(answers, "") != "s3cret\n42\n" {
+			t.Errorf("answers = %q", answers)
+		}
+		if strings.Contains(output.String(), "s3cret") {
+			t.Errorf("output leaks the secret: %q", output.String())
+		}
+	})
+	t.Run("rejected", func(t *testing.T) {
+		var output, input bytes.Buffer
+		stage.output = &output
+		reader := strings.NewReader("Password: \r\nPermission denied\r\nPassword: ")
+		_, err := stage.wait(&oneByteReader{reader}, &input, func() {})
+		var initError *InitError
+		if !errors.As(err, &initError) || initError.Kind != InitAuthFailed || !strings.Contains(err.Error(), "rejected") {
+			t.Errorf("wait() = %v, want rejected", err)
+		}
+	})
+}
+
+func TestInitStageWaitHandshake(t *testing.T) {
+	stage := &initStage{output: ioutil.Discard}
+	t.Run("leftover", func(t *testing.T) {
+		reader, writer := fakeCommand(func(in *bufio.Reader, out io.Writer) {}, "segments")
+		leftover, err := stage.wait(reader, writer, func() {})
+		if err != nil || string(leftover) != "segments" {
+			t.Errorf("wait() = %q, %v, want leftover segments", leftover, err)
+		}
+	})
+	t.Run("echo", func(t *testing.T) {
+		// a shell echoes the triggers typed by the user, the hello is answered but the forged token never matches
+		reader, writer := fakeCommand(func(in *bufio.Reader, out io.Writer) {
+			io.WriteString(out, "$ echo "+variable.StdoutHelloTrigger)
+			line, _ := in.ReadString('\n')
+			io.WriteString(out, line+"command not found\r\n$ echo "+readyToken("0123")+"\r\n")
+		}, "segments")
+		leftover, err := stage.wait(&oneByteReader{reader}, writer, func() {})
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the rest is delivered in pieces after the token
+		rest, _ := ioutil.ReadAll(io.LimitReader(reader, int64(len("segments")-len(leftover))))
+		if got := string(leftover) + string(rest); got != "segments" {
+			t.Errorf("segments = %q", got)
+		}
+	})
+}
+
+func TestInitStageWaitFailure(t *testing.T) {
+	t.Run("early exit", func(t *testing.T) {
+		stage := &initStage{output: ioutil.Discard}
+		_, err := stage.wait(strings.NewReader("Permission denied\n"), ioutil.Discard, func() {})
+		var initError *InitError
+		if !errors.As(err, &initError) || initError.Kind != InitEarlyExit || string(initError.Tail) != "Permission denied\n" {
+			t.Errorf("wait() = %v, want early exit with tail", err)
+		}
+	})
+	t.Run("timeout", func(t *testing.T) {
+		stage := &initStage{output: ioutil.Discard, initTimeout: 50 * time.Millisecond}
+		reader, writer := io.Pipe()
+		go writer.Write([]byte("connecting"))
+		// abort kills the command, then read fails
+		_, err := stage.wait(reader, ioutil.Discard, func() { writer.Close() })
+		var initError *InitError
+		if !errors.As(err, &initError) || initError.Kind != InitTimeout || string(initError.Tail) != "connecting" {
+			t.Errorf("wait() = %v, want timeout with tail", err)
+		}
+	})
+}
+
+// fakeCommand - run `script` as a remote command on pipes, then the server handshake,
+// the ready token and `segments` are written at once, as one read of the client
+func fakeCommand(script func(in *bufio.Reader, out io.Writer), segments string) (output io.Reader, input io.Writer) {
+	outputReader, outputWriter := io.Pipe()
+	inputReader, inputWriter := io.Pipe()
+	go func() {
+		in := bufio.NewReader(inputReader)
+		script(in, outputWriter)
+		io.WriteString(outputWriter, variable.StdoutHelloTrigger)
+		nonce, err := in.ReadString('\n')
+		if err != nil {
+			outputWriter.CloseWithError(err)
+			return
+		}
+		io.WriteString(outputWriter, readyToken(strings.TrimSpace(nonce))+segments)
+	}()
+	return outputReader, inputWriter
+}
+
+// oneByteReader - deliver output in small pieces like a slow command
+type oneByteReader struct {
+	reader io.Reader
+}
+
+func (r *oneByteReader) Read(p []byte) (int, error) {
+	return r.reader.Read(p[:1])
+}
@@ -0,0 +1,217 @@
+package stdiotunnel
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rectcircle/stdiotunnel/internal/stdiotunnel/config"
+	"github.com/rectcircle/stdiotunnel/internal/stdiotunnel/protocol"
+	"github.com/rectcircle/stdiotunnel/tools"
+)
+
+// ForwardType - how a listener of the client chooses the target
+type ForwardType int
+
+const (
+	// ForwardLocal - connections go to a fixed target, or the default target of the server
+	ForwardLocal = ForwardType(iota)
+	// ForwardDynamic - a SOCKS5 listener, every connection asks its own target
+	ForwardDynamic
+	// ForwardRemote - the server listens, connections go to a target dialed by the client
+	ForwardRemote
+)
+
+// Forward - a listener of the client, or of the server for ForwardRemote
+type Forward struct {
+	Type ForwardType
+	// Host, Port - listen address
+	Host string
+	Port uint16
+	// Target - `host:port` asked to the server, empty means the default target of the server, must be permitted by server
+	// for ForwardRemote, it is dialed by the client and required
+	Target string
+}
+
+func (f Forward) String() string {
+	if f.Type == ForwardRemote {
+		return fmt.Sprintf("server %s -> %s (remote)", tools.ToAddressString(f.Host, f.Port), f.Target)
+	}
+	if f.Type == ForwardDynamic {
+		return fmt.Sprintf("%s (dynamic)", tools.ToAddressString(f.Host, f.Port))
+	}
+	if f.Target == "" {
+		return fmt.Sprintf("%s -> default target", tools.ToAddressString(f.Host, f.Port))
+	}
+	return fmt.Sprintf("%s -> %s", tools.ToAddressString(f.Host, f.Port), f.Target)
+}
+
+// forwardHost - due to security, the client only listens on loopback
+const forwardHost = "127.0.0.1"
+
+func parsePort(s string) (uint16, error) {
+	port, err := strconv.ParseUint(s, 10, 16)
+	if err != nil {
+		return 0, fmt.Errorf("invalid port %q", s)
+	}
+	return uint16(port), nil
+}
+
+// ParseLocalForward - parse `PORT`, `PORT HOST:PORT` or `PORT:HOST:PORT`
+func ParseLocalForward(spec string) (Forward, error) {
+	forward := Forward{Type: ForwardLocal, Host: forwardHost}
+	port, target := strings.TrimSpace(spec), ""
+	if i := strings.IndexAny(port, " \t:"); i >= 0 {
+		port, target = port[:i], strings.TrimSpace(port[i+1:])
+	}
+	var err error
+	if forward.Port, err = parsePort(port); err != nil {
+		return forward, err
+	}
+	if target != "" {
+		if _, targetPort, err := net.SplitHostPort(target); err != nil {
+			return forward, fmt.Errorf("invalid target %q: %w", target, err)
+		} else if _, err := parsePort(targetPort); err != nil {
+			return forward, err
+		}
+		if len(target) > protocol.MaxTargetLength {
+			return forward, fmt.Errorf("target %q is too long", target)
+		}
+		forward.Target = target
+	}
+	return forward, nil
+}
+
+// ParseRemoteForward - parse `PORT HOST:PORT` or `PORT:HOST:PORT`, the server listens on its loopback PORT
+func ParseRemoteForward(spec string) (Forward, error) {
+	forward, err := ParseLocalForward(spec)
+	if err == nil && forward.Target == "" {
+		err = fmt.Errorf("remote forward %q has no target", spec)
+	}
+	forward.Type = ForwardRemote
+	return forward, err
+}
+
+// ParseDynamicForward - parse `PORT`
+func ParseDynamicForward(spec string) (Forward, error) {
+	port, err := parsePort(strings.TrimSpace(spec))
+	return Forward{Type: ForwardDynamic, Host: forwardHost, Port: port}, err
+}
+
+func parseBool(s string) (bool, error) {
+	switch strings.ToLower(s) {
+	case "yes", "true":
+		return true, nil
+	case "no", "false":
+		return false, nil
+	}
+	return false, fmt.Errorf("want yes or no, got %q", s)
+}
+
+// expandHome - expand a leading `~/` to the home dir
+func expandHome(path string) string {
+	if strings.HasPrefix(path, "~/") {
+		if home, err := os.UserHomeDir(); err == nil {
+			return filepath.Join(home, path[2:])
+		}
+	}
+	return path
+}
+
+// LoadProfile - load profile `name` of the config file `path` and apply it to `c`
+func LoadProfile(path string, name string, c *ClientConfig) error {
+	file, err := config.Load(path)
+	if err != nil {
+		return err
+	}
+	options, err := file.Profile(name)
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return ApplyProfile(c, options)
+}
+
+// ApplyProfile - apply options of a profile to `c`, forwards of the profile replace forwards of `c`
+func ApplyProfile(c *ClientConfig, options []config.Option) error {
+	forwards := []Forward{}
+	for _, option := range options {
+		var err error
+		switch option.Key {
+		case "command":
+			c.Command = option.Value
+		case "interactive":
+			c.Interactive, err = parseBool(option.Value)
+		case "localforward":
+			var forward Forward
+			if forward, err = ParseLocalForward(option.Value); err == nil {
+				forwards = append(forwards, forward)
+			}
+		case "dynamicforward":
+			var forward Forward
+			if forward, err = ParseDynamicForward(option.Value); err == nil {
+				forwards = append(forwards, forward)
+			}
+		case "remoteforward":
+			var forward Forward
+			if forward, err = ParseRemoteForward(option.Value); err == nil {
+				forwards = append(forwards, forward)
+			}
+		case "priority":
+			var priority uint64
+			if priority, err = strconv.ParseUint(option.Value, 10, 8); err == nil {
+				c.Priority = uint8(priority)
+			}
+		case "globalup", "globaldown", "listenerup", "listenerdown", "tunnelup", "tunneldown":
+			limit := map[string]*uint64{
+				"globalup": &c.Limits.GlobalUp, "globaldown": &c.Limits.GlobalDown,
+				"listenerup": &c.Limits.ListenerUp, "listenerdown": &c.Limits.ListenerDown,
+				"tunnelup": &c.Limits.TunnelUp, "tunneldown": &c.Limits.TunnelDown,
+			}[option.Key]
+			*limit, err = tools.ParseByteSize(option.Value)
+		case "opentimeout":
+			c.OpenTimeout, err = time.ParseDuration(option.Value)
+		case "idletimeout":
+			c.IdleTimeout, err = time.ParseDuration(option.Value)
+		case "keepalive":
+			c.KeepAlive, err = time.ParseDuration(option.Value)
+		case "auth":
+			var rule AuthRule
+			if rule, err = ParseAuthRule(option.Value); err == nil {
+				c.Auth = append(c.Auth, rule)
+			}
+		case "bootstrap":
+			c.Bootstrap, err = parseBool(option.Value)
+		case "bootstrapdir":
+			c.BootstrapDir = expandHome(option.Value)
+		case "bootstrapprompt":
+			c.BootstrapPrompt = option.Value
+		case "bootstrapserverargs":
+			c.BootstrapServerArgs = option.Value
+		case "inittimeout":
+			c.InitTimeout, err = time.ParseDuration(option.Value)
+		case "authtimeout":
+			c.AuthTimeout, err = time.ParseDuration(option.Value)
+		case "checksum":
+			c.Checksum, err = parseBool(option.Value)
+		case "encoding":
+			if err = CheckEncoding(option.Value); err == nil {
+				c.Encoding = option.Value
+			}
+		case "controlsocket":
+			c.ControlSocket = expandHome(option.Value)
+		default:
+			err = fmt.Errorf("unknown option")
+		}
+		if err != nil {
+			return option.Errorf("%v", err)
+		}
+	}
+	if len(forwards) > 0 {
+		c.Forwards = forwards
+	}
+	return nil
+}
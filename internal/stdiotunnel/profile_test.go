@@ -0,0 +1,97 @@
+package stdiotunnel
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rectcircle/stdiotunnel/internal/stdiotunnel/config"
+)
+
+func TestParseForward(t *testing.T) {
+	tests := []struct {
+		spec    string
+		parse   func(spec string) (Forward, error)
+		want    Forward
+		wantErr bool
+	}{
+		{spec: "8080", parse: ParseLocalForward, want: Forward{Type: ForwardLocal, Host: forwardHost, Port: 8080}},
+		{spec: "15432 db.internal:5432", parse: ParseLocalForward, want: Forward{Type: ForwardLocal, Host: forwardHost, Port: 15432, Target: "db.internal:5432"}},
+		{spec: "15432:db.internal:5432", parse: ParseLocalForward, want: Forward{Type: ForwardLocal, Host: forwardHost, Port: 15432, Target: "db.internal:5432"}},
+		{spec: "2222:[::1]:22", parse: ParseLocalForward, want: Forward{Type: ForwardLocal, Host: forwardHost, Port: 2222, Target: "[::1]:22"}},
+		{spec: "http", parse: ParseLocalForward, wantErr: true},
+		{spec: "70000", parse: ParseLocalForward, wantErr: true},
+		{spec: "8080 db.internal", parse: ParseLocalForward, wantErr: true},
+		{spec: "8080 db.internal:http", parse: ParseLocalForward, wantErr: true},
+		{spec: "8080 " + strings.Repeat("a", 256) + ":1", parse: ParseLocalForward, wantErr: true},
+		{spec: "9000:127.0.0.1:3000", parse: ParseRemoteForward, want: Forward{Type: ForwardRemote, Host: forwardHost, Port: 9000, Target: "127.0.0.1:3000"}},
+		{spec: "9000 localhost:3000", parse: ParseRemoteForward, want: Forward{Type: ForwardRemote, Host: forwardHost, Port: 9000, Target: "localhost:3000"}},
+		{spec: "9000", parse: ParseRemoteForward, wantErr: true},
+		{spec: " 1080 ", parse: ParseDynamicForward, want: Forward{Type: ForwardDynamic, Host: forwardHost, Port: 1080}},
+		{spec: "1080:x", parse: ParseDynamicForward, wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := tt.parse(tt.spec)
+		if (err != nil) != tt.wantErr || (err == nil && got != tt.want) {
+			t.Errorf("parse(%q) = %+v, %v, want %+v, error %v", tt.spec, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestApplyProfile(t *testing.T) {
+	c := ClientConfig{
+		Command:     "sh",
+		Interactive: true,
+		Forwards:    []Forward{{Type: ForwardLocal, Host: forwardHost, Port: 20096}},
+	}
+	options := []config.Option{
+		{Key: "command", Value: "ssh prod stdiotunnel server", Source: "config:2"},
+		{Key: "interactive", Value: "no", Source: "config:3"},
+		{Key: "localforward", Value: "15432 db.internal:5432", Source: "config:4"},
+		{Key: "dynamicforward", Value: "1080", Source: "config:5"},
+		{Key: "remoteforward", Value: "9000 127.0.0.1:3000", Source: "config:5"},
+		{Key: "priority", Value: "7", Source: "config:6"},
+		{Key: "tunneldown", Value: "512K", Source: "config:7"},
+		{Key: "opentimeout", Value: "5s", Source: "config:8"},
+	}
+	if err := ApplyProfile(&c, options); err != nil {
+		t.Fatal(err)
+	}
+	want := ClientConfig{
+		Command: "ssh prod stdiotunnel server",
+		Forwards: []Forward{
+			{Type: ForwardLocal, Host: forwardHost, Port: 15432, Target: "db.internal:5432"},
+			{Type: ForwardDynamic, Host: forwardHost, Port: 1080},
+			{Type: ForwardRemote, Host: forwardHost, Port: 9000, Target: "127.0.0.1:3000"},
+		},
+		Priority:    7,
+		Limits:      Limits{TunnelDown: 512 * 1024},
+		OpenTimeout: 5 * time.Second,
+	}
+	if !reflect.DeepEqual(c, want) {
+		t.Errorf("ApplyProfile() = %+v, want %+v", c, want)
+	}
+
+	// forwards of `c` are kept if the profile has none
+	c = ClientConfig{Forwards: want.Forwards}
+	if err := ApplyProfile(&c, []config.Option{{Key: "checksum", Value: "yes"}}); err != nil || !c.Checksum || len(c.Forwards) != 3 {
+		t.Errorf("ApplyProfile() = %+v, %v, want checksum and the forwards kept", c, err)
+	}
+
+	for _, tt := range []struct {
+		option  config.Option
+		wantErr string
+	}{
+		{config.Option{Key: "interactive", Value: "maybe", Source: "config:9"}, `config:9: interactive: want yes or no, got "maybe"`},
+		{config.Option{Key: "priority", Value: "256", Source: "config:9"}, "config:9: priority: "},
+		{config.Option{Key: "localforward", Value: "http", Source: "config:9"}, `config:9: localforward: invalid port "http"`},
+		{config.Option{Key: "encoding", Value: "rot13", Source: "config:9"}, "config:9: encoding: "},
+		{config.Option{Key: "forwardagent", Value: "yes", Source: "config:9"}, "config:9: forwardagent: unknown option"},
+	} {
+		err := ApplyProfile(&ClientConfig{}, []config.Option{tt.option})
+		if err == nil || !strings.HasPrefix(err.Error(), tt.wantErr) {
+			t.Errorf("ApplyProfile(%s) error = %v, want %q", tt.option.Key, err, tt.wantErr)
+		}
+	}
+}
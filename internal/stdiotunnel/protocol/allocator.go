@@ -0,0 +1,54 @@
+package protocol
+
+import (
+	"sync"
+	"time"
+
+	"github.com/rectcircle/stdiotunnel/internal/variable"
+)
+
+// vidAllocator - O(1) VID allocator of client
+// never used VIDs are allocated first, released VIDs are reused in FIFO order
+// after waiting variable.VIDQuarantine, so a late segment of a closed virtual connection can't hit a new one
+type vidAllocator struct {
+	mutex sync.Mutex
+	// next never used VID
+	next uint32
+	// released VIDs, oldest first
+	released []releasedVID
+}
+
+type releasedVID struct {
+	VID uint16
+	at  time.Time
+}
+
+func newVIDAllocator() *vidAllocator {
+	// VID = 0 not use
+	return &vidAllocator{next: 1}
+}
+
+// allocate - return false if all VIDs are in use or in quarantine
+func (a *vidAllocator) allocate() (uint16, bool) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if len(a.released) > 0 && time.Since(a.released[0].at) >= variable.VIDQuarantine &&
+		a.released[0].VID <= variable.MaxVirtualConnection {
+		VID := a.released[0].VID
+		a.released = a.released[1:]
+		return VID, true
+	}
+	if a.next <= uint32(variable.MaxVirtualConnection) {
+		VID := uint16(a.next)
+		a.next++
+		return VID, true
+	}
+	return 0, false
+}
+
+// release - put VID into quarantine
+func (a *vidAllocator) release(VID uint16) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.released = append(a.released, releasedVID{VID, time.Now()})
+}
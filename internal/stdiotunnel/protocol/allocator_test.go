@@ -0,0 +1,39 @@
+package protocol
+
+import (
+	"testing"
+	"time"
+
+	"github.com/rectcircle/stdiotunnel/internal/variable"
+)
+
+func Test_vidAllocator(t *testing.T) {
+	MaxVirtualConnection, VIDQuarantine := variable.MaxVirtualConnection, variable.VIDQuarantine
+	defer func() {
+		variable.MaxVirtualConnection, variable.VIDQuarantine = MaxVirtualConnection, VIDQuarantine
+	}()
+	variable.MaxVirtualConnection = 3
+	variable.VIDQuarantine = 50 * time.Millisecond
+
+	a := newVIDAllocator()
+	for want := uint16(1); want <= 3; want++ {
+		if got, ok := a.allocate(); !ok || got != want {
+			t.Errorf("allocate() = %d, %v, want %d, true", got, ok, want)
+		}
+	}
+	if _, ok := a.allocate(); ok {
+		t.Errorf("allocate() want exhausted")
+	}
+	a.release(2)
+	a.release(1)
+	if got, ok := a.allocate(); ok {
+		t.Errorf("allocate() = %d, want no VID in quarantine", got)
+	}
+	time.Sleep(variable.VIDQuarantine)
+	// reuse in release order
+	for _, want := range []uint16{2, 1} {
+		if got, ok := a.allocate(); !ok || got != want {
+			t.Errorf("allocate() = %d, %v, want %d, true", got, ok, want)
+		}
+	}
+}
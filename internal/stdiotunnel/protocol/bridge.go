@@ -4,8 +4,13 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"log"
 	"net"
+	"path"
+	"strconv"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/rectcircle/stdiotunnel/internal/variable"
 	"github.com/rectcircle/stdiotunnel/tools"
@@ -20,7 +25,29 @@ type Bridge struct {
 	WriteClosedError error
 	WriteMutex       *sync.Mutex
 	IsClient         bool
-	Tunnels          []Tunnel
+	// OpenTimeout - client waits MethodAckConn and server dials target within this duration, 0 means no timeout
+	// default is variable.OpenTimeout, change it before serving
+	OpenTimeout time.Duration
+	tunnels     *tunnelTable
+	allocator   *vidAllocator
+	scheduler   *scheduler
+	// egressLimiter - LimitScopeGlobal limit of data sent by this side
+	egressLimiter *RateLimiter
+	groupsMutex   sync.Mutex
+	// groups - LimitScopeGroup limits of data sent by this side
+	groups map[uint16]*RateLimiter
+	// permits - patterns of TunnelOptions.Target the server may dial, see PermitTargets
+	permits []string
+	// remoteMutex - guard the fields of remote forwards below, see remote.go
+	remoteMutex sync.Mutex
+	// remotes - client side remote forwards, indexed by id of MethodListen
+	remotes []remoteForward
+	// listeners - server side listeners of remote forwards
+	listeners []net.Listener
+	// accepted - server side conns accepted by listeners, waiting the client to open tunnels to them
+	accepted      map[uint32]io.ReadWriteCloser
+	acceptToken   uint32
+	remotesClosed bool
 }
 
 // WritableSegmentChannel - writable segment channel
@@ -28,10 +55,32 @@ type WritableSegmentChannel interface {
 	Write(segment Segment) error
 }
 
+// BridgeOptions - options of the stdio link, both sides must use the same
+type BridgeOptions struct {
+	// Checksum - every segment has a sync marker and CRC32C, the decoder skips corrupted bytes to the next valid segment,
+	// a virtual connection which lost segments is closed instead of forwarding corrupted data
+	Checksum bool
+	// OnCorruption - called when the decoder resyncs or finds lost segments, nil means log.Printf
+	OnCorruption func(err error)
+}
+
 // NewBridge - Create a Bridge to serve
 func NewBridge(conn io.ReadWriteCloser, IsClient bool) (bridge *Bridge) {
-	readChannel, readClosed := DeserializeFromReader(conn)
-	WriteChannel, writeClosed, writeMutex := SerializeToWriter(conn)
+	return NewBridgeWithOptions(conn, IsClient, BridgeOptions{})
+}
+
+// NewBridgeWithOptions - Create a Bridge to serve with link options
+func NewBridgeWithOptions(conn io.ReadWriteCloser, IsClient bool, options BridgeOptions) (bridge *Bridge) {
+	var decoder *checksumDecoder
+	if options.Checksum {
+		report := options.OnCorruption
+		if report == nil {
+			report = func(err error) { log.Printf("%s %v\n", tools.If(IsClient, "Client", "Server"), err) }
+		}
+		decoder = newChecksumDecoder(report)
+	}
+	readChannel, readClosed := deserializeFromReader(conn, decoder)
+	WriteChannel, writeClosed, writeMutex := serializeToWriter(conn, options.Checksum)
 	bridge = &Bridge{
 		ReadChannel:      readChannel,
 		ReadClosed:       readClosed,
@@ -39,14 +88,49 @@ func NewBridge(conn io.ReadWriteCloser, IsClient bool) (bridge *Bridge) {
 		WriteClosed:      writeClosed,
 		WriteClosedError: nil,
 
-		WriteMutex: writeMutex,
-		IsClient:   IsClient,
-		Tunnels:    make([]Tunnel, 1, variable.MaxVirtualConnection+1), // connectID = 0 not use
+		WriteMutex:  writeMutex,
+		IsClient:    IsClient,
+		OpenTimeout: variable.OpenTimeout,
+		tunnels:     newTunnelTable(),
+		allocator:   newVIDAllocator(),
+		scheduler:   newScheduler(),
+
+		egressLimiter: NewRateLimiter(0),
+		groups:        map[uint16]*RateLimiter{},
+		accepted:      map[uint32]io.ReadWriteCloser{},
 	}
+	go bridge.schedule()
 	return
 }
 
+// Write - queue a segment to the scheduler, it will be written to WriteChannel in turn
 func (bridge *Bridge) Write(segment Segment) error {
+	if !bridge.scheduler.push(segment) {
+		bridge.WriteMutex.Lock()
+		defer bridge.WriteMutex.Unlock()
+		return bridge.WriteClosedError
+	}
+	return nil
+}
+
+// schedule - move segments selected by the scheduler to WriteChannel, until writer closed
+func (bridge *Bridge) schedule() {
+	for {
+		segment, ok := bridge.scheduler.next()
+		if !ok {
+			return
+		}
+		if segment.Method == MethodSendData {
+			bridge.egressLimiter.Wait(int(segment.PayloadLength))
+		}
+		if err := bridge.writeSegment(segment); err != nil {
+			bridge.scheduler.close()
+			return
+		}
+	}
+}
+
+func (bridge *Bridge) writeSegment(segment Segment) error {
 	bridge.WriteMutex.Lock()
 	defer bridge.WriteMutex.Unlock()
 	select {
@@ -55,57 +139,269 @@ func (bridge *Bridge) Write(segment Segment) error {
 			bridge.WriteClosedError = err
 		}
 	default:
-		bridge.WriteChannel <- segment
+		// WriteChannel is only closed with WriteMutex locked, so it is safe to send here
+		select {
+		case err := <-bridge.WriteClosed:
+			bridge.WriteClosedError = err
+		case bridge.WriteChannel <- segment:
+		}
 	}
 	return bridge.WriteClosedError
 }
 
-// ClientNewTunnel - new a Tunnel from client
+// groupLimiter - get or create the limiter of a group, group 0 has no limiter
+func (bridge *Bridge) groupLimiter(group uint16) *RateLimiter {
+	if group == 0 {
+		return nil
+	}
+	bridge.groupsMutex.Lock()
+	defer bridge.groupsMutex.Unlock()
+	l, ok := bridge.groups[group]
+	if !ok {
+		l = NewRateLimiter(0)
+		bridge.groups[group] = l
+	}
+	return l
+}
+
+// SetRateLimit - set rate limit in bytes per second (0 is unlimited)
+// `VID` is used by LimitScopeTunnel, `group` is used by LimitScopeGroup,
+// DirectionUp is applied locally, DirectionDown is sent to remote
+func (bridge *Bridge) SetRateLimit(scope LimitScope, VID uint16, group uint16, direction Direction, rate uint64) error {
+	if direction == DirectionDown {
+		return bridge.Write(NewSetLimitSegment(scope, VID, group, rate))
+	}
+	return bridge.setEgressLimit(scope, VID, group, rate)
+}
+
+func (bridge *Bridge) setEgressLimit(scope LimitScope, VID uint16, group uint16, rate uint64) error {
+	switch scope {
+	case LimitScopeGlobal:
+		bridge.egressLimiter.SetRate(rate)
+	case LimitScopeGroup:
+		if group == 0 {
+			return errors.New("group 0 can't be limited")
+		}
+		bridge.groupLimiter(group).SetRate(rate)
+	case LimitScopeTunnel:
+		tunnel := bridge.tunnels.get(VID)
+		if tunnel == nil {
+			return fmt.Errorf("tunnel %d not found", VID)
+		}
+		tunnel.limiter.SetRate(rate)
+	default:
+		return fmt.Errorf("unknown limit scope %d", scope)
+	}
+	return nil
+}
+
+// ClientNewTunnel - new a Tunnel from client with default options
 func (bridge *Bridge) ClientNewTunnel(conn io.ReadWriteCloser) (VID uint16, Closed <-chan error) {
-	VID = uint16(len(bridge.Tunnels))
+	return bridge.ClientNewTunnelWithOptions(conn, TunnelOptions{})
+}
+
+// ClientNewTunnelWithOptions - new a Tunnel from client, `options` is sent to server with the request
+func (bridge *Bridge) ClientNewTunnelWithOptions(conn io.ReadWriteCloser, options TunnelOptions) (VID uint16, Closed <-chan error) {
+	return bridge.ClientOpenTunnel(conn, options, nil)
+}
+
+// ClientOpenTunnel - new a Tunnel from client as ClientNewTunnelWithOptions,
+// `onOpen` is called before `conn` is used or closed, with nil when the server acks, or with the reason the tunnel is closed before
+func (bridge *Bridge) ClientOpenTunnel(conn io.ReadWriteCloser, options TunnelOptions, onOpen func(err error)) (VID uint16, Closed <-chan error) {
 	c := make(chan error, 1)
-	tunnel := Tunnel{
-		Conn:   conn,
-		VID:    VID,
-		Closed: c,
-		mutex:  &sync.Mutex{},
-	}
 	Closed = c
-	// register this virtual connetion
-	if VID <= variable.MaxVirtualConnection {
-		bridge.Tunnels = append(bridge.Tunnels, tunnel)
-	} else {
-		for i, t := range bridge.Tunnels {
-			if t.VID == 0 && i != 0 {
-				VID = uint16(i)
-				tunnel.VID = VID
-				bridge.Tunnels[i] = tunnel
-				break
-			}
+	VID, ok := bridge.allocator.allocate()
+	// register this virtual connetion and send new connection request
+	if ok {
+		setKeepAlive(conn, options.KeepAlive)
+		tunnel := bridge.newTunnel(VID, conn, c, options)
+		tunnel.mutex.Lock()
+		tunnel.onOpen = onOpen
+		if bridge.OpenTimeout > 0 {
+			tunnel.openTimer = time.AfterFunc(bridge.OpenTimeout, func() { bridge.openTimeout(tunnel) })
 		}
-	}
-	// send new connection request
-	if VID <= variable.MaxVirtualConnection {
-		bridge.Write(NewRequestSegment(tunnel.VID))
+		tunnel.mutex.Unlock()
+		bridge.Write(NewRequestSegmentWithOptions(VID, options))
 		return
 	}
 	// error
-	c <- fmt.Errorf("Connection exhausted (max = %d)", variable.MaxVirtualConnection)
+	err := &CloseError{Code: CloseCodeExhausted, Message: fmt.Sprintf("Connection exhausted (max = %d)", variable.MaxVirtualConnection)}
+	if onOpen != nil {
+		onOpen(err)
+	}
+	c <- err
 	conn.Close()
 	close(c)
 	return
 }
 
+// openTimeout - client gives up a tunnel which is not acked in time
+func (bridge *Bridge) openTimeout(tunnel *Tunnel) {
+	tunnel.mutex.Lock()
+	pending := !tunnel.opened && !tunnel.closed
+	tunnel.mutex.Unlock()
+	if !pending {
+		return
+	}
+	err := &CloseError{Code: CloseCodeTimeout, Message: fmt.Sprintf("open timeout after %v", bridge.OpenTimeout)}
+	// close at once without waiting remote, the link may be broken
+	tunnel.Close(bridge.IsClient, err)
+	tunnel.NoticeRemoteClose(bridge, tunnel.VID, err)
+}
+
+// PermitTargets - set which TunnelOptions.Target the server may dial, call it before Serve
+// a pattern is `host:port` with path.Match wildcards, e.g. `db.internal:5432`, `10.0.0.*:*` or `*`
+// a tunnel without Target always goes to the default target
+func (bridge *Bridge) PermitTargets(patterns []string) error {
+	if err := CheckTargetPatterns(patterns); err != nil {
+		return err
+	}
+	bridge.permits = patterns
+	return nil
+}
+
+// CheckTargetPatterns - check the syntax of patterns of PermitTargets
+func CheckTargetPatterns(patterns []string) error {
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid permit pattern %q: %w", pattern, err)
+		}
+	}
+	return nil
+}
+
+// resolveTarget - the address a server tunnel dials, `Target` of options if permitted, or the default
+func (bridge *Bridge) resolveTarget(options TunnelOptions, host string, port uint16) (string, uint16, error) {
+	if options.Target == "" {
+		return host, port, nil
+	}
+	permitted := false
+	for _, pattern := range bridge.permits {
+		if ok, _ := path.Match(pattern, options.Target); ok {
+			permitted = true
+			break
+		}
+	}
+	if !permitted {
+		return "", 0, &CloseError{Code: CloseCodePolicyDenied, Message: fmt.Sprintf("target %s is not permitted", options.Target)}
+	}
+	targetHost, targetPort, err := net.SplitHostPort(options.Target)
+	if err != nil {
+		return "", 0, &CloseError{Code: CloseCodePolicyDenied, Message: err.Error()}
+	}
+	p, err := strconv.ParseUint(targetPort, 10, 16)
+	if err != nil {
+		return "", 0, &CloseError{Code: CloseCodePolicyDenied, Message: fmt.Sprintf("invalid target port %q", targetPort)}
+	}
+	return targetHost, uint16(p), nil
+}
+
+// openServerTunnel - create the conn of a pending server tunnel, response `MethodAckConn` or `MethodCloseConn`
+// a tunnel of a remote forward takes the accepted conn instead
+func (bridge *Bridge) openServerTunnel(tunnel *Tunnel, host string, port uint16, createNetConn CreateNetConn) {
+	var conn io.ReadWriteCloser
+	if tunnel.options.Accept != 0 {
+		if conn = bridge.takeAccepted(tunnel.options.Accept); conn == nil {
+			tunnel.StartClose(bridge, bridge.IsClient, &CloseError{Code: CloseCodeTimeout, Message: fmt.Sprintf("accepted conn %d is gone", tunnel.options.Accept)})
+			return
+		}
+	} else {
+		host, port, err := bridge.resolveTarget(tunnel.options, host, port)
+		if err != nil {
+			tunnel.StartClose(bridge, bridge.IsClient, err)
+			return
+		}
+		if conn, err = createNetConn(host, port); err != nil {
+			if !tunnel.IsClosed() {
+				tunnel.StartClose(bridge, bridge.IsClient, err)
+			}
+			return
+		}
+	}
+	if !tunnel.open(conn) {
+		// client has given up
+		conn.Close()
+		return
+	}
+	setKeepAlive(conn, tunnel.options.KeepAlive)
+	// response `MethodAckConn` and start forward
+	bridge.Write(NewAckSegment(tunnel.VID))
+	go tunnel.Forward(bridge, bridge.IsClient)
+}
+
+// newTunnel - create and register a tunnel, it is unregistered (and its VID is released on client) when closed
+func (bridge *Bridge) newTunnel(VID uint16, conn io.ReadWriteCloser, Closed chan<- error, options TunnelOptions) *Tunnel {
+	tunnel := &Tunnel{
+		Conn:    conn,
+		VID:     VID,
+		Closed:  Closed,
+		mutex:   &sync.Mutex{},
+		options: options,
+
+		limiter:      NewRateLimiter(0),
+		groupLimiter: bridge.groupLimiter(options.Group),
+	}
+	tunnel.onClose = func() {
+		if bridge.tunnels.remove(VID, tunnel) {
+			// forget the weight, a later tunnel of the VID may have default priority
+			bridge.scheduler.setPriority(VID, 0)
+		}
+		if bridge.IsClient {
+			bridge.allocator.release(VID)
+		}
+	}
+	bridge.scheduler.setPriority(VID, options.Priority)
+	bridge.tunnels.set(VID, tunnel)
+	if options.IdleTimeout > 0 {
+		tunnel.touch()
+		tunnel.mutex.Lock()
+		tunnel.idleTimer = time.AfterFunc(options.IdleTimeout, func() { bridge.checkIdle(tunnel, options.IdleTimeout) })
+		tunnel.mutex.Unlock()
+	}
+	return tunnel
+}
+
+// checkIdle - close the tunnel if it has no data for `idleTimeout`, or check again later
+func (bridge *Bridge) checkIdle(tunnel *Tunnel, idleTimeout time.Duration) {
+	idle := time.Since(time.Unix(0, atomic.LoadInt64(&tunnel.lastActivity)))
+	tunnel.mutex.Lock()
+	if tunnel.closed {
+		tunnel.mutex.Unlock()
+		return
+	}
+	if idle < idleTimeout {
+		tunnel.idleTimer.Reset(idleTimeout - idle)
+		tunnel.mutex.Unlock()
+		return
+	}
+	tunnel.mutex.Unlock()
+	tools.TraceF("%s tunnel idle timeout: VID = %d\n", tools.If(bridge.IsClient, "Client", "Server"), tunnel.VID)
+	tunnel.StartClose(bridge, bridge.IsClient, &CloseError{Code: CloseCodeTimeout, Message: fmt.Sprintf("idle timeout after %v", idleTimeout)})
+}
+
+// setKeepAlive - enable TCP keepalive of `conn` if it is a TCP conn and `period` > 0
+func setKeepAlive(conn io.ReadWriteCloser, period time.Duration) {
+	type keepAliveConn interface {
+		SetKeepAlive(keepalive bool) error
+		SetKeepAlivePeriod(d time.Duration) error
+	}
+	if c, ok := conn.(keepAliveConn); ok && period > 0 {
+		c.SetKeepAlive(true)
+		c.SetKeepAlivePeriod(period)
+	}
+}
+
 // ClientServe - Client receive from readChannel and do something
 func (bridge *Bridge) ClientServe() {
 	bridge.Serve("", 0, nil)
 }
 
 // ServerServe - Server receive from readChannel and do something
+// dial timeout is Bridge.OpenTimeout
 func (bridge *Bridge) ServerServe(host string, port uint16) {
 	bridge.Serve(host, port, func(host string, port uint16) (io.ReadWriteCloser, error) {
 		addr := tools.ToAddressString(host, port)
-		conn, err := net.Dial("tcp", addr)
+		conn, err := net.DialTimeout("tcp", addr, bridge.OpenTimeout)
 		return conn, err
 	})
 }
@@ -113,6 +409,16 @@ func (bridge *Bridge) ServerServe(host string, port uint16) {
 // CreateNetConn - Create TCP network connection
 type CreateNetConn func(host string, port uint16) (io.ReadWriteCloser, error)
 
+// tunnelMethod - whether a segment of `method` belongs to an existing tunnel,
+// other methods request a tunnel or are of the whole link, whose VID may be 0
+func tunnelMethod(method byte) bool {
+	switch method {
+	case MethodReqConn, MethodHeartbeat, MethodListen, MethodAccept, MethodSetLimit:
+		return false
+	}
+	return true
+}
+
 // Serve - receive from readChannel and do something
 func (bridge *Bridge) Serve(host string, port uint16, createNetConn CreateNetConn) {
 	for segment := range bridge.ReadChannel {
@@ -124,46 +430,53 @@ func (bridge *Bridge) Serve(host string, port uint16, createNetConn CreateNetCon
 			tools.If(bridge.IsClient, "Client", "Server"),
 			segment.VID, segment.Method)
 		// get the tunnel
-		if VID < uint16(len(bridge.Tunnels)) {
-			tunnel = &bridge.Tunnels[VID]
+		tunnel = bridge.tunnels.get(VID)
+		if tunnel == nil && tunnelMethod(segment.Method) {
+			// late segment of a closed virtual connection, or a corrupted or bogus VID
+			tools.TraceF("%s ignore segment of unknown VID = %d, Method = %d\n",
+				tools.If(bridge.IsClient, "Client", "Server"), VID, segment.Method)
+			continue
 		}
 		switch segment.Method {
 		case MethodReqConn: // server handle `MethodReqConn`
-			conn, err := createNetConn(host, port)
-			// register a tunnel
-			t := Tunnel{
-				Conn:   conn,
-				VID:    VID,
-				Closed: make(chan error, 1),
-				mutex:  &sync.Mutex{},
+			options, err := UnmarshalTunnelOptions(segment.Payload)
+			if err != nil {
+				tools.TraceF("Server ignore invalid tunnel options: VID = %d, err = %v\n", VID, err)
 			}
-			if tunnel == nil {
-				bridge.Tunnels = append(bridge.Tunnels, t)
-			} else {
-				bridge.Tunnels[VID] = t
-			}
-			tunnel = &bridge.Tunnels[VID]
-			// response `MethodCloseConn`
-			if err != nil /*&& !bridge.IsClient*/ { // must is Server
-				tunnel.StartClose(bridge, bridge.IsClient, err)
-				continue
-			}
-			// start forward
-			go tunnel.Forward(bridge, bridge.IsClient)
-			// response `MethodAckConn`
-			bridge.Write(NewAckSegment(VID))
+			// register a pending tunnel, a slow dial must not block other tunnels
+			tunnel = bridge.newTunnel(VID, nil, make(chan error, 1), options)
+			go bridge.openServerTunnel(tunnel, host, port, createNetConn)
 		case MethodAckConn: // client handle `MethodAckConn`
-			go tunnel.Forward(bridge, bridge.IsClient)
+			if tunnel.open(nil) {
+				go tunnel.Forward(bridge, bridge.IsClient)
+			}
 		case MethodSendData: // client or server handle `MethodSendData`
 			tunnel.WriteToConn(segment.Payload, bridge, bridge.IsClient)
 		case MethodCloseConn: // client or server handle `MethodCloseConn`
 			var err error = nil
-			if segment.PayloadLength != 0 {
-				err = errors.New(string(segment.Payload))
+			if closeError := parseClosePayload(segment.Payload); closeError != nil {
+				err = closeError
 			}
 			tunnel.HandleCloseConnSegment(bridge, bridge.IsClient, err)
 		case MethodHeartbeat:
 			// Nothing
+		case methodLinkLoss: // the checksummed decoder lost segments of the tunnel, its data has a hole
+			err := &CloseError{Code: CloseCodeError, Message: "segments lost on the stdio link"}
+			tunnel.Close(bridge.IsClient, err)
+			tunnel.NoticeRemoteClose(bridge, VID, err)
+		case MethodListen: // server handle `MethodListen`
+			bridge.handleListen(segment.Payload)
+		case MethodAccept: // client or server handle `MethodAccept`
+			bridge.handleAccept(segment.Payload)
+		case MethodSetLimit: // remote ask to limit what this side sends
+			scope, group, rate, err := ParseSetLimitPayload(segment.Payload)
+			if err == nil {
+				err = bridge.setEgressLimit(scope, VID, group, rate)
+			}
+			if err != nil {
+				tools.TraceF("%s ignore set limit: VID = %d, err = %v\n",
+					tools.If(bridge.IsClient, "Client", "Server"), VID, err)
+			}
 		}
 	}
 	// receive reader Closed
@@ -173,53 +486,113 @@ func (bridge *Bridge) Serve(host string, port uint16, createNetConn CreateNetCon
 		err)
 	// close all virtual connection
 	bridge.CloseTunnels()
+	bridge.closeRemotes()
 }
 
 // CloseTunnels - close all virtual connection
 func (bridge *Bridge) CloseTunnels() {
-	for i := range bridge.Tunnels {
-		tunnel := &bridge.Tunnels[i]
-		if tunnel.VID != 0 {
-			tunnel.Close(bridge.IsClient, errors.New("line break"))
-		}
+	for _, tunnel := range bridge.tunnels.snapshot() {
+		tunnel.Close(bridge.IsClient, errors.New("line break"))
 	}
 }
 
 // Tunnel - handle virtual connection
+// a Tunnel object is stable: it is registered once, its `VID` never changes and its `Conn` is set before opened,
+// after Close it is unregistered and all later calls are no-op
 type Tunnel struct {
+	// lastActivity - unix nano of last data, first field to be 64-bit aligned for atomic
+	lastActivity int64
+
 	Conn   io.ReadWriteCloser
 	VID    uint16
 	Closed chan<- error
 	mutex  *sync.Mutex
+	opened bool
+	closed bool
+	// openTimer - client open timeout, stopped when opened
+	openTimer *time.Timer
+	// idleTimer - check TunnelOptions.IdleTimeout, stopped when closed
+	idleTimer *time.Timer
+	// limiter - LimitScopeTunnel limit of data sent by Forward
+	limiter *RateLimiter
+	// groupLimiter - LimitScopeGroup limit shared with tunnels in the same group, may be nil
+	groupLimiter *RateLimiter
+	// onClose - called once when the tunnel closed
+	onClose func()
+	// onOpen - see Bridge.ClientOpenTunnel, called once when opened or closed
+	onOpen  func(err error)
+	options TunnelOptions
+}
+
+// touch - record data activity for idle timeout
+func (tunnel *Tunnel) touch() {
+	atomic.StoreInt64(&tunnel.lastActivity, time.Now().UnixNano())
+}
+
+// IsClosed - whether the tunnel has closed
+func (tunnel *Tunnel) IsClosed() bool {
+	tunnel.mutex.Lock()
+	defer tunnel.mutex.Unlock()
+	return tunnel.closed
+}
+
+// open - mark the tunnel opened, server set the created `conn`, client call it when `MethodAckConn` received
+// return false if the tunnel has closed meanwhile, e.g. by open timeout
+func (tunnel *Tunnel) open(conn io.ReadWriteCloser) bool {
+	tunnel.mutex.Lock()
+	defer tunnel.mutex.Unlock()
+	if tunnel.closed || tunnel.opened {
+		return false
+	}
+	if conn != nil {
+		tunnel.Conn = conn
+	}
+	tunnel.opened = true
+	if tunnel.openTimer != nil {
+		tunnel.openTimer.Stop()
+	}
+	if tunnel.onOpen != nil {
+		tunnel.onOpen(nil)
+		tunnel.onOpen = nil
+	}
+	return true
 }
 
 // Forward - Client/Server Read from conn and send to WriteChannel
 func (tunnel *Tunnel) Forward(Writable WritableSegmentChannel, IsClient bool) {
+	if tunnel.Conn == nil {
+		return
+	}
 	buffer := make([]byte, 4096)
-	for tunnel.Conn != nil {
+	for {
 		// Read
 		n, err := tunnel.Conn.Read(buffer)
 		if err != nil {
 			tools.TraceF("%s Forward has exit: VID = %d err = %v\n",
 				tools.If(IsClient, "Client", "Server"),
 				tunnel.VID, err)
-			tunnel.mutex.Lock()
-			if tunnel.Conn != nil {
-				tunnel.mutex.Unlock()
+			if !tunnel.IsClosed() {
 				tunnel.StartClose(Writable, IsClient, err)
-			} else {
-				tunnel.mutex.Unlock()
 			}
 			break
 		}
-		Writable.Write(NewSendDataSegment(tunnel.VID, buffer[:n]))
+		tunnel.touch()
+		tunnel.limiter.Wait(n)
+		tunnel.groupLimiter.Wait(n)
+		// data read before close must not follow the MethodCloseConn segment
+		if tunnel.IsClosed() {
+			break
+		}
+		// `buffer` is reused by next Read, but the segment may still wait in the write queue
+		Writable.Write(NewSendDataSegment(tunnel.VID, buffer[:n]).Copy())
 	}
 }
 
 // WriteToConn - write segment.Payload to conn
 func (tunnel *Tunnel) WriteToConn(buffer []byte, Writable WritableSegmentChannel, IsClient bool) (n int, err error) {
 	tunnel.mutex.Lock()
-	if tunnel.Conn != nil {
+	if !tunnel.closed && tunnel.Conn != nil {
+		tunnel.touch()
 		n, err = tunnel.Conn.Write(buffer)
 		tunnel.mutex.Unlock()
 		if err != nil {
@@ -260,21 +633,31 @@ func (tunnel *Tunnel) NoticeRemoteClose(Writable WritableSegmentChannel, VID uin
 	Writable.Write(NewCloseSegment(VID, err))
 }
 
-// Close - close and reset tunnel
+// Close - close the conn and unregister the tunnel
 func (tunnel *Tunnel) Close(IsClient bool, err error) {
 	tunnel.mutex.Lock()
-	defer tunnel.mutex.Unlock()
 	tools.TraceF("%s half has closed: VID = %d\n",
 		tools.If(IsClient, "Client", "Server"),
 		tunnel.VID)
-	if tunnel.VID != 0 {
-		tunnel.VID = 0
-		tunnel.Closed <- err
-		close(tunnel.Closed)
+	if tunnel.closed {
+		tunnel.mutex.Unlock()
+		return
+	}
+	tunnel.closed = true
+	if tunnel.idleTimer != nil {
+		tunnel.idleTimer.Stop()
 	}
+	if tunnel.onOpen != nil {
+		tunnel.onOpen(err)
+		tunnel.onOpen = nil
+	}
+	tunnel.Closed <- err
+	close(tunnel.Closed)
 	if tunnel.Conn != nil {
-		Conn := tunnel.Conn
-		tunnel.Conn = nil
-		Conn.Close()
+		tunnel.Conn.Close()
+	}
+	tunnel.mutex.Unlock()
+	if tunnel.onClose != nil {
+		tunnel.onClose()
 	}
 }
@@ -6,6 +6,8 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"net"
+	"sync"
 	"testing"
 	"time"
 
@@ -364,14 +366,347 @@ func bridgeLineBreak(t *testing.T) {
 	time.Sleep(10 * time.Millisecond)
 }
 
+func bridgeOpenTimeout(t *testing.T) {
+	OpenTimeout, VIDQuarantine := variable.OpenTimeout, variable.VIDQuarantine
+	variable.OpenTimeout = 50 * time.Millisecond
+	// the echoed MethodCloseConn of the timed out VID arrives late, it must not hit a reused VID
+	variable.VIDQuarantine = time.Minute
+	defer func() { variable.OpenTimeout, variable.VIDQuarantine = OpenTimeout, VIDQuarantine }()
+	pipeForClient, pipeForServer := NewSimulatedConn()
+	client := NewBridge(pipeForClient, true)
+	server := NewBridge(pipeForServer, false)
+	dialing := make(chan bool)
+	// start a Serve, dial hangs until the client gives up
+	go func() {
+		server.Serve("localhost", 10007, func(host string, port uint16) (io.ReadWriteCloser, error) {
+			<-dialing
+			return NewEchoService(), nil
+		})
+	}()
+	// start a client
+	go func() {
+		client.ClientServe()
+	}()
+	_, clientConnForServer := NewSimulatedConn()
+	VID, Closed := client.ClientNewTunnel(clientConnForServer)
+	err := <-Closed
+	var closeError *CloseError
+	if !errors.As(err, &closeError) || closeError.Code != CloseCodeTimeout {
+		t.Errorf("Closed want timeout, got %v", err)
+	}
+	log.Printf("Close a Virtual Connection VID = %d, err = %v", VID, err)
+	close(dialing)
+	// the hung dial does not block other tunnels
+	clientConnForClient2, clientConnForServer2 := NewSimulatedConn()
+	_, Closed2 := client.ClientNewTunnel(clientConnForServer2)
+	checkEchoService(clientConnForClient2, t)
+	<-Closed2
+}
+
+func bridgeIdleTimeout(t *testing.T) {
+	pipeForClient, pipeForServer := NewSimulatedConn()
+	client := NewBridge(pipeForClient, true)
+	server := NewBridge(pipeForServer, false)
+	go server.Serve("localhost", 10007, simulateCreateNetConn)
+	go client.ClientServe()
+	clientConnForClient, clientConnForServer := NewSimulatedConn()
+	VID, Closed := client.ClientNewTunnelWithOptions(clientConnForServer, TunnelOptions{IdleTimeout: 100 * time.Millisecond})
+	// activity keeps the tunnel open
+	for i := 0; i < 4; i++ {
+		checkEchoServiceNoClose(clientConnForClient, t)
+		time.Sleep(50 * time.Millisecond)
+	}
+	select {
+	case err := <-Closed:
+		t.Fatalf("active tunnel closed: %v", err)
+	default:
+	}
+	err := <-Closed
+	var closeError *CloseError
+	if !errors.As(err, &closeError) || closeError.Code != CloseCodeTimeout {
+		t.Errorf("Closed want idle timeout, got %v", err)
+	}
+	log.Printf("Close a Virtual Connection VID = %d, err = %v", VID, err)
+	if _, err := clientConnForClient.Read(make([]byte, 1)); err == nil {
+		t.Errorf("conn should be closed after idle timeout")
+	}
+	// wait server side Forward exit
+	time.Sleep(10 * time.Millisecond)
+}
+
+func bridgeTarget(t *testing.T) {
+	pipeForClient, pipeForServer := NewSimulatedConn()
+	client := NewBridge(pipeForClient, true)
+	server := NewBridge(pipeForServer, false)
+	if err := server.PermitTargets([]string{"db.internal:5432", "10.0.0.*:*"}); err != nil {
+		t.Fatal(err)
+	}
+	dialed := make(chan string, 3)
+	go server.Serve("localhost", 10007, func(host string, port uint16) (io.ReadWriteCloser, error) {
+		dialed <- tools.ToAddressString(host, port)
+		return NewEchoService(), nil
+	})
+	go client.ClientServe()
+	for _, c := range []struct{ target, dial string }{
+		{"", "localhost:10007"},
+		{"db.internal:5432", "db.internal:5432"},
+		{"10.0.0.8:80", "10.0.0.8:80"},
+	} {
+		clientConnForClient, clientConnForServer := NewSimulatedConn()
+		_, Closed := client.ClientNewTunnelWithOptions(clientConnForServer, TunnelOptions{Target: c.target})
+		checkEchoService(clientConnForClient, t)
+		<-Closed
+		if got := <-dialed; got != c.dial {
+			t.Errorf("target %q dial %s, want %s", c.target, got, c.dial)
+		}
+	}
+	// a target not permitted is denied without dialing
+	_, clientConnForServer := NewSimulatedConn()
+	_, Closed := client.ClientNewTunnelWithOptions(clientConnForServer, TunnelOptions{Target: "db.internal:22"})
+	err := <-Closed
+	var closeError *CloseError
+	if !errors.As(err, &closeError) || closeError.Code != CloseCodePolicyDenied {
+		t.Errorf("Closed want policy denied, got %v", err)
+	}
+	select {
+	case got := <-dialed:
+		t.Errorf("denied target dialed %s", got)
+	default:
+	}
+}
+
+func bridgePriority(t *testing.T) {
+	pipeForClient, pipeForServer := NewSimulatedConn()
+	client := NewBridge(pipeForClient, true)
+	server := NewBridge(pipeForServer, false)
+	go server.Serve("localhost", 10007, simulateCreateNetConn)
+	go client.ClientServe()
+	clientConnForClient, clientConnForServer := NewSimulatedConn()
+	_, Closed := client.ClientNewTunnelWithOptions(clientConnForServer, TunnelOptions{Priority: 5})
+	checkEchoService(clientConnForClient, t)
+	<-Closed
+	// wait server side close
+	time.Sleep(10 * time.Millisecond)
+	for _, bridge := range []*Bridge{client, server} {
+		bridge.scheduler.mutex.Lock()
+		if len(bridge.scheduler.weights) != 0 {
+			t.Errorf("weights of closed tunnels are kept: %v", bridge.scheduler.weights)
+		}
+		bridge.scheduler.mutex.Unlock()
+	}
+}
+
+// freePort - a loopback port nobody listens on
+func freePort(t *testing.T) (listener net.Listener, port uint16) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return listener, uint16(listener.Addr().(*net.TCPAddr).Port)
+}
+
+// dialRetry - dial a port which is listened asynchronously
+func dialRetry(t *testing.T, port uint16) net.Conn {
+	for i := 0; ; i++ {
+		conn, err := net.Dial("tcp", tools.ToAddressString("127.0.0.1", port))
+		if err == nil {
+			return conn
+		}
+		if i == 100 {
+			t.Fatalf("dial remote forward: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func bridgeRemoteForward(t *testing.T) {
+	pipeForClient, pipeForServer := NewSimulatedConn()
+	client := NewBridge(pipeForClient, true)
+	server := NewBridge(pipeForServer, false)
+	go server.Serve("localhost", 10007, simulateCreateNetConn)
+	go client.ClientServe()
+	// the target of the client echoes
+	target, _ := freePort(t)
+	defer target.Close()
+	go func() {
+		for {
+			conn, err := target.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	reports := make(chan error, 3)
+	report := func(err error) { reports <- err }
+
+	listener, port := freePort(t)
+	listener.Close()
+	client.RemoteListen(port, target.Addr().String(), TunnelOptions{}, nil, report)
+	checkEchoService(dialRetry(t, port), t)
+
+	// the client can't dial the target, the server closes the accepted conn
+	closed, _ := freePort(t)
+	closed.Close()
+	listener, port = freePort(t)
+	listener.Close()
+	client.RemoteListen(port, closed.Addr().String(), TunnelOptions{}, nil, report)
+	conn := dialRetry(t, port)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("accepted conn of a refused target read err = %v, want EOF", err)
+	}
+	if err := <-reports; NewCloseError(err).Code != CloseCodeRefused {
+		t.Errorf("report %v, want refused", err)
+	}
+
+	// the server can't listen a port in use
+	listener, port = freePort(t)
+	defer listener.Close()
+	client.RemoteListen(port, target.Addr().String(), TunnelOptions{}, nil, report)
+	select {
+	case err := <-reports:
+		var closeError *CloseError
+		if !errors.As(err, &closeError) {
+			t.Errorf("report %v, want a close error of the server", err)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("listen failure is not reported")
+	}
+
+	// listeners are closed with the link
+	pipeForClient.Close()
+	for i := 0; i < 100; i++ {
+		server.remoteMutex.Lock()
+		closed := server.remotesClosed
+		server.remoteMutex.Unlock()
+		if closed {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if conn, err := net.Dial("tcp", server.listeners[0].Addr().String()); err == nil {
+		conn.Close()
+		t.Errorf("remote forward listener is open after line break")
+	}
+}
+
+// bridgeServeNoTunnel - segments of tunnel methods with VID 0 or an unknown VID are ignored
+func bridgeServeNoTunnel(t *testing.T) {
+	for _, isClient := range []bool{true, false} {
+		pipe, peer := NewSimulatedConn()
+		bridge := NewBridge(pipe, isClient)
+		segments := make(chan Segment, 8)
+		bridge.ReadChannel = segments
+		for _, VID := range []uint16{0, 7} {
+			for _, method := range []byte{MethodAckConn, MethodSendData, MethodCloseConn, methodLinkLoss} {
+				segments <- Segment{Version: ProtocolVersion1, Method: method, VID: VID, Payload: []byte("x")}
+			}
+		}
+		close(segments)
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			bridge.Serve("localhost", 10007, simulateCreateNetConn)
+		}()
+		// Serve ends after the segments and the line break
+		peer.Close()
+		pipe.Close()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Errorf("Serve of client %v does not end", isClient)
+		}
+	}
+}
+
 func TestBridge_Serve(t *testing.T) {
 	// exp()
 	EnableTraceLog := variable.EnableTraceLog
 	variable.EnableTraceLog = true
+	// boundary cases reuse VIDs immediately
+	VIDQuarantine := variable.VIDQuarantine
+	variable.VIDQuarantine = 0
 	t.Run("smoke", bridgeServeSmoke)
 	t.Run("boundary connetion exhausted", bridgeServeBoundaryConnetionExhausted)
 	t.Run("boundary server start connection error", bridgeServeBoundaryServerStartConnError)
 	t.Run("boundary server close", bridgeServeBoundaryServerClose)
 	t.Run("boundary line break", bridgeLineBreak)
+	t.Run("boundary open timeout", bridgeOpenTimeout)
+	t.Run("boundary idle timeout", bridgeIdleTimeout)
+	t.Run("target", bridgeTarget)
+	t.Run("priority", bridgePriority)
+	t.Run("remote forward", bridgeRemoteForward)
+	t.Run("boundary no tunnel", bridgeServeNoTunnel)
 	variable.EnableTraceLog = EnableTraceLog
+	variable.VIDQuarantine = VIDQuarantine
+}
+
+func TestBridge_Stress(t *testing.T) {
+	MaxVirtualConnection, VIDQuarantine := variable.MaxVirtualConnection, variable.VIDQuarantine
+	defer func() {
+		variable.MaxVirtualConnection, variable.VIDQuarantine = MaxVirtualConnection, VIDQuarantine
+	}()
+	// VIDs are recycled many times
+	variable.MaxVirtualConnection = 256
+	variable.VIDQuarantine = 0
+	const (
+		total      = 3000
+		concurrent = 200
+	)
+	pipeForClient, pipeForServer := NewSimulatedConn()
+	client := NewBridge(pipeForClient, true)
+	server := NewBridge(pipeForServer, false)
+	go server.Serve("localhost", 10007, simulateCreateNetConn)
+	go client.ClientServe()
+
+	semaphore := make(chan bool, concurrent)
+	var wg sync.WaitGroup
+	for i := 0; i < total; i++ {
+		semaphore <- true
+		wg.Add(1)
+		go func(i int) {
+			defer func() {
+				<-semaphore
+				wg.Done()
+			}()
+			clientConnForClient, clientConnForServer := NewSimulatedConn()
+			_, Closed := client.ClientNewTunnel(clientConnForServer)
+			want := []byte(fmt.Sprintf("tunnel-%d", i))
+			clientConnForClient.Write(want)
+			got := make([]byte, 0, len(want))
+			buffer := make([]byte, 64)
+			for len(got) < len(want) {
+				n, err := clientConnForClient.Read(buffer)
+				if err != nil {
+					t.Errorf("tunnel %d Read() err = %v", i, err)
+					return
+				}
+				got = append(got, buffer[:n]...)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("tunnel %d got %q, want %q", i, got, want)
+			}
+			clientConnForClient.Close()
+			select {
+			case <-Closed:
+			case <-time.After(10 * time.Second):
+				t.Errorf("tunnel %d not closed", i)
+			}
+		}(i)
+	}
+	wg.Wait()
+	// all tunnels are unregistered
+	for i := 0; i < 100 && (len(client.tunnels.snapshot()) != 0 || len(server.tunnels.snapshot()) != 0); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := len(client.tunnels.snapshot()); n != 0 {
+		t.Errorf("client has %d tunnels after all closed", n)
+	}
+	if n := len(server.tunnels.snapshot()); n != 0 {
+		t.Errorf("server has %d tunnels after all closed", n)
+	}
 }
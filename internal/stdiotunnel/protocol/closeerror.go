@@ -0,0 +1,96 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"syscall"
+)
+
+// CloseCode - why a virtual connection is closed or rejected
+type CloseCode byte
+
+const (
+	// CloseCodeNormal - closed by one side, e.g. EOF
+	CloseCodeNormal = CloseCode(iota)
+	// CloseCodeRefused - server target refused the connection
+	CloseCodeRefused
+	// CloseCodeUnreachable - server target host or network is unreachable, or can't be resolved
+	CloseCodeUnreachable
+	// CloseCodePolicyDenied - server does not allow the connection
+	CloseCodePolicyDenied
+	// CloseCodeTimeout - open or idle timeout
+	CloseCodeTimeout
+	// CloseCodeExhausted - no VID available
+	CloseCodeExhausted
+	// CloseCodeError - other error
+	CloseCodeError
+)
+
+var closeCodeNames = []string{"normal", "refused", "unreachable", "policy denied", "timeout", "exhausted", "error"}
+
+func (c CloseCode) String() string {
+	if int(c) < len(closeCodeNames) {
+		return closeCodeNames[c]
+	}
+	return fmt.Sprintf("code %d", c)
+}
+
+// CloseError - error carried by MethodCloseConn segment, payload is `code(1) | message`
+// a payload starts with a printable byte is free text from an old peer, it is parsed as CloseCodeError
+type CloseError struct {
+	Code    CloseCode
+	Message string
+}
+
+func (e *CloseError) Error() string {
+	if e.Message == "" {
+		return e.Code.String()
+	}
+	return e.Code.String() + ": " + e.Message
+}
+
+// NewCloseError - classify `err` to a CloseError, nil is nil
+func NewCloseError(err error) *CloseError {
+	if err == nil {
+		return nil
+	}
+	var closeError *CloseError
+	if errors.As(err, &closeError) {
+		return closeError
+	}
+	code := CloseCodeError
+	var (
+		netError net.Error
+		dnsError *net.DNSError
+	)
+	switch {
+	case err == io.EOF:
+		code = CloseCodeNormal
+	case errors.Is(err, syscall.ECONNREFUSED):
+		code = CloseCodeRefused
+	case errors.Is(err, syscall.EHOSTUNREACH), errors.Is(err, syscall.ENETUNREACH), errors.As(err, &dnsError):
+		code = CloseCodeUnreachable
+	case errors.Is(err, os.ErrDeadlineExceeded), errors.As(err, &netError) && netError.Timeout():
+		code = CloseCodeTimeout
+	}
+	return &CloseError{Code: code, Message: err.Error()}
+}
+
+// marshal - payload of MethodCloseConn segment
+func (e *CloseError) marshal() []byte {
+	return append([]byte{byte(e.Code)}, e.Message...)
+}
+
+// parseClosePayload - parse payload of MethodCloseConn segment, empty payload is nil
+func parseClosePayload(payload []byte) *CloseError {
+	if len(payload) == 0 {
+		return nil
+	}
+	if payload[0] >= 0x20 {
+		return &CloseError{Code: CloseCodeError, Message: string(payload)}
+	}
+	return &CloseError{Code: CloseCode(payload[0]), Message: string(payload[1:])}
+}
@@ -0,0 +1,45 @@
+package protocol
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestNewCloseError(t *testing.T) {
+	_, refused := net.Dial("tcp", "127.0.0.1:1")
+	_, timeout := net.DialTimeout("tcp", "10.255.255.1:9", time.Nanosecond)
+	tests := []struct {
+		name string
+		err  error
+		want CloseCode
+	}{
+		{name: "EOF", err: io.EOF, want: CloseCodeNormal},
+		{name: "refused", err: refused, want: CloseCodeRefused},
+		{name: "unreachable", err: &net.DNSError{Err: "no such host", Name: "nowhere.invalid"}, want: CloseCodeUnreachable},
+		{name: "timeout", err: timeout, want: CloseCodeTimeout},
+		{name: "other", err: errors.New("boom"), want: CloseCodeError},
+		{name: "keep code", err: &CloseError{Code: CloseCodePolicyDenied}, want: CloseCodePolicyDenied},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := NewCloseError(tt.err)
+			if got.Code != tt.want {
+				t.Errorf("NewCloseError(%v).Code = %v, want %v", tt.err, got.Code, tt.want)
+			}
+			// round trip through MethodCloseConn segment
+			segment := NewCloseSegment(1, tt.err)
+			if parsed := parseClosePayload(segment.Payload); *parsed != *got {
+				t.Errorf("parseClosePayload() = %v, want %v", parsed, got)
+			}
+		})
+	}
+	if got := parseClosePayload([]byte("free text")); got.Code != CloseCodeError || got.Message != "free text" {
+		t.Errorf("parseClosePayload() of an old peer = %v", got)
+	}
+	if got := parseClosePayload(nil); got != nil {
+		t.Errorf("parseClosePayload(nil) = %v, want nil", got)
+	}
+}
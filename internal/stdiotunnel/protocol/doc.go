@@ -3,12 +3,16 @@ Package protocol - MIT License Copyright (c) 2020, Rectcircle. All rights reserv
 
 This is the project core code - protocol implementation
 
-1. Segment - attach control protocol header to data chunk
+1. Segment - attach control protocol header to data chunk, optionally with a sync marker and CRC32C (BridgeOptions.Checksum)
 
 2. Bridge - handle Segment
 
 3. Tunnel - virtual connection
 
+4. scheduler - share the stdio link between tunnels by deficit round-robin, weighted by TunnelOptions.Priority
+
+5. remote forward - the server listens (MethodListen) and announces accepted conns (MethodAccept), the client opens their tunnels
+
 Architecture diagram:
                        Client                                                 Server
                                                                          +--------------+
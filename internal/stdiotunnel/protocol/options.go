@@ -0,0 +1,127 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"time"
+)
+
+const (
+	// optionKeyPriority - TunnelOptions.Priority, 1 byte
+	optionKeyPriority = byte(iota + 1)
+	// optionKeyGroup - TunnelOptions.Group, 2 bytes
+	optionKeyGroup
+	// optionKeyIdleTimeout - TunnelOptions.IdleTimeout in milliseconds, 4 bytes
+	optionKeyIdleTimeout
+	// optionKeyKeepAlive - TunnelOptions.KeepAlive in milliseconds, 4 bytes
+	optionKeyKeepAlive
+	// optionKeyTarget - TunnelOptions.Target, at most MaxTargetLength bytes
+	optionKeyTarget
+	// optionKeyAccept - TunnelOptions.Accept, 4 bytes
+	optionKeyAccept
+)
+
+// MaxTargetLength - max length of TunnelOptions.Target
+const MaxTargetLength = 255
+
+// TunnelOptions - options of a virtual connection, the client sends them in the MethodReqConn payload
+// encoding is a list of `key(1 byte) | length(1 byte) | value`, unknown keys are skipped
+type TunnelOptions struct {
+	// Priority - scheduling weight on the shared stdio link, 0 means variable.DefaultTunnelPriority
+	Priority uint8
+	// Group - rate limit group, 0 means no group, the client uses one group per listener
+	Group uint16
+	// IdleTimeout - both sides close the tunnel after no data for this duration, 0 means never
+	IdleTimeout time.Duration
+	// KeepAlive - TCP keepalive period of the conn on both sides, for silent protocols without IdleTimeout, 0 means system default
+	KeepAlive time.Duration
+	// Target - `host:port` the server dials instead of its default target, it must be permitted by the server
+	Target string
+	// Accept - token of a conn accepted by a remote forward listener of the server, the server forwards the tunnel to it instead of dialing,
+	// 0 means none, see Bridge.RemoteListen
+	Accept uint32
+}
+
+// Marshal - Marshal TunnelOptions to []byte, zero value options are omitted
+func (o *TunnelOptions) Marshal() []byte {
+	data := []byte{}
+	if o.Priority != 0 {
+		data = append(data, optionKeyPriority, 1, o.Priority)
+	}
+	if o.Group != 0 {
+		data = append(data, optionKeyGroup, 2, byte(o.Group>>8), byte(o.Group))
+	}
+	data = appendDurationOption(data, optionKeyIdleTimeout, o.IdleTimeout)
+	data = appendDurationOption(data, optionKeyKeepAlive, o.KeepAlive)
+	if o.Target != "" && len(o.Target) <= MaxTargetLength {
+		data = append(data, optionKeyTarget, byte(len(o.Target)))
+		data = append(data, o.Target...)
+	}
+	if o.Accept != 0 {
+		data = append(data, optionKeyAccept, 4, 0, 0, 0, 0)
+		binary.BigEndian.PutUint32(data[len(data)-4:], o.Accept)
+	}
+	return data
+}
+
+func appendDurationOption(data []byte, key byte, d time.Duration) []byte {
+	if d <= 0 {
+		return data
+	}
+	ms := d.Milliseconds()
+	if ms > math.MaxUint32 {
+		ms = math.MaxUint32
+	} else if ms == 0 {
+		ms = 1
+	}
+	data = append(data, key, 4, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(data[len(data)-4:], uint32(ms))
+	return data
+}
+
+func parseDurationOption(value []byte) (time.Duration, error) {
+	if len(value) != 4 {
+		return 0, fmt.Errorf("invalid duration option length %d", len(value))
+	}
+	return time.Duration(binary.BigEndian.Uint32(value)) * time.Millisecond, nil
+}
+
+// UnmarshalTunnelOptions - Unmarshal TunnelOptions from MethodReqConn payload
+func UnmarshalTunnelOptions(data []byte) (options TunnelOptions, err error) {
+	for i := 0; i < len(data); {
+		if i+2 > len(data) || i+2+int(data[i+1]) > len(data) {
+			return options, fmt.Errorf("truncated tunnel option at %d", i)
+		}
+		key, value := data[i], data[i+2:i+2+int(data[i+1])]
+		i += 2 + len(value)
+		switch key {
+		case optionKeyPriority:
+			if len(value) != 1 {
+				return options, fmt.Errorf("invalid priority option length %d", len(value))
+			}
+			options.Priority = value[0]
+		case optionKeyGroup:
+			if len(value) != 2 {
+				return options, fmt.Errorf("invalid group option length %d", len(value))
+			}
+			options.Group = binary.BigEndian.Uint16(value)
+		case optionKeyIdleTimeout:
+			if options.IdleTimeout, err = parseDurationOption(value); err != nil {
+				return
+			}
+		case optionKeyKeepAlive:
+			if options.KeepAlive, err = parseDurationOption(value); err != nil {
+				return
+			}
+		case optionKeyTarget:
+			options.Target = string(value)
+		case optionKeyAccept:
+			if len(value) != 4 {
+				return options, fmt.Errorf("invalid accept option length %d", len(value))
+			}
+			options.Accept = binary.BigEndian.Uint32(value)
+		}
+	}
+	return
+}
@@ -0,0 +1,88 @@
+package protocol
+
+import (
+	"sync"
+	"time"
+
+	"github.com/rectcircle/stdiotunnel/internal/variable"
+)
+
+// Direction - direction of a rate limit, relative to the local side of the Bridge
+type Direction byte
+
+const (
+	// DirectionUp - data sent by this side, enforced locally
+	DirectionUp = Direction(iota)
+	// DirectionDown - data received by this side, enforced by remote after a MethodSetLimit segment
+	DirectionDown
+)
+
+// RateLimiter - token bucket limiter, rate is bytes per second, 0 means unlimited
+// a nil *RateLimiter never limits
+type RateLimiter struct {
+	mutex  sync.Mutex
+	rate   uint64
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimiter - new a RateLimiter, rate is bytes per second, 0 means unlimited
+func NewRateLimiter(rate uint64) *RateLimiter {
+	l := &RateLimiter{}
+	l.SetRate(rate)
+	return l
+}
+
+// SetRate - change rate at runtime, take effect from next Wait
+func (l *RateLimiter) SetRate(rate uint64) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.rate = rate
+	l.tokens = l.burst()
+	l.last = time.Now()
+}
+
+// Rate - current rate, 0 means unlimited
+func (l *RateLimiter) Rate() uint64 {
+	if l == nil {
+		return 0
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.rate
+}
+
+// burst - bucket size, one second of rate but at least one max segment
+func (l *RateLimiter) burst() float64 {
+	if l.rate < uint64(variable.MaxSegmentPayload) {
+		return float64(variable.MaxSegmentPayload)
+	}
+	return float64(l.rate)
+}
+
+// Wait - take n bytes from the bucket, block until the bucket is not in debt
+func (l *RateLimiter) Wait(n int) {
+	if l == nil {
+		return
+	}
+	l.mutex.Lock()
+	if l.rate == 0 {
+		l.mutex.Unlock()
+		return
+	}
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * float64(l.rate)
+	if burst := l.burst(); l.tokens > burst {
+		l.tokens = burst
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	var wait time.Duration
+	if l.tokens < 0 {
+		wait = time.Duration(-l.tokens / float64(l.rate) * float64(time.Second))
+	}
+	l.mutex.Unlock()
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+}
@@ -0,0 +1,58 @@
+package protocol
+
+import (
+	"testing"
+	"time"
+
+	"github.com/rectcircle/stdiotunnel/internal/variable"
+)
+
+func TestRateLimiter(t *testing.T) {
+	t.Run("nil and unlimited never wait", func(t *testing.T) {
+		var l *RateLimiter
+		start := time.Now()
+		l.Wait(1 << 30)
+		NewRateLimiter(0).Wait(1 << 30)
+		if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+			t.Errorf("Wait() want no wait, got %v", elapsed)
+		}
+	})
+
+	t.Run("limit rate after burst", func(t *testing.T) {
+		rate := uint64(variable.MaxSegmentPayload * 10)
+		l := NewRateLimiter(rate)
+		start := time.Now()
+		// burst is one second of rate, the rest half second is limited
+		for sent := 0; sent < int(rate)*3/2; sent += variable.MaxSegmentPayload {
+			l.Wait(variable.MaxSegmentPayload)
+		}
+		if elapsed := time.Since(start); elapsed < 400*time.Millisecond || elapsed > 2*time.Second {
+			t.Errorf("Wait() want about 500ms, got %v", elapsed)
+		}
+	})
+
+	t.Run("set rate at runtime", func(t *testing.T) {
+		l := NewRateLimiter(1)
+		l.SetRate(0)
+		start := time.Now()
+		l.Wait(1 << 30)
+		if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+			t.Errorf("Wait() want no wait after SetRate(0), got %v", elapsed)
+		}
+		if l.Rate() != 0 {
+			t.Errorf("Rate() want 0, got %d", l.Rate())
+		}
+	})
+}
+
+func TestSetLimitSegment(t *testing.T) {
+	segment := NewSetLimitSegment(LimitScopeGroup, 3, 7, 1<<40)
+	got := handleBytes(&Segment{}, &segmentState{}, segment.Serialize())
+	if len(got) != 1 || got[0].VID != 3 {
+		t.Fatalf("handleBytes() = %v, want %v", got, segment)
+	}
+	scope, group, rate, err := ParseSetLimitPayload(got[0].Payload)
+	if err != nil || scope != LimitScopeGroup || group != 7 || rate != 1<<40 {
+		t.Errorf("ParseSetLimitPayload() = %v, %v, %v, %v", scope, group, rate, err)
+	}
+}
@@ -0,0 +1,174 @@
+package protocol
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/rectcircle/stdiotunnel/tools"
+)
+
+// A remote forward is opened by the server: the server listens, the client dials the target and opens the tunnel
+//
+//             client                                         server
+//        RemoteListen  ---- MethodListen(id, port) ---->  listen on loopback port
+//                      <--- MethodAccept(id, token) ----  accept a conn
+//        dial target   ---- MethodReqConn(Accept) ----->  the tunnel takes the accepted conn instead of dialing
+//
+// VIDs are still allocated by the client, so tunnels of both directions share one VID space
+
+// remoteHost - due to security, the server only listens on loopback for remote forwards
+const remoteHost = "127.0.0.1"
+
+// remoteForward - a remote forward of the client, see RemoteListen
+type remoteForward struct {
+	target   string
+	options  TunnelOptions
+	onTunnel func(conn net.Conn, VID uint16, Closed <-chan error)
+	report   func(err error)
+}
+
+// RemoteListen - ask the server to listen on its loopback `port`, every accepted conn is forwarded to `target` dialed by the client,
+// with `options` of the tunnel, `onTunnel` is called with every opened tunnel if not nil, it may block until the tunnel closed,
+// `report` is called when the server can't listen or the client can't dial `target`
+func (bridge *Bridge) RemoteListen(port uint16, target string, options TunnelOptions, onTunnel func(conn net.Conn, VID uint16, Closed <-chan error), report func(err error)) error {
+	// the server never dials for a remote forward
+	options.Target = ""
+	bridge.remoteMutex.Lock()
+	id := uint16(len(bridge.remotes))
+	bridge.remotes = append(bridge.remotes, remoteForward{target: target, options: options, onTunnel: onTunnel, report: report})
+	bridge.remoteMutex.Unlock()
+	return bridge.Write(NewListenSegment(id, port))
+}
+
+// handleAccept - client: forward a conn accepted by the server, or report the listen failure
+// server: close an accepted conn which the client can't forward
+func (bridge *Bridge) handleAccept(payload []byte) {
+	id, token, closeError, err := ParseAcceptPayload(payload)
+	if err != nil {
+		tools.TraceF("%s ignore accept: err = %v\n", tools.If(bridge.IsClient, "Client", "Server"), err)
+		return
+	}
+	if !bridge.IsClient {
+		if conn := bridge.takeAccepted(token); conn != nil {
+			tools.TraceF("Server close accepted conn: token = %d, err = %v\n", token, closeError)
+			conn.Close()
+		}
+		return
+	}
+	bridge.remoteMutex.Lock()
+	if int(id) >= len(bridge.remotes) {
+		bridge.remoteMutex.Unlock()
+		tools.TraceF("Client ignore accept of unknown remote forward %d\n", id)
+		return
+	}
+	remote := bridge.remotes[id]
+	bridge.remoteMutex.Unlock()
+	if token == 0 {
+		if remote.report != nil {
+			remote.report(fmt.Errorf("server can't listen: %w", closeError))
+		}
+		return
+	}
+	go bridge.forwardAccepted(id, token, remote)
+}
+
+// forwardAccepted - client dials the target of a remote forward and opens a tunnel to the accepted conn `token`
+func (bridge *Bridge) forwardAccepted(id uint16, token uint32, remote remoteForward) {
+	conn, err := net.DialTimeout("tcp", remote.target, bridge.OpenTimeout)
+	if err != nil {
+		bridge.Write(NewAcceptSegment(id, token, err))
+		if remote.report != nil {
+			remote.report(fmt.Errorf("dial %s: %w", remote.target, err))
+		}
+		return
+	}
+	options := remote.options
+	options.Accept = token
+	VID, Closed := bridge.ClientNewTunnelWithOptions(conn, options)
+	if remote.onTunnel != nil {
+		remote.onTunnel(conn, VID, Closed)
+	}
+}
+
+// handleListen - server listens for a remote forward of the client, the listener is closed when Serve ends
+func (bridge *Bridge) handleListen(payload []byte) {
+	id, port, err := ParseListenPayload(payload)
+	if err != nil || bridge.IsClient {
+		tools.TraceF("%s ignore listen: err = %v\n", tools.If(bridge.IsClient, "Client", "Server"), err)
+		return
+	}
+	listener, err := net.Listen("tcp", tools.ToAddressString(remoteHost, port))
+	if err != nil {
+		bridge.Write(NewAcceptSegment(id, 0, err))
+		return
+	}
+	bridge.remoteMutex.Lock()
+	if bridge.remotesClosed {
+		bridge.remoteMutex.Unlock()
+		listener.Close()
+		return
+	}
+	bridge.listeners = append(bridge.listeners, listener)
+	bridge.remoteMutex.Unlock()
+	go bridge.acceptRemote(id, listener)
+}
+
+// acceptRemote - server keeps accepted conns until the client opens tunnels to them, or Bridge.OpenTimeout
+func (bridge *Bridge) acceptRemote(id uint16, listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		bridge.remoteMutex.Lock()
+		if bridge.remotesClosed {
+			bridge.remoteMutex.Unlock()
+			conn.Close()
+			return
+		}
+		bridge.acceptToken++
+		if bridge.acceptToken == 0 {
+			// 0 means the listen failed
+			bridge.acceptToken++
+		}
+		token := bridge.acceptToken
+		bridge.accepted[token] = conn
+		bridge.remoteMutex.Unlock()
+		if bridge.OpenTimeout > 0 {
+			time.AfterFunc(bridge.OpenTimeout, func() {
+				if conn := bridge.takeAccepted(token); conn != nil {
+					conn.Close()
+				}
+			})
+		}
+		bridge.Write(NewAcceptSegment(id, token, nil))
+	}
+}
+
+// takeAccepted - unregister and return the accepted conn `token`, nil if it is gone
+func (bridge *Bridge) takeAccepted(token uint32) io.ReadWriteCloser {
+	bridge.remoteMutex.Lock()
+	defer bridge.remoteMutex.Unlock()
+	conn, ok := bridge.accepted[token]
+	if !ok {
+		return nil
+	}
+	delete(bridge.accepted, token)
+	return conn
+}
+
+// closeRemotes - server closes the listeners of remote forwards and the conns not taken by tunnels
+func (bridge *Bridge) closeRemotes() {
+	bridge.remoteMutex.Lock()
+	defer bridge.remoteMutex.Unlock()
+	bridge.remotesClosed = true
+	for _, listener := range bridge.listeners {
+		listener.Close()
+	}
+	for token, conn := range bridge.accepted {
+		conn.Close()
+		delete(bridge.accepted, token)
+	}
+}
@@ -0,0 +1,156 @@
+package protocol
+
+import (
+	"sync"
+
+	"github.com/rectcircle/stdiotunnel/internal/variable"
+)
+
+// scheduler - share the stdio link between virtual connections by deficit round-robin
+// every VID has its own FIFO queue, so the segment order of one virtual connection is kept,
+// a VID with priority N may send N quantums per round
+type scheduler struct {
+	mutex   sync.Mutex
+	cond    *sync.Cond
+	queues  map[uint16]*segmentQueue
+	weights map[uint16]int
+	// VIDs which have queued segments, in round-robin order
+	active []uint16
+	closed bool
+}
+
+type segmentQueue struct {
+	segments []Segment
+	// queued payload bytes
+	size    int
+	deficit int
+	// whether this queue has received its quantum in the current visit
+	visited bool
+}
+
+func newScheduler() *scheduler {
+	s := &scheduler{
+		queues:  map[uint16]*segmentQueue{},
+		weights: map[uint16]int{},
+	}
+	s.cond = sync.NewCond(&s.mutex)
+	return s
+}
+
+// schedulerQuantum - bytes a priority 1 queue may send per round, any chunk fits in one quantum
+func schedulerQuantum() int {
+	return variable.MaxSegmentPayload + SegmentHeaderLength
+}
+
+// setPriority - set scheduling weight of VID, 0 means variable.DefaultTunnelPriority
+func (s *scheduler) setPriority(VID uint16, priority uint8) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if priority == 0 {
+		delete(s.weights, VID)
+	} else {
+		s.weights[VID] = int(priority)
+	}
+}
+
+func (s *scheduler) weight(VID uint16) int {
+	if w, ok := s.weights[VID]; ok {
+		return w
+	}
+	return int(variable.DefaultTunnelPriority)
+}
+
+// push - queue a segment, large MethodSendData payload is split into chunks of variable.MaxSegmentPayload
+// data segments block while the queue of the VID is full, return false if scheduler has closed
+func (s *scheduler) push(segment Segment) bool {
+	if segment.Method != MethodSendData || int(segment.PayloadLength) <= variable.MaxSegmentPayload {
+		return s.pushOne(segment)
+	}
+	for start := 0; start < int(segment.PayloadLength); start += variable.MaxSegmentPayload {
+		end := start + variable.MaxSegmentPayload
+		if end > int(segment.PayloadLength) {
+			end = int(segment.PayloadLength)
+		}
+		if !s.pushOne(NewSendDataSegment(segment.VID, segment.Payload[start:end])) {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *scheduler) pushOne(segment Segment) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	// control segments never wait, MethodCloseConn must not be blocked by a stuck queue
+	for segment.Method == MethodSendData && s.queue(segment.VID).size >= variable.MaxTunnelQueueSize && !s.closed {
+		s.cond.Wait()
+	}
+	if s.closed {
+		return false
+	}
+	q := s.queue(segment.VID)
+	if len(q.segments) == 0 {
+		s.active = append(s.active, segment.VID)
+	}
+	q.segments = append(q.segments, segment)
+	q.size += int(segment.PayloadLength)
+	s.cond.Broadcast()
+	return true
+}
+
+// queue - get or create the queue of VID, drained queues are dropped by next
+func (s *scheduler) queue(VID uint16) *segmentQueue {
+	q := s.queues[VID]
+	if q == nil {
+		q = &segmentQueue{}
+		s.queues[VID] = q
+	}
+	return q
+}
+
+// next - block until a segment is selected, return false if scheduler has closed
+func (s *scheduler) next() (Segment, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for {
+		for len(s.active) == 0 && !s.closed {
+			s.cond.Wait()
+		}
+		if s.closed {
+			return Segment{}, false
+		}
+		VID := s.active[0]
+		q := s.queues[VID]
+		if !q.visited {
+			q.deficit += schedulerQuantum() * s.weight(VID)
+			q.visited = true
+		}
+		segment := q.segments[0]
+		cost := SegmentHeaderLength + int(segment.PayloadLength)
+		if cost > q.deficit {
+			// this visit is used up, move to the tail of the round
+			q.visited = false
+			s.active = append(s.active[1:], VID)
+			continue
+		}
+		q.deficit -= cost
+		q.segments[0] = Segment{}
+		q.segments = q.segments[1:]
+		q.size -= int(segment.PayloadLength)
+		if len(q.segments) == 0 {
+			// an idle queue does not keep its deficit
+			s.active = s.active[1:]
+			delete(s.queues, VID)
+		}
+		s.cond.Broadcast()
+		return segment, true
+	}
+}
+
+// close - wake up all waiting push and next
+func (s *scheduler) close() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.closed = true
+	s.cond.Broadcast()
+}
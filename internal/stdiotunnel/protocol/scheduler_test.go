@@ -0,0 +1,94 @@
+package protocol
+
+import (
+	"testing"
+	"time"
+
+	"github.com/rectcircle/stdiotunnel/internal/variable"
+)
+
+func Test_scheduler(t *testing.T) {
+	t.Run("chunk large payload", func(t *testing.T) {
+		s := newScheduler()
+		payload := randomBytes(1)
+		for len(payload) < 2*variable.MaxSegmentPayload+100 {
+			payload = append(payload, randomBytes(1000)...)
+		}
+		go s.push(NewSendDataSegment(1, payload))
+		got := []byte{}
+		for len(got) < len(payload) {
+			segment, _ := s.next()
+			if int(segment.PayloadLength) > variable.MaxSegmentPayload {
+				t.Errorf("segment.PayloadLength want <= %d, got %d", variable.MaxSegmentPayload, segment.PayloadLength)
+			}
+			got = append(got, segment.Payload...)
+		}
+		if string(got) != string(payload) {
+			t.Errorf("chunks are not in order")
+		}
+	})
+
+	t.Run("round-robin between tunnels", func(t *testing.T) {
+		s := newScheduler()
+		chunk := make([]byte, variable.MaxSegmentPayload)
+		// VID 1 is a bulk transfer and queued first
+		for i := 0; i < 3; i++ {
+			s.push(NewSendDataSegment(1, chunk))
+		}
+		s.push(NewSendDataSegment(2, []byte("ls\n")))
+		s.push(NewCloseSegment(2, nil))
+		want := []uint16{1, 2, 2, 1, 1}
+		for i, VID := range want {
+			segment, _ := s.next()
+			if segment.VID != VID {
+				t.Errorf("next()[%d].VID want %d, got %d", i, VID, segment.VID)
+			}
+		}
+	})
+
+	t.Run("priority", func(t *testing.T) {
+		s := newScheduler()
+		s.setPriority(1, 2)
+		chunk := make([]byte, variable.MaxSegmentPayload)
+		for i := 0; i < 3; i++ {
+			s.push(NewSendDataSegment(1, chunk))
+			s.push(NewSendDataSegment(2, chunk))
+		}
+		want := []uint16{1, 1, 2, 1, 2, 2}
+		for i, VID := range want {
+			segment, _ := s.next()
+			if segment.VID != VID {
+				t.Errorf("next()[%d].VID want %d, got %d", i, VID, segment.VID)
+			}
+		}
+	})
+
+	t.Run("close wakes up", func(t *testing.T) {
+		s := newScheduler()
+		done := make(chan bool)
+		go func() {
+			_, ok := s.next()
+			done <- ok
+		}()
+		s.close()
+		if <-done {
+			t.Errorf("next() want false after close")
+		}
+		if s.push(NewHeartbeatSegment()) {
+			t.Errorf("push() want false after close")
+		}
+	})
+}
+
+func TestTunnelOptions(t *testing.T) {
+	want := TunnelOptions{Priority: 7, Group: 300, IdleTimeout: time.Hour, KeepAlive: 15 * time.Second, Target: "db.internal:5432", Accept: 1 << 20}
+	// unknown option keys are skipped
+	data := append([]byte{0xff, 2, 0, 0}, want.Marshal()...)
+	got, err := UnmarshalTunnelOptions(data)
+	if err != nil || got != want {
+		t.Errorf("UnmarshalTunnelOptions() = %v, %v, want %v", got, err, want)
+	}
+	if _, err := UnmarshalTunnelOptions([]byte{optionKeyPriority, 1}); err == nil {
+		t.Errorf("UnmarshalTunnelOptions() want error for truncated data")
+	}
+}
@@ -3,8 +3,13 @@ package protocol
 import (
 	"bytes"
 	"encoding/binary"
+	"fmt"
+	"hash/crc32"
 	"io"
 	"sync"
+	"time"
+
+	"github.com/rectcircle/stdiotunnel/internal/variable"
 )
 
 const (
@@ -23,8 +28,43 @@ const (
 	MethodCloseConn
 	// MethodHeartbeat - Heartbeat
 	MethodHeartbeat
+	// MethodSetLimit - ask remote to limit what it sends, payload is `scope(1) | group(2) | rate(8)`
+	MethodSetLimit
+	// MethodListen - client asks server to listen for a remote forward, VID is 0, payload is `id(2) | port(2)`
+	MethodListen
+	// MethodAccept - VID is 0, payload is `id(2) | token(4) | close error`
+	// server to client: a conn is accepted by the listener `id`, or the listen failed if token is 0
+	// client to server: the client can't forward the accepted conn `token`, the server closes it
+	MethodAccept
 )
 
+// LimitScope - what a rate limit applies to
+type LimitScope byte
+
+const (
+	// LimitScopeGlobal - all data on the stdio link
+	LimitScopeGlobal = LimitScope(iota)
+	// LimitScopeGroup - all tunnels with the same TunnelOptions.Group, a group is a client listener
+	LimitScopeGroup
+	// LimitScopeTunnel - one virtual connection
+	LimitScopeTunnel
+)
+
+// SegmentHeaderLength - serialized length of the fixed Segment header
+const SegmentHeaderLength = 8
+
+// SegmentSyncMarker - starts every checksummed segment, the decoder resyncs to it after corruption
+var SegmentSyncMarker = []byte{0xf3, 0x5e, 0x9a, 0x2c}
+
+// A checksummed segment is `marker(4) | seq(2) | header(8) | CRC32C of seq and header(4) | payload | CRC32C of payload(4)`
+// seq counts the segments of a VID in one direction, from 0 at MethodReqConn or MethodAckConn, a gap means segments were lost
+const checksumHeaderLength = 4 + 2 + SegmentHeaderLength + 4
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// methodLinkLoss - never on the link, the checksummed decoder reports that segments of the VID were lost
+const methodLinkLoss = byte(0xff)
+
 // A kind of stdio multiplexing private protocol implementation
 
 // Segment - this is data Segment on stdio, use Big-Endian
@@ -50,6 +90,15 @@ func NewRequestSegment(VID uint16) Segment {
 	}
 }
 
+// NewRequestSegmentWithOptions - new a Segment with method = MethodReqConn, payload is the marshaled `options`
+func NewRequestSegmentWithOptions(VID uint16, options TunnelOptions) Segment {
+	segment := NewRequestSegment(VID)
+	payload := options.Marshal()
+	segment.PayloadLength = uint32(len(payload))
+	segment.Payload = payload
+	return segment
+}
+
 // NewAckSegment - new a Segment with method = MethodAckConn
 func NewAckSegment(VID uint16) Segment {
 	return Segment{
@@ -70,7 +119,7 @@ func NewSendDataSegment(VID uint16, payload []byte) Segment {
 	}
 }
 
-// NewCloseSegment - new a Segment with method = MethodCloseConn
+// NewCloseSegment - new a Segment with method = MethodCloseConn, `err` is classified by NewCloseError
 func NewCloseSegment(VID uint16, err error) (segment Segment) {
 	segment = Segment{
 		Version: ProtocolVersion1,
@@ -78,7 +127,7 @@ func NewCloseSegment(VID uint16, err error) (segment Segment) {
 		VID:     VID,
 	}
 	if err != nil {
-		payload := []byte(err.Error())
+		payload := NewCloseError(err).marshal()
 		segment.PayloadLength = uint32(len(payload))
 		segment.Payload = payload
 	}
@@ -93,6 +142,75 @@ func NewHeartbeatSegment() Segment {
 	}
 }
 
+// NewSetLimitSegment - new a Segment with method = MethodSetLimit
+// `VID` is used by LimitScopeTunnel, `group` is used by LimitScopeGroup, `rate` is bytes per second
+func NewSetLimitSegment(scope LimitScope, VID uint16, group uint16, rate uint64) Segment {
+	payload := make([]byte, 11)
+	payload[0] = byte(scope)
+	binary.BigEndian.PutUint16(payload[1:3], group)
+	binary.BigEndian.PutUint64(payload[3:11], rate)
+	return Segment{
+		Version:       ProtocolVersion1,
+		Method:        MethodSetLimit,
+		VID:           VID,
+		PayloadLength: uint32(len(payload)),
+		Payload:       payload,
+	}
+}
+
+// ParseSetLimitPayload - parse payload of MethodSetLimit segment
+func ParseSetLimitPayload(payload []byte) (scope LimitScope, group uint16, rate uint64, err error) {
+	if len(payload) < 11 {
+		return 0, 0, 0, fmt.Errorf("invalid set limit payload length %d", len(payload))
+	}
+	return LimitScope(payload[0]), binary.BigEndian.Uint16(payload[1:3]), binary.BigEndian.Uint64(payload[3:11]), nil
+}
+
+// NewListenSegment - new a Segment with method = MethodListen
+func NewListenSegment(id uint16, port uint16) Segment {
+	payload := make([]byte, 4)
+	binary.BigEndian.PutUint16(payload[0:2], id)
+	binary.BigEndian.PutUint16(payload[2:4], port)
+	return Segment{
+		Version:       ProtocolVersion1,
+		Method:        MethodListen,
+		PayloadLength: uint32(len(payload)),
+		Payload:       payload,
+	}
+}
+
+// ParseListenPayload - parse payload of MethodListen segment
+func ParseListenPayload(payload []byte) (id uint16, port uint16, err error) {
+	if len(payload) < 4 {
+		return 0, 0, fmt.Errorf("invalid listen payload length %d", len(payload))
+	}
+	return binary.BigEndian.Uint16(payload[0:2]), binary.BigEndian.Uint16(payload[2:4]), nil
+}
+
+// NewAcceptSegment - new a Segment with method = MethodAccept, `err` is classified by NewCloseError
+func NewAcceptSegment(id uint16, token uint32, err error) Segment {
+	payload := make([]byte, 6)
+	binary.BigEndian.PutUint16(payload[0:2], id)
+	binary.BigEndian.PutUint32(payload[2:6], token)
+	if err != nil {
+		payload = append(payload, NewCloseError(err).marshal()...)
+	}
+	return Segment{
+		Version:       ProtocolVersion1,
+		Method:        MethodAccept,
+		PayloadLength: uint32(len(payload)),
+		Payload:       payload,
+	}
+}
+
+// ParseAcceptPayload - parse payload of MethodAccept segment, `closeError` is nil without error
+func ParseAcceptPayload(payload []byte) (id uint16, token uint32, closeError *CloseError, err error) {
+	if len(payload) < 6 {
+		return 0, 0, nil, fmt.Errorf("invalid accept payload length %d", len(payload))
+	}
+	return binary.BigEndian.Uint16(payload[0:2]), binary.BigEndian.Uint32(payload[2:6]), parseClosePayload(payload[6:]), nil
+}
+
 // Equal - Equal
 func (s *Segment) Equal(other *Segment) bool {
 	return s.Version == other.Version &&
@@ -112,28 +230,109 @@ func (s Segment) Copy() Segment {
 
 // Serialize - Serialize Segment to []byte
 func (s *Segment) Serialize() []byte {
-	data := make([]byte, 8+s.PayloadLength)
-	data[0] = s.Version
-	data[1] = s.Method
-	binary.BigEndian.PutUint16(data[2:4], s.VID)
-	binary.BigEndian.PutUint32(data[4:8], s.PayloadLength)
-	copy(data[8:], s.Payload)
-	return data
+	return s.appendSerialized(make([]byte, 0, SegmentHeaderLength+s.PayloadLength))
+}
+
+// appendSerialized - append the serialized Segment to `data` and return the extended slice
+func (s *Segment) appendSerialized(data []byte) []byte {
+	data = s.appendHeader(data)
+	return append(data, s.Payload[:s.PayloadLength]...)
+}
+
+func (s *Segment) appendHeader(data []byte) []byte {
+	var header [SegmentHeaderLength]byte
+	header[0] = s.Version
+	header[1] = s.Method
+	binary.BigEndian.PutUint16(header[2:4], s.VID)
+	binary.BigEndian.PutUint32(header[4:8], s.PayloadLength)
+	return append(data, header[:]...)
+}
+
+// appendChecksummed - append the checksummed Segment with sequence number `seq` to `data` and return the extended slice
+func (s *Segment) appendChecksummed(data []byte, seq uint16) []byte {
+	data = append(data, SegmentSyncMarker...)
+	start := len(data)
+	data = append(data, byte(seq>>8), byte(seq))
+	data = s.appendHeader(data)
+	data = appendUint32(data, crc32.Checksum(data[start:], castagnoli))
+	data = append(data, s.Payload[:s.PayloadLength]...)
+	return appendUint32(data, crc32.Checksum(s.Payload[:s.PayloadLength], castagnoli))
+}
+
+func appendUint32(data []byte, v uint32) []byte {
+	return append(data, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+// segmentSequencer - the next sequence number of every VID in one direction of a checksummed link
+type segmentSequencer map[uint16]uint16
+
+// next - the sequence number of a segment to send
+func (seqs segmentSequencer) next(s *Segment) uint16 {
+	if s.Method == MethodReqConn || s.Method == MethodAckConn {
+		delete(seqs, s.VID)
+	}
+	seq := seqs[s.VID]
+	seqs[s.VID] = seq + 1
+	if s.Method == MethodCloseConn {
+		delete(seqs, s.VID)
+	}
+	return seq
+}
+
+// check - whether segments of the VID were lost before a received segment with sequence number `seq`
+func (seqs segmentSequencer) check(s *Segment, seq uint16) (lost bool) {
+	expected, tracked := seqs[s.VID]
+	if s.Method == MethodReqConn || s.Method == MethodAckConn {
+		tracked = false
+	}
+	seqs[s.VID] = seq + 1
+	if s.Method == MethodCloseConn {
+		delete(seqs, s.VID)
+	}
+	return tracked && seq != expected
 }
 
 // SerializeToWriter - start a goroutine to receive Segment from channel and write to `writer`
+// queued segments are coalesced into one write, the batch is flushed as soon as the queue is idle,
+// or when it reaches `variable.MaxWriteBatchSize`, or when it has been collected for `variable.MaxWriteBatchDelay`
 // if write() error, `closed` will receive a error and close the `closed` channel
 func SerializeToWriter(writer io.Writer) (chan<- Segment, <-chan error, *sync.Mutex) {
-	segmentChannel := make(chan Segment)
+	return serializeToWriter(writer, false)
+}
+
+// serializeToWriter - SerializeToWriter, segments are checksummed if `checksum`
+func serializeToWriter(writer io.Writer, checksum bool) (chan<- Segment, <-chan error, *sync.Mutex) {
+	segmentChannel := make(chan Segment, variable.WriteQueueLength)
 	closed := make(chan error, 1)
 	writeMutex := &sync.Mutex{}
+	seqs := segmentSequencer{}
+	appendSegment := func(batch []byte, s *Segment) []byte {
+		if checksum {
+			return s.appendChecksummed(batch, seqs.next(s))
+		}
+		return s.appendSerialized(batch)
+	}
 	go func() {
+		batch := make([]byte, 0, variable.MaxWriteBatchSize)
 		for {
 			s := <-segmentChannel
-			_, err := writer.Write(s.Serialize())
+			batch = appendSegment(batch[:0], &s)
+			deadline := time.Now().Add(variable.MaxWriteBatchDelay)
+		coalesce:
+			for len(batch) < variable.MaxWriteBatchSize && time.Now().Before(deadline) {
+				select {
+				case s := <-segmentChannel:
+					batch = appendSegment(batch, &s)
+				default:
+					// queue is idle, flush now to keep interactive latency low
+					break coalesce
+				}
+			}
+			_, err := writer.Write(batch)
 			if err != nil {
-				writeMutex.Lock()
+				// report before lock, a sender may hold the lock and wait for it
 				closed <- err
+				writeMutex.Lock()
 				close(closed)
 				close(segmentChannel)
 				writeMutex.Unlock()
@@ -148,6 +347,11 @@ func SerializeToWriter(writer io.Writer) (chan<- Segment, <-chan error, *sync.Mu
 // DeserializeFromReader - start a goroutine to read and Deserialize `reader` and send to `segment`
 // if read() error, `closed` will receive a error and close the `closed` channel
 func DeserializeFromReader(reader io.Reader) (<-chan Segment, <-chan error) {
+	return deserializeFromReader(reader, nil)
+}
+
+// deserializeFromReader - DeserializeFromReader, segments are checksummed if `checksum` is not nil
+func deserializeFromReader(reader io.Reader, checksum *checksumDecoder) (<-chan Segment, <-chan error) {
 	segmentChannel := make(chan Segment)
 	closed := make(chan error, 1)
 	go func() {
@@ -162,7 +366,13 @@ func DeserializeFromReader(reader io.Reader) (<-chan Segment, <-chan error) {
 				close(segmentChannel)
 				return
 			}
-			for _, segment := range handleBytes(&cache, &state, buffer[:n]) {
+			var segments []Segment
+			if checksum != nil {
+				segments = checksum.handleBytes(buffer[:n])
+			} else {
+				segments = handleBytes(&cache, &state, buffer[:n])
+			}
+			for _, segment := range segments {
 				segmentChannel <- segment
 			}
 		}
@@ -241,3 +451,88 @@ func handleBytes(cache *Segment, state *segmentState, buffer []byte) []Segment {
 	}
 	return result
 }
+
+// checksumDecoder - decode checksummed segments, skip corrupted bytes to the next valid segment
+type checksumDecoder struct {
+	buffer []byte
+	seqs   segmentSequencer
+	// skipped, reason - corrupted bytes since the last valid segment
+	skipped int
+	reason  string
+	// report - called with the corruption when the decoder resyncs
+	report func(err error)
+}
+
+func newChecksumDecoder(report func(err error)) *checksumDecoder {
+	return &checksumDecoder{seqs: segmentSequencer{}, report: report}
+}
+
+// skip - drop `n` corrupted bytes
+func (d *checksumDecoder) skip(n int, reason string) {
+	if d.skipped == 0 {
+		d.reason = reason
+	}
+	d.skipped += n
+	d.buffer = d.buffer[n:]
+}
+
+func (d *checksumDecoder) handleBytes(data []byte) []Segment {
+	d.buffer = append(d.buffer, data...)
+	result := []Segment{}
+	for {
+		i := bytes.Index(d.buffer, SegmentSyncMarker)
+		if i < 0 {
+			// keep a possible beginning of the marker
+			if keep := len(SegmentSyncMarker) - 1; len(d.buffer) > keep {
+				d.skip(len(d.buffer)-keep, "no sync marker")
+			}
+			break
+		}
+		if i > 0 {
+			d.skip(i, "no sync marker")
+		}
+		if len(d.buffer) < checksumHeaderLength {
+			break
+		}
+		header := d.buffer[len(SegmentSyncMarker):checksumHeaderLength]
+		if crc32.Checksum(header[:len(header)-4], castagnoli) != binary.BigEndian.Uint32(header[len(header)-4:]) {
+			// the marker may be a part of payload, resync from the next byte
+			d.skip(1, "header checksum mismatch")
+			continue
+		}
+		segment := Segment{
+			Version:       header[2],
+			Method:        header[3],
+			VID:           binary.BigEndian.Uint16(header[4:6]),
+			PayloadLength: binary.BigEndian.Uint32(header[6:10]),
+		}
+		if segment.PayloadLength > uint32(variable.MaxSegmentPayload) {
+			// a valid header checksum of a corrupted length, waiting the payload would stall the link
+			d.skip(1, "payload length too large")
+			continue
+		}
+		if uint64(len(d.buffer)) < uint64(checksumHeaderLength)+uint64(segment.PayloadLength)+4 {
+			break
+		}
+		end := checksumHeaderLength + int(segment.PayloadLength)
+		payload := d.buffer[checksumHeaderLength:end]
+		if crc32.Checksum(payload, castagnoli) != binary.BigEndian.Uint32(d.buffer[end:end+4]) {
+			d.skip(1, "payload checksum mismatch")
+			continue
+		}
+		if d.skipped > 0 {
+			d.report(fmt.Errorf("stdio link corrupted (%s), skipped %d bytes to resync", d.reason, d.skipped))
+			d.skipped = 0
+		}
+		segment.Payload = append([]byte{}, payload...)
+		if d.seqs.check(&segment, binary.BigEndian.Uint16(header[:2])) && segment.VID != 0 {
+			d.report(fmt.Errorf("stdio link lost segments of VID = %d", segment.VID))
+			result = append(result, Segment{Version: ProtocolVersion1, Method: methodLinkLoss, VID: segment.VID})
+		}
+		result = append(result, segment)
+		d.buffer = d.buffer[end+4:]
+	}
+	// do not keep the array of consumed bytes
+	d.buffer = append([]byte{}, d.buffer...)
+	return result
+}
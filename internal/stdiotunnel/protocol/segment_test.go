@@ -1,8 +1,12 @@
 package protocol
 
 import (
+	"bytes"
+	"hash/crc32"
 	"math/rand"
 	"sort"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -82,3 +86,172 @@ func Test_handleBytes(t *testing.T) {
 		}
 	})
 }
+
+func Test_checksumDecoder(t *testing.T) {
+	seqs := segmentSequencer{}
+	encode := func(s Segment) []byte {
+		return s.appendChecksummed(nil, seqs.next(&s))
+	}
+	segments := []Segment{
+		NewRequestSegment(1),
+		NewSendDataSegment(1, []byte("first")),
+		NewSendDataSegment(2, []byte("other")),
+		NewSendDataSegment(1, []byte("corrupted")),
+		NewSendDataSegment(1, []byte("after")),
+		NewCloseSegment(1, nil),
+	}
+	frames := [][]byte{}
+	for _, s := range segments {
+		frames = append(frames, encode(s))
+	}
+	t.Run("clean", func(t *testing.T) {
+		reports := []error{}
+		decoder := newChecksumDecoder(func(err error) { reports = append(reports, err) })
+		got := []Segment{}
+		// one byte at a time, a segment spans many reads
+		for _, b := range bytes.Join(frames, nil) {
+			got = append(got, decoder.handleBytes([]byte{b})...)
+		}
+		if len(got) != len(segments) || len(reports) != 0 {
+			t.Fatalf("got %d segments and %v, want %d segments", len(got), reports, len(segments))
+		}
+		for i := range segments {
+			if !segments[i].Equal(&got[i]) {
+				t.Errorf("got[%d] = %v, want %v", i, got[i], segments[i])
+			}
+		}
+	})
+	t.Run("corrupted", func(t *testing.T) {
+		link := [][]byte{
+			frames[0],
+			// noise before a segment
+			[]byte("noise"),
+			frames[1],
+			// a dropped byte
+			frames[2][:len(frames[2])-1],
+			// a flipped byte in payload
+			append(append([]byte{}, frames[3][:checksumHeaderLength]...), append([]byte("c0rrupted"), frames[3][checksumHeaderLength+9:]...)...),
+			frames[4],
+			frames[5],
+		}
+		reports := []error{}
+		decoder := newChecksumDecoder(func(err error) { reports = append(reports, err) })
+		got := decoder.handleBytes(bytes.Join(link, nil))
+		methods := []byte{}
+		for _, s := range got {
+			methods = append(methods, s.Method)
+		}
+		// segment 2 and 3 are dropped, the loss of VID 1 is found at segment 4
+		want := []byte{MethodReqConn, MethodSendData, methodLinkLoss, MethodSendData, MethodCloseConn}
+		if !bytes.Equal(methods, want) {
+			t.Errorf("methods = %v, want %v", methods, want)
+		}
+		if len(got) == len(want) && string(got[3].Payload) != "after" {
+			t.Errorf("payload after resync = %q", got[3].Payload)
+		}
+		// noise, then corrupted segment 2 and 3 and the loss
+		if len(reports) != 3 {
+			t.Errorf("reports = %v, want 3", reports)
+		}
+	})
+	t.Run("payload length too large", func(t *testing.T) {
+		// the header checksum is valid, but the length is corrupted before it is checksummed
+		huge := Segment{Version: ProtocolVersion1, Method: MethodSendData, VID: 3, PayloadLength: 1 << 31}
+		header := append([]byte{}, SegmentSyncMarker...)
+		header = append(header, 0, 0)
+		header = huge.appendHeader(header)
+		header = appendUint32(header, crc32.Checksum(header[len(SegmentSyncMarker):], castagnoli))
+		reports := []error{}
+		decoder := newChecksumDecoder(func(err error) { reports = append(reports, err) })
+		// the next segment is not held by waiting 2GB of payload
+		got := decoder.handleBytes(append(header, frames[0]...))
+		if len(got) != 1 || !got[0].Equal(&segments[0]) {
+			t.Errorf("got %v, want the segment after the corrupted header", got)
+		}
+		if len(reports) != 1 || !strings.Contains(reports[0].Error(), "payload length too large") {
+			t.Errorf("reports = %v, want payload length too large", reports)
+		}
+	})
+}
+
+// gatedWriter - record every Write, the first Write notices `entered` and blocks until `gate` is closed
+type gatedWriter struct {
+	mutex   sync.Mutex
+	entered chan bool
+	gate    chan bool
+	writes  [][]byte
+	wrote   chan bool
+}
+
+func newGatedWriter() *gatedWriter {
+	return &gatedWriter{
+		entered: make(chan bool, 1),
+		gate:    make(chan bool),
+		wrote:   make(chan bool, 100),
+	}
+}
+
+func (w *gatedWriter) Write(p []byte) (int, error) {
+	w.mutex.Lock()
+	first := len(w.writes) == 0
+	w.writes = append(w.writes, append([]byte{}, p...))
+	w.mutex.Unlock()
+	if first {
+		w.entered <- true
+		<-w.gate
+	}
+	w.wrote <- true
+	return len(p), nil
+}
+
+func TestSerializeToWriter(t *testing.T) {
+	t.Run("coalesce queued segments", func(t *testing.T) {
+		writer := newGatedWriter()
+		segmentChannel, _, _ := SerializeToWriter(writer)
+		wants := []Segment{}
+		for i := 0; i < 10; i++ {
+			s := NewSendDataSegment(uint16(i+1), randomBytes(100))
+			wants = append(wants, s)
+			segmentChannel <- s
+			if i == 0 {
+				// first write only has the first segment, others are queued meanwhile
+				<-writer.entered
+			}
+		}
+		close(writer.gate)
+		<-writer.wrote
+		<-writer.wrote
+		writer.mutex.Lock()
+		defer writer.mutex.Unlock()
+		if len(writer.writes) != 2 {
+			t.Fatalf("len(writes) want 2, got %d", len(writer.writes))
+		}
+		got := handleBytes(&Segment{}, &segmentState{}, bytes.Join(writer.writes, nil))
+		if len(got) != len(wants) {
+			t.Fatalf("len(got) want %d, got %d", len(wants), len(got))
+		}
+		for i := range wants {
+			if !wants[i].Equal(&got[i]) {
+				t.Errorf("wants[i] != got[i]: %v != %v : (i = %d)", wants[i], got[i], i)
+			}
+		}
+	})
+
+	t.Run("flush on idle", func(t *testing.T) {
+		writer := newGatedWriter()
+		close(writer.gate)
+		segmentChannel, _, _ := SerializeToWriter(writer)
+		want := NewHeartbeatSegment()
+		segmentChannel <- want
+		select {
+		case <-writer.wrote:
+		case <-time.After(time.Second):
+			t.Fatalf("a single segment should be flushed without waiting for more")
+		}
+		writer.mutex.Lock()
+		defer writer.mutex.Unlock()
+		if !bytes.Equal(writer.writes[0], want.Serialize()) {
+			t.Errorf("write want %v, got %v", want.Serialize(), writer.writes[0])
+		}
+	})
+}
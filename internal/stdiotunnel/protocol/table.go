@@ -0,0 +1,50 @@
+package protocol
+
+import (
+	"sync"
+)
+
+// tunnelTable - concurrency safe VID -> *Tunnel registry
+type tunnelTable struct {
+	mutex   sync.RWMutex
+	tunnels map[uint16]*Tunnel
+}
+
+func newTunnelTable() *tunnelTable {
+	return &tunnelTable{tunnels: map[uint16]*Tunnel{}}
+}
+
+// get - return nil if VID is not registered
+func (t *tunnelTable) get(VID uint16) *Tunnel {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	return t.tunnels[VID]
+}
+
+func (t *tunnelTable) set(VID uint16, tunnel *Tunnel) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.tunnels[VID] = tunnel
+}
+
+// remove - unregister VID if it is still registered to `tunnel`, return whether it is removed
+func (t *tunnelTable) remove(VID uint16, tunnel *Tunnel) bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.tunnels[VID] != tunnel {
+		return false
+	}
+	delete(t.tunnels, VID)
+	return true
+}
+
+// snapshot - all registered tunnels
+func (t *tunnelTable) snapshot() []*Tunnel {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	result := make([]*Tunnel, 0, len(t.tunnels))
+	for _, tunnel := range t.tunnels {
+		result = append(result, tunnel)
+	}
+	return result
+}
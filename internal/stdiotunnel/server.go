@@ -0,0 +1,87 @@
+package stdiotunnel
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/rectcircle/stdiotunnel/internal/stdiotunnel/protocol"
+	"github.com/rectcircle/stdiotunnel/internal/variable"
+	"github.com/rectcircle/stdiotunnel/tools"
+	"golang.org/x/term"
+)
+
+// StartServer - run server on stdio, every virtual connection is forwarded to `host:port`
+// log is written to `logFile`, if it is empty, log to stderr unless stderr is a terminal (the stdio link of interactive mode)
+// `openTimeout` is the dial timeout, 0 means no timeout
+// `permits` are patterns of targets which clients may ask instead of `host:port`, see protocol.Bridge.PermitTargets
+func StartServer(host string, port uint16, logFile string, openTimeout time.Duration, permits []string) {
+	if logFile != "" {
+		f, err := os.OpenFile(logFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		tools.LogAndExitIfErr(err)
+		defer f.Close()
+		log.SetOutput(f)
+	} else if term.IsTerminal(int(os.Stderr.Fd())) {
+		log.SetOutput(ioutil.Discard)
+	}
+	tools.LogAndExitIfErr(protocol.CheckTargetPatterns(permits))
+	// The stdio of interactive mode is a tty, its line discipline translates CR/LF and handles ^C, ^S/^Q and ^D
+	if term.IsTerminal(int(os.Stdin.Fd())) {
+		state, err := term.MakeRaw(int(os.Stdin.Fd()))
+		tools.LogAndExitIfErr(err)
+		defer term.Restore(int(os.Stdin.Fd()), state)
+	}
+	// Notice client the server is ready, after this, stdio only transport segment
+	encoding, checksum, err := serverHandshake(os.Stdin, os.Stdout)
+	tools.LogAndExitIfErr(err)
+	bridge := protocol.NewBridgeWithOptions(encodeLink(&stdioConn{os.Stdin, os.Stdout}, encoding), false, protocol.BridgeOptions{Checksum: checksum})
+	bridge.OpenTimeout = openTimeout
+	tools.LogAndExitIfErr(bridge.PermitTargets(permits))
+	log.Printf("Start a Stdio Tunnel Server Success! forward to %s, encoding %s, checksum %v\n", tools.ToAddressString(host, port), encoding, checksum)
+	bridge.ServerServe(host, port)
+	log.Printf("Stdio Tunnel Server exit: stdio has closed\n")
+}
+
+// serverHandshake - echo the hello trigger, read the line `NONCE [ENCODING] [checksum]` of client,
+// echo the ready token and return the link options asked by the client
+// `in` is read byte by byte, so that no segment after the line is consumed
+func serverHandshake(in io.Reader, out io.Writer) (encoding string, checksum bool, err error) {
+	if _, err = io.WriteString(out, variable.StdoutHelloTrigger); err != nil {
+		return
+	}
+	var line []byte
+	b := make([]byte, 1)
+	for {
+		if _, err = io.ReadFull(in, b); err != nil {
+			return
+		}
+		if b[0] == '\n' || b[0] == '\r' {
+			if len(line) > 0 {
+				break
+			}
+			continue
+		}
+		if len(line) >= 64 {
+			return "", false, errors.New("handshake: the nonce line is too long")
+		}
+		line = append(line, b[0])
+	}
+	fields := strings.Fields(string(line))
+	encoding = EncodingRaw
+	for _, field := range fields[1:] {
+		if field == "checksum" {
+			checksum = true
+		} else if err = CheckEncoding(field); err != nil {
+			return "", false, fmt.Errorf("handshake: %w", err)
+		} else {
+			encoding = field
+		}
+	}
+	_, err = io.WriteString(out, readyToken(fields[0]))
+	return
+}
@@ -0,0 +1,123 @@
+package stdiotunnel
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+
+	"github.com/rectcircle/stdiotunnel/internal/stdiotunnel/protocol"
+)
+
+// SOCKS5 (RFC 1928) constants used by dynamic forwards
+const (
+	socksVersion      = 0x05
+	socksMethodNoAuth = 0x00
+	socksNoAcceptable = 0xff
+	socksCmdConnect   = 0x01
+	socksAtypIPv4     = 0x01
+	socksAtypDomain   = 0x03
+	socksAtypIPv6     = 0x04
+	socksReplySuccess = 0x00
+	// reply codes of failures
+	socksReplyGeneralFailure      = 0x01
+	socksReplyNotAllowed          = 0x02
+	socksReplyHostUnreachable     = 0x04
+	socksReplyRefused             = 0x05
+	socksReplyTTLExpired          = 0x06
+	socksReplyCommandNotSupported = 0x07
+)
+
+// socksHandshake - serve the SOCKS5 handshake of a dynamic forward connection and return the requested `host:port`
+// only no-auth and CONNECT are supported, the CONNECT request is replied by socksReply after the server opens the target
+func socksHandshake(conn io.ReadWriter) (target string, err error) {
+	// greeting: VER NMETHODS METHODS...
+	header := make([]byte, 2)
+	if _, err = io.ReadFull(conn, header); err != nil {
+		return
+	}
+	if header[0] != socksVersion {
+		return "", fmt.Errorf("unsupported socks version %d", header[0])
+	}
+	methods := make([]byte, header[1])
+	if _, err = io.ReadFull(conn, methods); err != nil {
+		return
+	}
+	noAuth := false
+	for _, m := range methods {
+		noAuth = noAuth || m == socksMethodNoAuth
+	}
+	if !noAuth {
+		conn.Write([]byte{socksVersion, socksNoAcceptable})
+		return "", errors.New("socks client does not support no-auth")
+	}
+	if _, err = conn.Write([]byte{socksVersion, socksMethodNoAuth}); err != nil {
+		return
+	}
+	// request: VER CMD RSV ATYP DST.ADDR DST.PORT
+	request := make([]byte, 4)
+	if _, err = io.ReadFull(conn, request); err != nil {
+		return
+	}
+	var host string
+	switch request[3] {
+	case socksAtypIPv4, socksAtypIPv6:
+		ip := make(net.IP, net.IPv4len)
+		if request[3] == socksAtypIPv6 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		if _, err = io.ReadFull(conn, ip); err != nil {
+			return
+		}
+		host = ip.String()
+	case socksAtypDomain:
+		length := make([]byte, 1)
+		if _, err = io.ReadFull(conn, length); err != nil {
+			return
+		}
+		domain := make([]byte, length[0])
+		if _, err = io.ReadFull(conn, domain); err != nil {
+			return
+		}
+		host = string(domain)
+	default:
+		return "", fmt.Errorf("unsupported socks address type %d", request[3])
+	}
+	port := make([]byte, 2)
+	if _, err = io.ReadFull(conn, port); err != nil {
+		return
+	}
+	if request[1] != socksCmdConnect {
+		writeSocksReply(conn, socksReplyCommandNotSupported)
+		return "", fmt.Errorf("unsupported socks command %d", request[1])
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), nil
+}
+
+// socksReply - reply the CONNECT request, `err` is nil if the server has opened the target,
+// or the reason the tunnel is closed before, see protocol.Bridge.ClientOpenTunnel
+func socksReply(conn io.Writer, err error) error {
+	if err == nil {
+		return writeSocksReply(conn, socksReplySuccess)
+	}
+	switch protocol.NewCloseError(err).Code {
+	case protocol.CloseCodeRefused:
+		return writeSocksReply(conn, socksReplyRefused)
+	case protocol.CloseCodeUnreachable:
+		return writeSocksReply(conn, socksReplyHostUnreachable)
+	case protocol.CloseCodePolicyDenied:
+		return writeSocksReply(conn, socksReplyNotAllowed)
+	case protocol.CloseCodeTimeout:
+		return writeSocksReply(conn, socksReplyTTLExpired)
+	default:
+		return writeSocksReply(conn, socksReplyGeneralFailure)
+	}
+}
+
+// writeSocksReply - write a reply without bound address, clients of CONNECT don't use it
+func writeSocksReply(conn io.Writer, reply byte) error {
+	_, err := conn.Write([]byte{socksVersion, reply, 0, socksAtypIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
@@ -0,0 +1,158 @@
+package stdiotunnel
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/rectcircle/stdiotunnel/internal/stdiotunnel/protocol"
+)
+
+func TestSocksHandshake(t *testing.T) {
+	greeting := []byte{socksVersion, 2, 0x02, socksMethodNoAuth}
+	tests := []struct {
+		name       string
+		input      []byte
+		wantTarget string
+		// wantOutput - replies written by the handshake
+		wantOutput []byte
+		wantErr    bool
+	}{
+		{
+			name:       "domain",
+			input:      append(greeting, socksVersion, socksCmdConnect, 0, socksAtypDomain, 11, 'd', 'b', '.', 'i', 'n', 't', 'e', 'r', 'n', 'a', 'l', 0x15, 0x38),
+			wantTarget: "db.internal:5432",
+			wantOutput: []byte{socksVersion, socksMethodNoAuth},
+		},
+		{
+			name:       "ipv4",
+			input:      append(greeting, socksVersion, socksCmdConnect, 0, socksAtypIPv4, 10, 0, 0, 8, 0, 80),
+			wantTarget: "10.0.0.8:80",
+			wantOutput: []byte{socksVersion, socksMethodNoAuth},
+		},
+		{
+			name:       "ipv6",
+			input:      append(greeting, socksVersion, socksCmdConnect, 0, socksAtypIPv6, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0, 22),
+			wantTarget: "[::1]:22",
+			wantOutput: []byte{socksVersion, socksMethodNoAuth},
+		},
+		{
+			name:       "no acceptable method",
+			input:      []byte{socksVersion, 1, 0x02},
+			wantOutput: []byte{socksVersion, socksNoAcceptable},
+			wantErr:    true,
+		},
+		{
+			name:       "bind",
+			input:      append(greeting, socksVersion, 0x02, 0, socksAtypIPv4, 10, 0, 0, 8, 0, 80),
+			wantOutput: []byte{socksVersion, socksMethodNoAuth, socksVersion, socksReplyCommandNotSupported, 0, socksAtypIPv4, 0, 0, 0, 0, 0, 0},
+			wantErr:    true,
+		},
+		{
+			name:    "socks4",
+			input:   []byte{0x04, socksCmdConnect},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := &bufferLink{input: bytes.NewReader(tt.input)}
+			target, err := socksHandshake(conn)
+			if (err != nil) != tt.wantErr || target != tt.wantTarget {
+				t.Errorf("socksHandshake() = %q, %v, want %q, error %v", target, err, tt.wantTarget, tt.wantErr)
+			}
+			// CONNECT is not replied by the handshake
+			if !bytes.Equal(conn.output.Bytes(), tt.wantOutput) {
+				t.Errorf("output = %v, want %v", conn.output.Bytes(), tt.wantOutput)
+			}
+		})
+	}
+}
+
+func TestSocksReply(t *testing.T) {
+	for err, want := range map[error]byte{
+		nil: socksReplySuccess,
+		&net.OpError{Op: "dial", Err: &net.DNSError{Err: "no such host", Name: "db"}}: socksReplyHostUnreachable,
+		&protocol.CloseError{Code: protocol.CloseCodeRefused}:                         socksReplyRefused,
+		&protocol.CloseError{Code: protocol.CloseCodeUnreachable}:                     socksReplyHostUnreachable,
+		&protocol.CloseError{Code: protocol.CloseCodePolicyDenied}:                    socksReplyNotAllowed,
+		&protocol.CloseError{Code: protocol.CloseCodeTimeout}:                         socksReplyTTLExpired,
+		&protocol.CloseError{Code: protocol.CloseCodeExhausted}:                       socksReplyGeneralFailure,
+		io.ErrUnexpectedEOF: socksReplyGeneralFailure,
+	} {
+		conn := &bufferLink{}
+		socksReply(conn, err)
+		if got := conn.output.Bytes(); len(got) != 10 || got[1] != want {
+			t.Errorf("socksReply(%v) = %v, want reply %d", err, got, want)
+		}
+	}
+}
+
+// serveEcho - a TCP echo server on loopback, closed with the test
+func serveEcho(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+// TestSocksOpen - the CONNECT reply waits the server, and tells why it can't open the target
+func TestSocksOpen(t *testing.T) {
+	echo := serveEcho(t)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed := listener.Addr().String()
+	listener.Close()
+
+	clientLink, serverLink := net.Pipe()
+	client := protocol.NewBridge(clientLink, true)
+	server := protocol.NewBridge(serverLink, false)
+	if err := server.PermitTargets([]string{echo, closed}); err != nil {
+		t.Fatal(err)
+	}
+	go server.ServerServe("127.0.0.1", 1)
+	go client.ClientServe()
+	defer clientLink.Close()
+
+	for target, want := range map[string]byte{
+		echo:             socksReplySuccess,
+		closed:           socksReplyRefused,
+		"db.internal:22": socksReplyNotAllowed,
+	} {
+		socksClient, conn := net.Pipe()
+		_, Closed := client.ClientOpenTunnel(conn, protocol.TunnelOptions{Target: target}, func(err error) { socksReply(conn, err) })
+		reply := make([]byte, 10)
+		if _, err := io.ReadFull(socksClient, reply); err != nil {
+			t.Fatalf("%s: read reply: %v", target, err)
+		}
+		if reply[1] != want {
+			t.Errorf("%s: reply %d, want %d", target, reply[1], want)
+		}
+		if want == socksReplySuccess {
+			socksClient.Write([]byte("hi"))
+			echoed := make([]byte, 2)
+			if _, err := io.ReadFull(socksClient, echoed); err != nil || string(echoed) != "hi" {
+				t.Errorf("%s: echo %q, %v", target, echoed, err)
+			}
+			socksClient.Close()
+		}
+		<-Closed
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"os"
 	"os/user"
 	"path"
+	"time"
 )
 
 var (
@@ -13,10 +14,64 @@ var (
 	ConfigBaseDir string
 	// SSHHostKeyFileName - simple ssh ras private key file name
 	SSHHostKeyFileName string = "ssh_host_rsa_key"
-	// StdoutReadyTrigger - if stdiotunnel echo this string, then server ready
-	StdoutReadyTrigger string = "::stdiotunnel-server-ready::"
+	// SSHAuthorizedKeysFileName - simple ssh authorized public keys file name, in the format of sshd
+	SSHAuthorizedKeysFileName string = "authorized_keys"
+	// SSHPasswordFileName - simple ssh password file name, lines of `USER:BCRYPT_HASH`
+	SSHPasswordFileName string = "sshd_passwd"
+	// SSHSessionEnvName - env request of simple ssh naming a persistent session to start or reattach
+	SSHSessionEnvName string = "STDIOTUNNEL_SESSION"
+	// SSHSessionCommand - exec command of simple ssh, `stdiotunnel-session NAME` starts or reattaches a persistent session
+	SSHSessionCommand string = "stdiotunnel-session"
+	// SSHSessionScrollbackSize - bytes of the last output of a persistent session replayed on reattach
+	SSHSessionScrollbackSize = 64 * 1024
+	// ConfigFileName - config file name of profiles
+	ConfigFileName string = "config"
+	// ControlSocketFileName - default unix socket file name of control interface
+	ControlSocketFileName string = "control.sock"
+	// StdoutHelloTrigger - server echo this string, then read a nonce line of client from stdin
+	StdoutHelloTrigger string = "::stdiotunnel-server-hello::"
+	// StdoutReadyTrigger - format of the ready token, the argument is the proof of the nonce,
+	// if stdiotunnel echo the token, then server ready, the terminal echo of the nonce never matches it
+	StdoutReadyTrigger string = "::stdiotunnel-server-ready:%s::"
 	// MaxVirtualConnection - max virtual connection count
 	MaxVirtualConnection = uint16(math.MaxUint16 - 1)
+	// OpenTimeout - client waits MethodAckConn and server dials target within this duration, 0 means no timeout
+	OpenTimeout = 10 * time.Second
+	// InitTimeout - the server must be ready within this duration after the command started, 0 means no timeout,
+	// by default it only applies to detached clients (e.g. cron, daemon), a user at the terminal may take longer to log in and ends a stuck init with ^C
+	InitTimeout = 2 * time.Minute
+	// InitOutputTailSize - how many bytes of the last command output are reported when the init stage failed
+	InitOutputTailSize = 2048
+	// AuthTimeout - with auth rules, the next prompt or the ready trigger must appear within this duration
+	AuthTimeout = 30 * time.Second
+	// BootstrapPrompt - default regexp of the remote shell prompt, the bootstrap starts when it appears
+	BootstrapPrompt = `[$#%>] ?$`
+	// BootstrapChunkSize - bytes of binary uploaded and verified at a time by the bootstrap
+	BootstrapChunkSize = 48 * 1024
+	// BootstrapChunkRetries - how many times a corrupted chunk is uploaded again
+	BootstrapChunkRetries = 3
+	// FrameDataSize - max bytes carried by a frame of a printable link encoding, the encoded line stays below the 4096 bytes of a canonical tty line
+	FrameDataSize = 768
+	// VIDQuarantine - a released VID is not reused within this duration
+	VIDQuarantine = 5 * time.Second
+	// WriteQueueLength - how many segments can wait for the stdio writer
+	WriteQueueLength = 64
+	// MaxWriteBatchSize - max bytes coalesced into one stdio write (a single large segment may exceed it)
+	MaxWriteBatchSize = 64 * 1024
+	// MaxWriteBatchDelay - max time spent collecting queued segments into one stdio write
+	MaxWriteBatchDelay = 2 * time.Millisecond
+	// MaxSegmentPayload - larger MethodSendData payload is split into chunks, so one tunnel can't hold the link
+	MaxSegmentPayload = 16 * 1024
+	// MaxTunnelQueueSize - max payload bytes queued per tunnel before its writer blocks
+	MaxTunnelQueueSize = 64 * 1024
+	// DefaultTunnelPriority - scheduling weight of a tunnel without priority
+	DefaultTunnelPriority = uint8(1)
+	// DaemonRestartMinDelay - first delay before the daemon restarts a failed session, doubled on each failure
+	DaemonRestartMinDelay = time.Second
+	// DaemonRestartMaxDelay - max delay before the daemon restarts a failed session, a session running longer resets the delay
+	DaemonRestartMaxDelay = time.Minute
+	// DaemonConfigPollInterval - how often the daemon checks the config file for changes
+	DaemonConfigPollInterval = 2 * time.Second
 	// EnableTraceLog - whether enable trace log
 	EnableTraceLog = false
 )
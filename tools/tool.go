@@ -2,8 +2,10 @@ package tools
 
 import (
 	"errors"
+	"fmt"
 	"io/ioutil"
 	"log"
+	"math"
 	"net"
 	"os"
 	"os/exec"
@@ -115,6 +117,31 @@ func ReadOrCreateFile(path string, f func() []byte) ([]byte, error) {
 	return content, nil
 }
 
+// ParseByteSize - parse "512", "64K", "1.5M", "2G" (1024 based, case insensitive, optional "B" suffix) to bytes
+func ParseByteSize(s string) (uint64, error) {
+	str := strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(s)), "B")
+	unit := float64(1)
+	if l := len(str); l > 0 {
+		switch str[l-1] {
+		case 'K':
+			unit = 1 << 10
+		case 'M':
+			unit = 1 << 20
+		case 'G':
+			unit = 1 << 30
+		}
+		if unit != 1 {
+			str = str[:l-1]
+		}
+	}
+	n, err := strconv.ParseFloat(str, 64)
+	// float64(math.MaxUint64) is 2^64, which overflows uint64 too
+	if err != nil || n < 0 || math.IsNaN(n) || math.IsInf(n, 0) || n*unit >= math.MaxUint64 {
+		return 0, fmt.Errorf("invalid byte size %q", s)
+	}
+	return uint64(n * unit), nil
+}
+
 // LogAndExitIfErr - will log and exit if err != nil
 func LogAndExitIfErr(err error) {
 	if err != nil {
@@ -131,3 +131,37 @@ func TestReadOrCreateFile(t *testing.T) {
 		})
 	}
 }
+
+func TestParseByteSize(t *testing.T) {
+	tests := []struct {
+		name    string
+		s       string
+		want    uint64
+		wantErr bool
+	}{
+		{name: "plain", s: "512", want: 512},
+		{name: "kilo", s: "64K", want: 64 * 1024},
+		{name: "fraction mega with B", s: "1.5mb", want: 1536 * 1024},
+		{name: "giga", s: "2G", want: 2 << 30},
+		{name: "zero", s: "0", want: 0},
+		{name: "invalid", s: "fast", wantErr: true},
+		{name: "negative", s: "-1K", wantErr: true},
+		{name: "nan", s: "NaN", wantErr: true},
+		{name: "inf", s: "Inf", wantErr: true},
+		{name: "negative inf", s: "-inf", wantErr: true},
+		{name: "too large", s: "1e30", wantErr: true},
+		{name: "too large by unit", s: "17179869184G", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseByteSize(tt.s)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ParseByteSize() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if got != tt.want {
+				t.Errorf("ParseByteSize() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}